@@ -0,0 +1,153 @@
+package pbf
+
+import (
+	"github.com/ninchat/pbf/op"
+)
+
+// Analysis of a program's control flow and field usage.  An instruction is
+// reachable if some sequence of jumps leads to it; the values of the registers
+// and the status flag aren't taken into account.  Thus a program may always
+// yield the same result even if it has reachable ReturnFalse and ReturnTrue
+// instructions, e.g. if it tests a tautology such as "a == 1 || a != 1".
+type Analysis struct {
+	Reachable     []int  // Offsets of the reachable instructions in ascending order.
+	UnusedFields  []int  // Indexes of the field specs which aren't accessed by reachable instructions.
+	Unused        []Span // Unreachable code and constants which aren't loaded by reachable instructions.
+	MaxPathLength int    // Instruction count of the longest execution path when every loop iterates at most once.
+	NoReturnFalse bool   // There is no reachable ReturnFalse instruction.
+	NoReturnTrue  bool   // There is no reachable ReturnTrue instruction.
+}
+
+// Span of bytecode.
+type Span struct {
+	Offset int
+	Length int
+}
+
+// Analyze verifies a PBF bytecode program (see NewProgram) and analyzes it.
+func Analyze(bytecode []byte) (*Analysis, error) {
+	prog, err := NewProgram(bytecode)
+	if err != nil {
+		return nil, err
+	}
+	return prog.analyze(), nil
+}
+
+func (p *program) analyze() *Analysis {
+	var (
+		a         = &Analysis{NoReturnFalse: true, NoReturnTrue: true}
+		reached   = make([]bool, len(p.bytecode))
+		used      = make([]bool, len(p.bytecode)) // Reachable instructions and loaded constants.
+		fieldused = make([]bool, p.fieldcount)
+	)
+
+	// All jumps except LoopBack are forward, and LoopBack targets a LoopNext
+	// instruction which has been reached.
+	reached[p.insnoffset] = true
+
+	for off := p.insnoffset; off < len(p.bytecode); off++ {
+		if !reached[off] {
+			continue
+		}
+		a.Reachable = append(a.Reachable, off)
+
+		opcode, arg, end := p.instructionAt(off)
+		for i := off; i < end; i++ {
+			used[i] = true
+		}
+
+		if opcode.HasFieldIndex() {
+			fieldused[arg] = true
+		}
+
+		switch {
+		case opcode == op.ReturnFalse:
+			a.NoReturnFalse = false
+		case opcode == op.ReturnTrue:
+			a.NoReturnTrue = false
+
+		case opcode == op.LoadConstBytes:
+			offset, n := unpackBytesRef(arg)
+			for i := int(offset); i < int(offset+n); i++ {
+				used[i] = true
+			}
+
+		case opcode.IsSkip():
+			reached[end+int(arg)] = true
+
+		case opcode == op.LoopNext:
+			index, exit := op.SplitLoopNextArg(arg)
+			fieldused[index] = true
+			reached[end+int(exit)] = true
+		}
+
+		if opcode.Continues() {
+			reached[end] = true
+		}
+	}
+
+	for i, ok := range fieldused {
+		if !ok {
+			a.UnusedFields = append(a.UnusedFields, i)
+		}
+	}
+
+	for off := p.insnoffset; off < len(p.bytecode); off++ {
+		if !used[off] {
+			if n := len(a.Unused); n > 0 && a.Unused[n-1].Offset+a.Unused[n-1].Length == off {
+				a.Unused[n-1].Length++
+			} else {
+				a.Unused = append(a.Unused, Span{off, 1})
+			}
+		}
+	}
+
+	a.MaxPathLength = p.maxPathLength(a.Reachable)
+	return a
+}
+
+// maxPathLength from the first instruction.  A path which executes LoopBack
+// continues from the exit of the loop, so the control flow graph is acyclic and
+// the instructions can be processed in reverse order.
+func (p *program) maxPathLength(reachable []int) int {
+	length := make(map[int]int, len(reachable))
+
+	for i := len(reachable) - 1; i >= 0; i-- {
+		off := reachable[i]
+		opcode, arg, end := p.instructionAt(off)
+		n := 0
+
+		switch {
+		case opcode.IsSkip():
+			n = length[end+int(arg)]
+
+		case opcode == op.LoopNext:
+			_, exit := op.SplitLoopNextArg(arg)
+			n = length[end+int(exit)]
+
+		case opcode == op.LoopBack:
+			// LoopNext is executed again, and jumps to the exit.
+			_, next, _ := p.instructionAt(end - int(arg))
+			_, exit := op.SplitLoopNextArg(next)
+			n = 1 + length[end-int(arg)+op.LoopNext.Size()+int(exit)]
+		}
+
+		if opcode.Continues() && length[end] > n {
+			n = length[end]
+		}
+
+		length[off] = 1 + n
+	}
+
+	return length[p.insnoffset]
+}
+
+// instructionAt decodes the instruction at the given offset of verified
+// bytecode.
+func (p *program) instructionAt(off int) (opcode op.Code, arg uint64, end int) {
+	opcode = op.Code(p.bytecode[off])
+	end = off + opcode.Size()
+
+	arg = opcode.Arg(p.bytecode[off+1:])
+	return
+}
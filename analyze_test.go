@@ -0,0 +1,110 @@
+package pbf_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/asm"
+	"github.com/ninchat/pbf/op"
+)
+
+func TestAnalyze(t *testing.T) {
+	a, err := pbf.Analyze([]byte{
+		'P', 'B', 'F', 0,
+		2,
+		1, 0, 0, 0, 0,
+		2, 0, 0, 0, 0, // Unused.
+
+		byte(op.LoadR1FieldScalar), 0, // Offset 15.
+		byte(op.LoadConstScalar1),
+		byte(op.CompareUnsignedEQ),
+		byte(op.SkipTrue), 1, 0,
+		byte(op.ReturnFalse),
+		byte(op.ReturnTrue),
+
+		// Unreachable:
+		byte(op.LoadConstBytes), 33, 0, 0, 0, 2, 0, 0, 0, // Offset 24.
+		'h', 'i',
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := &pbf.Analysis{
+		Reachable:     []int{15, 17, 18, 19, 22, 23},
+		UnusedFields:  []int{1},
+		Unused:        []pbf.Span{{24, 11}},
+		MaxPathLength: 5,
+	}
+	if !reflect.DeepEqual(a, expect) {
+		t.Errorf("%#v", a)
+	}
+}
+
+func TestAnalyzeLoop(t *testing.T) {
+	bytecode, err := asm.Assemble([]byte(`
+	.field q 17
+	.field x 17.Each 1
+	.field s 12
+
+loop:	LoopNext q @done
+	LoadR1FieldScalar x
+	LoadConstScalar 101
+	CompareSignedEQ
+	SkipTrue @found
+	LoopBack @loop
+found:	ReturnTrue
+done:	ReturnTrue
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := pbf.Analyze(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// LoopNext, 4 body instructions, LoopBack, LoopNext and ReturnTrue.
+	if a.MaxPathLength != 8 {
+		t.Error(a.MaxPathLength)
+	}
+	if !a.NoReturnFalse || a.NoReturnTrue {
+		t.Error(a.NoReturnFalse, a.NoReturnTrue)
+	}
+	if len(a.UnusedFields) != 1 || len(a.Unused) != 0 {
+		t.Error(a.UnusedFields, a.Unused)
+	}
+}
+
+func TestAnalyzeTautology(t *testing.T) {
+	// a == 1 || a != 1
+	bytecode, err := asm.Assemble([]byte(`
+	.field a 1
+
+	LoadR1FieldScalar a
+	LoadConstScalar1
+	CompareUnsignedEQ
+	SkipTrue @pass
+	LoadR1FieldScalar a
+	LoadConstScalar1
+	CompareUnsignedNE
+	SkipTrue @pass
+	ReturnFalse
+pass:	ReturnTrue
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := pbf.Analyze(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The register values aren't taken into account.
+	if a.NoReturnFalse || a.NoReturnTrue {
+		t.Error(a.NoReturnFalse, a.NoReturnTrue)
+	}
+}
@@ -0,0 +1,473 @@
+// Package asm implements a textual assembly language for PBF bytecode.
+//
+// Each line contains a directive, an instruction, or nothing.  A line may
+// start with a label followed by a colon, and a semicolon starts a comment
+// which extends to the end of the line.
+//
+// Field specs are declared with the .field directive:
+//
+//	.field [NAME] NODE...
+//
+// where NODE is NUM, NUM.Mod or NUM.Packed.Subtype (e.g. 14.Message 2 or
+// 15.Message 1.Packed.Varint 0.ZigZag).  The last node must be a leaf.  Fields
+// are referenced by name, or by declaration order using the #INDEX syntax.
+//
+// Instructions consist of an opcode name (see package op) and an argument:
+//
+//	LoadR1FieldScalar #0
+//	SkipTrue @label
+//	LoadConstScalar -5
+//	LoadConstScalar 3.14
+//	LoadConstBytes "Hello"
+//	LoadConstBytes @label
+//	AnyFixed32 CompareFloatGT
+//	LoopNext #3 @label
+//	LoopBack @label
+//
+// Integer arguments may be written in decimal or hexadecimal (0x prefix).  A
+// floating-point argument is encoded as IEEE 754 double precision.  A quoted
+// LoadConstBytes argument is interned into the constant pool; a label refers
+// to an inline constant declared with the .const directive:
+//
+//	label: .const "Hello, world!"
+//
+// An inline constant must not be reachable by falling through from the
+// previous instruction.
+//
+// LoopNext takes a loop field and the label of the loop exit.  The label of a
+// LoopBack instruction must mark a LoopNext instruction:
+//
+//	.field each 17
+//	.field x 17.Each 1
+//
+//	loop:	LoopNext each @done
+//		LoadR1FieldScalar x
+//		...
+//		LoopBack @loop
+//	done:	ReturnFalse
+package asm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ninchat/pbf/build"
+	"github.com/ninchat/pbf/field"
+	"github.com/ninchat/pbf/op"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type stmt struct {
+	line  int
+	label string
+	name  string // Directive or opcode name.
+	args  []string
+}
+
+type assembler struct {
+	b      *build.Builder
+	fields []int          // Builder field indexes by declaration order.
+	names  map[string]int // Field declaration order by name.
+	labels map[string]build.Label
+	consts map[string]int // Inline constant lengths by label.
+}
+
+// Assemble source code into bytecode.
+func Assemble(src []byte) ([]byte, error) {
+	stmts, err := parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	a := assembler{
+		b:      build.New(),
+		names:  make(map[string]int),
+		labels: make(map[string]build.Label),
+		consts: make(map[string]int),
+	}
+
+	// Declare fields and labels before emitting any instructions.
+
+	var pending []string // Labels preceding the current statement.
+
+	for _, s := range stmts {
+		if s.label != "" {
+			if _, dup := a.labels[s.label]; dup {
+				return nil, errorf(s.line, "label %q defined twice", s.label)
+			}
+			a.labels[s.label] = a.b.NewLabel()
+			pending = append(pending, s.label)
+		}
+
+		switch s.name {
+		case "":
+			continue
+
+		case ".field":
+			if err := a.declareField(s); err != nil {
+				return nil, err
+			}
+
+		case ".const":
+			if len(s.args) != 1 {
+				return nil, errorf(s.line, ".const expects one quoted string")
+			}
+			data, err := strconv.Unquote(s.args[0])
+			if err != nil {
+				return nil, errorf(s.line, "invalid string: %s", s.args[0])
+			}
+			for _, l := range pending {
+				a.consts[l] = len(data)
+			}
+		}
+
+		pending = pending[:0]
+	}
+
+	for _, s := range stmts {
+		if s.label != "" {
+			a.b.Mark(a.labels[s.label])
+		}
+
+		switch s.name {
+		case "", ".field":
+
+		case ".const":
+			data, _ := strconv.Unquote(s.args[0])
+			a.b.Data([]byte(data))
+
+		default:
+			if err := a.emit(s); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := a.b.Err(); err != nil {
+			return nil, errorf(s.line, "%v", err)
+		}
+	}
+
+	return a.b.Bytecode()
+}
+
+func (a *assembler) declareField(s stmt) error {
+	args := s.args
+	name := ""
+	if len(args) > 0 && !isDigit(args[0][0]) {
+		name = args[0]
+		args = args[1:]
+		if _, dup := a.names[name]; dup {
+			return errorf(s.line, "field %q declared twice", name)
+		}
+	}
+	if len(args) == 0 {
+		return errorf(s.line, ".field expects a field spec")
+	}
+
+	var spec *build.FieldSpec
+	for _, arg := range args {
+		var err error
+		if spec, err = parseFieldNode(spec, arg); err != nil {
+			return errorf(s.line, "%v", err)
+		}
+	}
+
+	if name != "" {
+		a.names[name] = len(a.fields)
+	}
+	a.fields = append(a.fields, a.b.AddField(spec))
+
+	if err := a.b.Err(); err != nil {
+		return errorf(s.line, "%v", err)
+	}
+	return nil
+}
+
+func parseFieldNode(parent *build.FieldSpec, s string) (*build.FieldSpec, error) {
+	parts := strings.Split(s, ".")
+
+	num, err := strconv.ParseInt(parts[0], 0, 32)
+	if err != nil || num < 0 {
+		return nil, fmt.Errorf("invalid field number: %s", parts[0])
+	}
+
+	var mod field.Mod
+	if len(parts) > 1 {
+		if mod, err = parseMod(parts[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	var subtype protowire.Type
+	if mod == field.ModPacked {
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("packed field node lacks subtype: %s", s)
+		}
+		var ok bool
+		if subtype, ok = field.ParseSubtype(parts[2]); !ok {
+			return nil, fmt.Errorf("unknown packed subtype: %s", parts[2])
+		}
+	} else if len(parts) > 2 {
+		return nil, fmt.Errorf("invalid field node: %s", s)
+	}
+
+	spec := &build.FieldSpec{
+		Num:     int32(num),
+		Mod:     mod,
+		Subtype: subtype,
+		Parent:  parent,
+	}
+	return spec, nil
+}
+
+func parseMod(s string) (field.Mod, error) {
+	for m := field.Mod(0); m.IsValid(); m++ {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown field mod: %s", s)
+}
+
+func (a *assembler) emit(s stmt) error {
+	code, ok := op.ParseCode(s.name)
+	if !ok {
+		return errorf(s.line, "unknown opcode: %s", s.name)
+	}
+
+	if code < 64 {
+		if len(s.args) != 0 {
+			return errorf(s.line, "%s doesn't take an argument", code)
+		}
+		a.b.Op(code)
+		return nil
+	}
+
+	if code == op.LoopNext {
+		if len(s.args) != 2 {
+			return errorf(s.line, "%s expects a field and a label", code)
+		}
+		index, err := a.fieldIndex(s.args[0])
+		if err != nil {
+			return errorf(s.line, "%v", err)
+		}
+		l, err := a.label(s.args[1])
+		if err != nil {
+			return errorf(s.line, "%v", err)
+		}
+		a.b.OpLoopNext(index, l)
+		return nil
+	}
+
+	if len(s.args) != 1 {
+		return errorf(s.line, "%s expects one argument", code)
+	}
+	arg := s.args[0]
+
+	switch {
+	case code.HasFieldIndex():
+		index, err := a.fieldIndex(arg)
+		if err != nil {
+			return errorf(s.line, "%v", err)
+		}
+		a.b.OpField(code, index)
+
+	case code.IsSkip():
+		l, err := a.label(arg)
+		if err != nil {
+			return errorf(s.line, "%v", err)
+		}
+		a.b.OpSkip(code, l)
+
+	case code.IsQuantifier():
+		cmp, ok := op.ParseCode(arg)
+		if !ok || !cmp.IsCompare() {
+			return errorf(s.line, "expected comparison opcode: %s", arg)
+		}
+		a.b.OpQuantifier(code, cmp)
+
+	case code == op.LoopBack:
+		l, err := a.label(arg)
+		if err != nil {
+			return errorf(s.line, "%v", err)
+		}
+		a.b.OpLoopBack(l)
+
+	case code == op.LoadConstScalar:
+		value, err := parseScalar(arg)
+		if err != nil {
+			return errorf(s.line, "%v", err)
+		}
+		a.b.LoadConstScalar(value)
+
+	case code == op.LoadConstBytes:
+		if strings.HasPrefix(arg, "@") {
+			l, err := a.label(arg)
+			if err != nil {
+				return errorf(s.line, "%v", err)
+			}
+			n, found := a.consts[arg[1:]]
+			if !found {
+				return errorf(s.line, "label doesn't mark a .const directive: %s", arg)
+			}
+			a.b.LoadConstBytesAt(l, n)
+		} else {
+			data, err := strconv.Unquote(arg)
+			if err != nil {
+				return errorf(s.line, "invalid string: %s", arg)
+			}
+			a.b.LoadConstBytes([]byte(data))
+		}
+
+	default:
+		return errorf(s.line, "unsupported opcode: %s", code)
+	}
+
+	return nil
+}
+
+func (a *assembler) fieldIndex(arg string) (int, error) {
+	var i int
+
+	if strings.HasPrefix(arg, "#") {
+		n, err := strconv.Atoi(arg[1:])
+		if err != nil {
+			return 0, fmt.Errorf("invalid field reference: %s", arg)
+		}
+		i = n
+	} else {
+		n, found := a.names[arg]
+		if !found {
+			return 0, fmt.Errorf("unknown field: %s", arg)
+		}
+		i = n
+	}
+
+	if i < 0 || i >= len(a.fields) {
+		return 0, fmt.Errorf("field reference out of bounds: %s", arg)
+	}
+	return a.fields[i], nil
+}
+
+func (a *assembler) label(arg string) (build.Label, error) {
+	if !strings.HasPrefix(arg, "@") {
+		return 0, fmt.Errorf("expected label reference: %s", arg)
+	}
+	l, found := a.labels[arg[1:]]
+	if !found {
+		return 0, fmt.Errorf("unknown label: %s", arg)
+	}
+	return l, nil
+}
+
+func parseScalar(s string) (uint64, error) {
+	if u, err := strconv.ParseUint(s, 0, 64); err == nil {
+		return u, nil
+	}
+	if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return uint64(i), nil
+	}
+	if !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "-0x") {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return math.Float64bits(f), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid scalar value: %s", s)
+}
+
+// parse source code into statements.
+func parse(src string) ([]stmt, error) {
+	var stmts []stmt
+
+	for i, text := range strings.Split(src, "\n") {
+		s := stmt{line: i + 1}
+
+		tokens, err := tokenize(text)
+		if err != nil {
+			return nil, errorf(s.line, "%v", err)
+		}
+
+		if len(tokens) > 0 && strings.HasSuffix(tokens[0], ":") {
+			s.label = strings.TrimSuffix(tokens[0], ":")
+			if !isIdent(s.label) {
+				return nil, errorf(s.line, "invalid label: %s", tokens[0])
+			}
+			tokens = tokens[1:]
+		}
+
+		if len(tokens) > 0 {
+			s.name = tokens[0]
+			s.args = tokens[1:]
+		}
+
+		if s.label != "" || s.name != "" {
+			stmts = append(stmts, s)
+		}
+	}
+
+	return stmts, nil
+}
+
+// tokenize a line.  Quoted strings are returned as single tokens.
+func tokenize(line string) ([]string, error) {
+	var tokens []string
+
+	for {
+		line = strings.TrimLeft(line, " \t\r")
+		if line == "" || line[0] == ';' {
+			return tokens, nil
+		}
+
+		if line[0] == '"' {
+			n, err := quotedLen(line)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, line[:n])
+			line = line[n:]
+			continue
+		}
+
+		n := strings.IndexAny(line, " \t\r;\"")
+		if n < 0 {
+			n = len(line)
+		}
+		tokens = append(tokens, line[:n])
+		line = line[n:]
+	}
+}
+
+func quotedLen(s string) (int, error) {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string")
+}
+
+func isIdent(s string) bool {
+	if s == "" || isDigit(s[0]) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c == '_' || c == '.' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("asm: line %d: %s", line, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,396 @@
+package asm_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/asm"
+	"github.com/ninchat/pbf/internal/test"
+	"github.com/ninchat/pbf/op"
+)
+
+const source = `
+; Field section.
+
+.field 1                                ; #0
+.field b 2
+.field 3
+.field d 4
+.field 5.ZigZag
+.field 9.Float
+.field 11
+.field l 12
+.field 13.Packed.Varint 3
+.field 14.Message 2
+.field 15.Message 1.Packed.Varint 0.ZigZag
+.field 17.Repeated 2.Message 1
+.field 13                               ; Vector.
+.field t 20
+
+; Instruction-and-constant section.
+
+	Skip @begin
+hello:	.const "Hello, world!"
+
+begin:
+	LoadR1FieldScalar #0
+	LoadConstScalar1
+	CompareUnsignedEQ
+	SkipTrue @b
+	ReturnFalse
+
+b:	LoadR1FieldScalar b
+	LoadConstScalar1
+	CompareUnsignedNE
+	SkipTrue @c
+	ReturnFalse
+	.const "\xff"                           ; Unreachable.
+
+c:	LoadR1FieldScalar #2
+	LoadConstScalar 3
+	CompareSignedEQ
+	SkipTrue @d
+	ReturnFalse
+
+d:	LoadR1FieldScalar d
+	LoadConstScalar0
+	CompareSignedLT
+	SkipTrue @e
+	ReturnFalse
+
+e:	LoadR1FieldScalar #4
+	LoadConstScalar -5
+	CompareSignedEQ
+	SkipTrue @i
+	ReturnFalse
+
+i:	LoadR1FieldScalar #5
+	LoadConstScalar 3.1415927410125732      ; float32 cast to float64.
+	CompareFloatEQ
+	SkipTrue @k
+	ReturnFalse
+
+k:	LoadR1FieldBytes #6
+	LoadConstBytes "PBF"
+	CompareBytesEQ
+	SkipTrue @l
+	ReturnFalse
+
+l:	LoadR1FieldBytes l
+	LoadConstBytes @hello
+	CompareBytesEQ
+	SkipTrue @m
+	ReturnFalse
+
+m:	LoadR1FieldScalar #8
+	LoadConstScalar 0x4
+	CompareSignedEQ
+	SkipTrue @n
+	ReturnFalse
+
+n:	LoadR1FieldScalar #9
+	LoadConstScalar 56789
+	CompareSignedEQ
+	SkipTrue @o
+	ReturnFalse
+
+o:	LoadR1FieldScalar #10
+	LoadConstScalar -3
+	CompareSignedEQ
+	SkipTrue @q
+	ReturnFalse
+
+q:	LoadR1FieldScalar #11
+	LoadConstScalar 102
+	CompareSignedEQ
+	SkipTrue @vm
+	ReturnFalse
+
+vm:	LoadR1FieldVector #12
+	LoadConstScalar 4
+	ContainsVarint
+	SkipTrue @vt
+	ReturnFalse
+
+vt:	LoadR1FieldVector t
+	LoadConstScalar 0x40490fdb              ; float32 as is.
+	ContainsFixed32
+	SkipFalseLong @fail
+	LoadConstScalar 5.5                     ; float32 cast to float64.
+	AllFixed32 CompareFloatLE
+	SkipFalse @fail
+	ReturnTrue
+
+fail:	ReturnFalse
+`
+
+func TestAssemble(t *testing.T) {
+	bytecode, err := asm.Assemble([]byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := pbf.NewMachine(prog).Filter(test.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error(ok)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	for _, src := range []string{
+		"Foo",
+		"ReturnTrue 1",
+		".field 1.Message\nReturnTrue",
+		".field 1.Packed 2\nReturnTrue",
+		".field 1.Bogus\nReturnTrue",
+		"LoadR1FieldScalar #0\nReturnTrue",
+		".field x 1\nLoadR1FieldScalar y\nReturnTrue",
+		"Skip @nowhere\nReturnTrue",
+		"x: ReturnTrue\nx: ReturnFalse",
+		"LoadConstScalar 1.2.3\nReturnTrue",
+		"LoadConstBytes \"unterminated\nReturnTrue",
+		"LoadConstBytes @x\nReturnTrue\nx: ReturnFalse",
+		"LoadConstScalar1\n.const \"x\"\nReturnTrue",
+		"LoadConstScalar1",
+		".field 17\n.field 17.Each 1\nx: LoopNext #0\nReturnTrue",
+		".field 17\nLoopBack 5\nReturnTrue",
+		"AnyVarint ReturnTrue\nReturnTrue",
+		".field 17\n.field 17.Each 1\nLoopBack @x\nx: LoopNext #0 @y\ny: ReturnTrue",
+	} {
+		if _, err := asm.Assemble([]byte(src)); err == nil {
+			t.Errorf("no error: %q", src)
+		} else if !strings.HasPrefix(err.Error(), "asm: ") && !strings.HasPrefix(err.Error(), "build: ") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	bytecode, err := asm.Assemble([]byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listing, err := asm.Disassemble(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		".field 15.Message 1.Packed.Varint 0.ZigZag",
+		"#10 = .15 Message[.1 Packed Varint[.0 ZigZag]]",
+		"LoadConstScalar -5 ",
+		"LoadConstScalar 3.1415927410125732 ",
+		"LoadConstScalar 0x40490fdb ",
+		"LoadConstBytes \"Hello, world!\" ",
+		".const \"\\xff\"",
+		"AllFixed32 CompareFloatLE ",
+		"LoadConstScalar 5.5 ",
+	} {
+		if !strings.Contains(string(listing), s) {
+			t.Errorf("listing doesn't contain %q", s)
+		}
+	}
+
+	bytecode2, err := asm.Assemble(listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prog, err := pbf.NewProgram(bytecode2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := pbf.NewMachine(prog).Filter(test.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error(ok)
+	}
+}
+
+func TestDisassembleWide(t *testing.T) {
+	var src strings.Builder
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&src, ".field %d\n", 1000+i)
+	}
+	src.WriteString(`
+.field a 1
+	CheckFieldWide #299
+	SkipTrue @found
+	ReturnFalse
+found:
+	LoadR1FieldScalar a
+	LoadConstScalar1
+	CompareUnsignedEQ
+	SkipFalseLong @fail
+	ReturnTrue
+fail:
+	ReturnFalse
+`)
+
+	bytecode, err := asm.Assemble([]byte(src.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bytecode[:4]) != "PBF\x01" {
+		t.Errorf("%q", bytecode[:4])
+	}
+
+	listing, err := asm.Disassemble(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		"; Bytecode size 1534, 301 fields, instructions at offset 1511.\n",
+		"CheckFieldWide #299 ",
+		"LoadR1FieldScalarWide #300 ",
+		"SkipFalseLong @L1533 ",
+	} {
+		if !strings.Contains(string(listing), s) {
+			t.Errorf("listing doesn't contain %q", s)
+		}
+	}
+
+	bytecode2, err := asm.Assemble(listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bytecode2) != string(bytecode) {
+		t.Error("reassembled bytecode differs")
+	}
+
+	prog, err := pbf.NewProgram(bytecode2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := pbf.NewMachine(prog).Filter(test.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error(ok)
+	}
+}
+
+func TestDisassembleLoop(t *testing.T) {
+	const src = `
+.field q 17
+.field x 17.Each 1
+
+loop:	LoopNext q @done
+	LoadR1FieldScalar x
+	LoadConstScalar 101
+	CompareSignedGT
+	SkipFalse @next
+	ReturnTrue
+next:	LoopBack @loop
+done:	ReturnFalse
+`
+
+	bytecode, err := asm.Assemble([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listing, err := asm.Disassemble(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		".field 17.Each 1",
+		"#1 = .17 Each[.1]",
+		"LoopNext #0 @L54 ",
+		"LoopBack @L20 ",
+		"; 45 -> 20\n",
+	} {
+		if !strings.Contains(string(listing), s) {
+			t.Errorf("listing doesn't contain %q", s)
+		}
+	}
+
+	bytecode2, err := asm.Assemble(listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bytecode2) != string(bytecode) {
+		t.Error("reassembled bytecode differs")
+	}
+
+	prog, err := pbf.NewProgram(bytecode2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := pbf.NewMachine(prog).Filter(test.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error(ok)
+	}
+}
+
+func TestDisassembleOverlapping(t *testing.T) {
+	for _, skip := range []op.Code{op.SkipFalse, op.SkipTrue} {
+		// The jump targets the argument of LoadConstScalar, which is ReturnTrue.
+		bytecode := []byte{
+			'P', 'B', 'F', 0, 0,
+			byte(op.LoadConstScalar1),
+			byte(op.CompareFloatNaN),
+			byte(skip), 1, 0,
+			byte(op.LoadConstScalar), byte(op.ReturnTrue), 0, 0, 0, 0, 0, 0, 0,
+			byte(op.ReturnFalse),
+		}
+
+		listing, err := asm.Disassemble(bytecode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, s := range []string{
+			skip.String() + " @L11 ",
+			"\tSkip @L19 ",
+			"L11:\n\tReturnTrue ",
+			"L19:\n\tReturnFalse ",
+		} {
+			if !strings.Contains(string(listing), s) {
+				t.Errorf("listing doesn't contain %q", s)
+			}
+		}
+
+		bytecode2, err := asm.Assemble(listing)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var results []bool
+		for _, b := range [][]byte{bytecode, bytecode2} {
+			prog, err := pbf.NewProgram(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, err := pbf.NewMachine(prog).Filter(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, ok)
+		}
+		if results[0] != (skip == op.SkipFalse) || results[1] != results[0] {
+			t.Error(skip, results)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/build"
+	"github.com/ninchat/pbf/field"
+	"github.com/ninchat/pbf/op"
+)
+
+const commentColumn = 40
+
+type disassembler struct {
+	bytecode   []byte
+	insnoffset int
+	insns      map[int]op.Code // Reachable instructions by bytecode offset.
+	targets    map[int]bool    // Jump targets.
+}
+
+// Disassemble bytecode into source code.  The bytecode must be accepted by
+// pbf.NewProgram.  The listing can be assembled back into an equivalent
+// program; offsets, jump targets and constant values are annotated as
+// comments.
+//
+// An instruction may start within the argument of another instruction.  Such
+// instructions are listed one after the other, and a Skip instruction is
+// inserted where execution would otherwise fall through to the wrong one.  The
+// reassembled program doesn't have overlapping instructions.
+func Disassemble(bytecode []byte) ([]byte, error) {
+	if _, err := pbf.NewProgram(bytecode); err != nil {
+		return nil, err
+	}
+
+	specs, insnoffset := build.ParseFieldSection(bytecode)
+
+	d := disassembler{
+		bytecode:   bytecode,
+		insnoffset: insnoffset,
+		insns:      make(map[int]op.Code),
+		targets:    make(map[int]bool),
+	}
+	d.traverse()
+
+	var w bytes.Buffer
+
+	fmt.Fprintf(&w, "; Bytecode size %d, %d fields, instructions at offset %d.\n", len(bytecode), len(specs), d.insnoffset)
+	if len(specs) > 0 {
+		w.WriteString("\n")
+	}
+	for i, spec := range specs {
+		writeLine(&w, ".field "+spec.String(), fmt.Sprintf("#%d = %s", i, fieldPath(spec)))
+	}
+	w.WriteString("\n")
+
+	offsets := make([]int, 0, len(d.insns))
+	for off := range d.insns {
+		offsets = append(offsets, off)
+	}
+	sort.Ints(offsets)
+
+	// Execution continues past overlapping instructions.
+	fallthroughs := make(map[int]bool)
+	for i, off := range offsets {
+		code := d.insns[off]
+		end := off + code.Size()
+		if code.Continues() && i+1 < len(offsets) && offsets[i+1] != end {
+			fallthroughs[off] = true
+			d.targets[end] = true
+		}
+	}
+
+	for i, off := range offsets {
+		if d.targets[off] {
+			fmt.Fprintf(&w, "%s:\n", label(off))
+		}
+
+		code := d.insns[off]
+		end := off + code.Size()
+
+		text, comment := d.instruction(off)
+		writeLine(&w, "\t"+text, comment)
+
+		if fallthroughs[off] {
+			writeLine(&w, fmt.Sprintf("\t%s @%s", op.Skip, label(end)), fmt.Sprintf("-> %d (overlapping instruction at %d)", end, offsets[i+1]))
+		}
+
+		next := len(bytecode)
+		if i+1 < len(offsets) {
+			next = offsets[i+1]
+		}
+		if end < next {
+			writeLine(&w, "\t.const "+strconv.Quote(string(bytecode[end:next])), fmt.Sprint(end))
+		}
+	}
+
+	return w.Bytes(), nil
+}
+
+// traverse all execution paths.
+func (d *disassembler) traverse() {
+	queue := []int{d.insnoffset}
+
+	for len(queue) > 0 {
+		off := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+
+		for {
+			if _, done := d.insns[off]; done {
+				break
+			}
+
+			code := op.Code(d.bytecode[off])
+			d.insns[off] = code
+			next := off + code.Size()
+
+			if code == op.ReturnFalse || code == op.ReturnTrue {
+				break
+			}
+
+			if code == op.LoopBack {
+				d.targets[next-d.skipOffset(off)] = true
+				break
+			}
+
+			if code.IsSkip() {
+				target := next + d.skipOffset(off)
+				d.targets[target] = true
+				if code.Short() == op.Skip {
+					off = target
+					continue
+				}
+				queue = append(queue, target)
+			}
+
+			if code == op.LoopNext {
+				target := next + d.loopExit(off)
+				d.targets[target] = true
+				queue = append(queue, target)
+			}
+
+			off = next
+		}
+	}
+}
+
+func (d *disassembler) instruction(off int) (text, comment string) {
+	code := d.insns[off]
+	arg := d.arg(off)
+
+	switch {
+	case code < 64:
+		return code.String(), fmt.Sprint(off)
+
+	case code.IsQuantifier():
+		return fmt.Sprintf("%s %s", code, op.Code(arg)), fmt.Sprint(off)
+
+	case code < 128:
+		return fmt.Sprintf("%s #%d", code, arg), fmt.Sprint(off)
+
+	case code.HasFieldIndex():
+		return fmt.Sprintf("%s #%d", code, arg), fmt.Sprint(off)
+
+	case code.IsSkip():
+		target := off + code.Size() + d.skipOffset(off)
+		return fmt.Sprintf("%s @%s", code, label(target)), fmt.Sprintf("%d -> %d", off, target)
+
+	case code == op.LoopNext:
+		index, exit := op.SplitLoopNextArg(arg)
+		target := off + code.Size() + int(exit)
+		return fmt.Sprintf("%s #%d @%s", code, index, label(target)), fmt.Sprintf("%d -> %d", off, target)
+
+	case code == op.LoopBack:
+		target := off + code.Size() - d.skipOffset(off)
+		return fmt.Sprintf("%s @%s", code, label(target)), fmt.Sprintf("%d -> %d", off, target)
+
+	case code == op.LoadConstScalar:
+		return fmt.Sprintf("%s %s", code, d.formatScalar(off, arg)), fmt.Sprintf("%d = %#x", off, arg)
+
+	default: // LoadConstBytes
+		start := int(uint32(arg))
+		size := int(uint32(arg >> 32))
+		data := d.bytecode[start : start+size]
+		return fmt.Sprintf("%s %s", code, strconv.Quote(string(data))), fmt.Sprintf("%d = %d+%d", off, start, size)
+	}
+}
+
+// skipOffset of the skip or LoopBack instruction at the given offset.
+func (d *disassembler) skipOffset(off int) int {
+	return int(d.arg(off))
+}
+
+// loopExit offset of the LoopNext instruction at the given offset.
+func (d *disassembler) loopExit(off int) int {
+	_, exit := op.SplitLoopNextArg(d.arg(off))
+	return int(exit)
+}
+
+// arg of the instruction at the given offset.
+func (d *disassembler) arg(off int) uint64 {
+	return op.Code(d.bytecode[off]).Arg(d.bytecode[off+1:])
+}
+
+// formatScalar according to the instruction which uses the R0 value loaded at
+// the given offset.
+func (d *disassembler) formatScalar(off int, value uint64) string {
+	code := op.LoadConstScalar
+
+	for visited := make(map[int]bool); !visited[off]; {
+		visited[off] = true
+
+		next := off + code.Size()
+		if next >= len(d.bytecode) {
+			break
+		}
+		code = op.Code(d.bytecode[next])
+		off = next
+
+		if code.IsQuantifier() {
+			// Format like the comparison which is applied to the elements.
+			code = op.Code(d.bytecode[off+1])
+		}
+
+		switch code {
+		case op.CompareSignedLT, op.CompareSignedGE, op.CompareSignedEQ, op.CompareSignedNE, op.CompareSignedLE, op.CompareSignedGT, op.ContainsZigZag:
+			return strconv.FormatInt(int64(value), 10)
+
+		case op.CompareFloatLT, op.CompareFloatGE, op.CompareFloatEQ, op.CompareFloatNE, op.CompareFloatLE, op.CompareFloatGT, op.CompareFloatInfPos, op.CompareFloatInfNeg, op.CompareFloatNaN:
+			s := strconv.FormatFloat(math.Float64frombits(value), 'g', -1, 64)
+			if !strings.ContainsAny(s, ".eIN") {
+				s += ".0"
+			}
+			return s
+
+		case op.ContainsFixed32:
+			return fmt.Sprintf("%#x", value)
+
+		case op.CompareUnsignedLT, op.CompareUnsignedGE, op.CompareUnsignedEQ, op.CompareUnsignedNE, op.CompareUnsignedLE, op.CompareUnsignedGT, op.ContainsVarint, op.ContainsFixed64:
+			return strconv.FormatUint(value, 10)
+
+		case op.LoadConstScalar0, op.LoadConstScalar1, op.LoadConstScalar, op.LoadConstBytes, op.LoadR0FieldScalar, op.LoadR0FieldBytes, op.LoadR0FieldVector, op.LoadR0FieldScalarWide, op.LoadR0FieldBytesWide, op.LoadR0FieldVectorWide, op.LengthR0Bytes, op.CountR0Varint, op.CountR0Fixed64, op.CountR0Fixed32, op.ReturnFalse, op.ReturnTrue, op.LoopNext, op.LoopBack:
+			return strconv.FormatUint(value, 10)
+
+		case op.Skip, op.SkipLong:
+			off += d.skipOffset(off)
+		}
+	}
+
+	return strconv.FormatUint(value, 10)
+}
+
+// fieldPath representation of a leaf field spec.
+func fieldPath(spec *build.FieldSpec) string {
+	var s string
+
+	for n := spec; n != nil; n = n.Parent {
+		node := fmt.Sprintf(".%d", n.Num)
+		if n.Mod != 0 {
+			node += " " + n.Mod.String()
+		}
+		if n.Mod == field.ModPacked {
+			node += " " + field.SubtypeName(n.Subtype)
+		}
+		if n != spec {
+			node += "[" + s + "]"
+		}
+		s = node
+	}
+
+	return s
+}
+
+func label(off int) string {
+	return fmt.Sprintf("L%d", off)
+}
+
+func writeLine(w *bytes.Buffer, text, comment string) {
+	w.WriteString(text)
+
+	n := len(text)
+	if strings.HasPrefix(text, "\t") {
+		n += 7
+	}
+	if n < commentColumn {
+		w.WriteString(strings.Repeat(" ", commentColumn-n))
+	} else {
+		w.WriteString(" ")
+	}
+
+	w.WriteString("; ")
+	w.WriteString(comment)
+	w.WriteString("\n")
+}
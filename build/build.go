@@ -0,0 +1,540 @@
+// Package build implements construction of PBF bytecode programs.
+//
+// A Builder keeps track of field specs, instructions, jump targets and constants,
+// and produces bytecode which has been verified by pbf.NewProgram.
+//
+// Field indexes are assigned in the order in which distinct field specs are
+// added.  Jump targets are expressed as labels, which are resolved when the
+// bytecode is produced.  Byte constants are interned into a constant pool which
+// is placed after the last instruction.
+package build
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/op"
+)
+
+var (
+	bytecodeHeader     = []byte{'P', 'B', 'F', 0}
+	bytecodeHeaderWide = []byte{'P', 'B', 'F', 1}
+)
+
+// maxFieldCount of the wide bytecode format.
+const maxFieldCount = 0xffff
+
+var (
+	errFieldIndex    = errors.New("build: field index out of bounds")
+	errTooManyFields = errors.New("build: too many fields")
+	errNoReturn      = errors.New("build: program doesn't end with Return, Skip or LoopBack instruction")
+)
+
+// Label is a jump target.
+type Label int
+
+// Builder of a bytecode program.  The first error encountered is remembered
+// and returned by Bytecode; the construction methods have no effect after an
+// error.
+type Builder struct {
+	fields   [][]byte // Encoded field specs by index.
+	fieldmap map[string]int
+
+	code       []byte
+	terminated bool     // Last instruction is Return, Skip or LoopBack.
+	data       [][2]int // Inline constant ranges.
+
+	labels []int // Instruction offsets; -1 if not marked.
+	skips  []skipRef
+
+	consts    [][]byte // Constant pool.
+	constmap  map[string]int
+	constrefs []constRef
+
+	notes map[int]string // By instruction offset.
+
+	err error
+}
+
+type skipRef struct {
+	pos   int // Instruction offset.
+	label Label
+}
+
+type constRef struct {
+	pos    int   // Argument offset.
+	index  int   // Constant pool index, or -1 if inline.
+	label  Label // Inline constant position.
+	length int   // Inline constant length.
+}
+
+// New program builder.
+func New() *Builder {
+	return &Builder{
+		fieldmap: make(map[string]int),
+		constmap: make(map[string]int),
+	}
+}
+
+// Err returns the first error, if any.
+func (b *Builder) Err() error {
+	return b.err
+}
+
+func (b *Builder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Note attaches a comment to the next instruction.  Notes of the same
+// instruction are joined.
+func (b *Builder) Note(text string) {
+	if b.notes == nil {
+		b.notes = make(map[int]string)
+	}
+	if prev := b.notes[len(b.code)]; prev != "" {
+		text = prev + "; " + text
+	}
+	b.notes[len(b.code)] = text
+}
+
+// Notes returns the comments by instruction offset in the bytecode.  The
+// offsets are final only after all fields have been added and all labels have
+// been marked.
+func (b *Builder) Notes() map[int]string {
+	insnoffset := len(b.fieldSection())
+	grown := b.layout()
+
+	notes := make(map[int]string, len(b.notes))
+	for pos, text := range b.notes {
+		notes[insnoffset+relocate(grown, pos)] = text
+	}
+	return notes
+}
+
+// AddField declares a field spec, returning its index.  The spec must be a
+// leaf node.  Adding an equivalent spec again returns the same index.
+func (b *Builder) AddField(spec *FieldSpec) int {
+	if b.err != nil {
+		return 0
+	}
+
+	enc, err := spec.encode()
+	if err != nil {
+		b.fail(err)
+		return 0
+	}
+
+	if index, found := b.fieldmap[string(enc)]; found {
+		return index
+	}
+
+	index := len(b.fields)
+	if index >= maxFieldCount {
+		b.fail(errTooManyFields)
+		return 0
+	}
+
+	b.fields = append(b.fields, enc)
+	b.fieldmap[string(enc)] = index
+	return index
+}
+
+// FieldCount returns the number of distinct field specs.
+func (b *Builder) FieldCount() int {
+	return len(b.fields)
+}
+
+// NewLabel creates an unmarked jump target.
+func (b *Builder) NewLabel() Label {
+	b.labels = append(b.labels, -1)
+	return Label(len(b.labels) - 1)
+}
+
+// Mark the position of the next instruction as the label's target.
+func (b *Builder) Mark(l Label) {
+	if b.err != nil {
+		return
+	}
+
+	if int(l) < 0 || int(l) >= len(b.labels) {
+		b.fail(fmt.Errorf("build: unknown label %d", l))
+		return
+	}
+	if b.labels[l] >= 0 {
+		b.fail(fmt.Errorf("build: label %d marked twice", l))
+		return
+	}
+	b.labels[l] = len(b.code)
+}
+
+// Op emits an instruction without arguments.
+func (b *Builder) Op(code op.Code) {
+	if b.err != nil {
+		return
+	}
+
+	if code >= 64 {
+		b.fail(fmt.Errorf("build: opcode %d requires an argument", code))
+		return
+	}
+
+	b.code = append(b.code, byte(code))
+	b.terminated = code == op.ReturnFalse || code == op.ReturnTrue
+}
+
+// OpField emits an instruction with a field index argument.  An opcode with a
+// 1-byte argument is replaced with the corresponding wide opcode if the index
+// doesn't fit in a byte.
+func (b *Builder) OpField(code op.Code, index int) {
+	if b.err != nil {
+		return
+	}
+
+	if !code.HasFieldIndex() {
+		b.fail(fmt.Errorf("build: opcode %d doesn't take a field index", code))
+		return
+	}
+	if index < 0 || index >= len(b.fields) {
+		b.fail(errFieldIndex)
+		return
+	}
+
+	if index > 0xff {
+		code = code.Wide()
+	}
+
+	if code < 128 {
+		b.code = append(b.code, byte(code), byte(index))
+	} else {
+		b.code = append(b.code, byte(code), byte(index), byte(index>>8))
+	}
+	b.terminated = false
+}
+
+// OpQuantifier emits an instruction which applies a comparison opcode to the
+// elements of the packed vector in R1 and the scalar in R0.
+func (b *Builder) OpQuantifier(code, cmp op.Code) {
+	if b.err != nil {
+		return
+	}
+
+	if !code.IsQuantifier() {
+		b.fail(fmt.Errorf("build: opcode %d is not a quantifier", code))
+		return
+	}
+	if !cmp.IsCompare() {
+		b.fail(fmt.Errorf("build: opcode %d is not a comparison", cmp))
+		return
+	}
+
+	b.code = append(b.code, byte(code), byte(cmp))
+	b.terminated = false
+}
+
+// OpSkip emits a jump instruction.  The label must be marked at a later
+// position.  A short jump is replaced with the corresponding long jump if the
+// offset doesn't fit in 16 bits.
+func (b *Builder) OpSkip(code op.Code, l Label) {
+	if b.err != nil {
+		return
+	}
+
+	if !code.IsSkip() {
+		b.fail(fmt.Errorf("build: opcode %d doesn't take an instruction offset", code))
+		return
+	}
+	if int(l) < 0 || int(l) >= len(b.labels) {
+		b.fail(fmt.Errorf("build: unknown label %d", l))
+		return
+	}
+	if b.labels[l] >= 0 {
+		b.fail(fmt.Errorf("build: label %d precedes jump (backward jumps are not supported)", l))
+		return
+	}
+
+	b.skips = append(b.skips, skipRef{len(b.code), l})
+	b.code = append(b.code, byte(code))
+	b.code = append(b.code, make([]byte, code.Size()-1)...)
+	b.terminated = code.Short() == op.Skip
+}
+
+// OpLoopNext emits an instruction which visits the next element of a repeated
+// message field, or jumps to the exit label after the last element.  The field
+// must be a direct reference to a ModEach node, and the label must be marked at
+// a later position.
+func (b *Builder) OpLoopNext(index int, exit Label) {
+	if b.err != nil {
+		return
+	}
+
+	if index < 0 || index >= len(b.fields) {
+		b.fail(errFieldIndex)
+		return
+	}
+	if int(exit) < 0 || int(exit) >= len(b.labels) {
+		b.fail(fmt.Errorf("build: unknown label %d", exit))
+		return
+	}
+	if b.labels[exit] >= 0 {
+		b.fail(fmt.Errorf("build: label %d precedes loop exit", exit))
+		return
+	}
+
+	var arg [8]byte
+	binary.LittleEndian.PutUint64(arg[:], op.LoopNextArg(index, 0))
+	b.skips = append(b.skips, skipRef{len(b.code), exit})
+	b.code = append(b.code, byte(op.LoopNext))
+	b.code = append(b.code, arg[:]...)
+	b.terminated = false
+}
+
+// OpLoopBack emits a jump to a LoopNext instruction.  The label must be marked
+// at the LoopNext instruction.
+func (b *Builder) OpLoopBack(l Label) {
+	if b.err != nil {
+		return
+	}
+
+	if int(l) < 0 || int(l) >= len(b.labels) {
+		b.fail(fmt.Errorf("build: unknown label %d", l))
+		return
+	}
+	if b.labels[l] < 0 {
+		b.fail(fmt.Errorf("build: label %d doesn't precede loop back", l))
+		return
+	}
+
+	b.skips = append(b.skips, skipRef{len(b.code), l})
+	b.code = append(b.code, byte(op.LoopBack), 0, 0, 0, 0, 0, 0, 0, 0)
+	b.terminated = true
+}
+
+// LoadConstScalar emits an instruction which loads an immediate value to R0.
+func (b *Builder) LoadConstScalar(value uint64) {
+	if b.err != nil {
+		return
+	}
+
+	var arg [8]byte
+	binary.LittleEndian.PutUint64(arg[:], value)
+	b.code = append(b.code, byte(op.LoadConstScalar))
+	b.code = append(b.code, arg[:]...)
+	b.terminated = false
+}
+
+// LoadConstBytes emits an instruction which loads a reference to a constant
+// byte sequence to R0.  The data is interned into the constant pool.
+func (b *Builder) LoadConstBytes(data []byte) {
+	if b.err != nil {
+		return
+	}
+
+	index, found := b.constmap[string(data)]
+	if !found {
+		index = len(b.consts)
+		b.consts = append(b.consts, append([]byte{}, data...))
+		b.constmap[string(data)] = index
+	}
+
+	b.code = append(b.code, byte(op.LoadConstBytes), 0, 0, 0, 0, 0, 0, 0, 0)
+	b.constrefs = append(b.constrefs, constRef{pos: len(b.code) - 8, index: index})
+	b.terminated = false
+}
+
+// LoadConstBytesAt emits an instruction which loads a reference to an inline
+// constant to R0.  The label must be marked at the constant's position.
+func (b *Builder) LoadConstBytesAt(l Label, length int) {
+	if b.err != nil {
+		return
+	}
+
+	if int(l) < 0 || int(l) >= len(b.labels) {
+		b.fail(fmt.Errorf("build: unknown label %d", l))
+		return
+	}
+	if length < 0 {
+		b.fail(fmt.Errorf("build: negative constant length: %d", length))
+		return
+	}
+
+	b.code = append(b.code, byte(op.LoadConstBytes), 0, 0, 0, 0, 0, 0, 0, 0)
+	b.constrefs = append(b.constrefs, constRef{pos: len(b.code) - 8, index: -1, label: l, length: length})
+	b.terminated = false
+}
+
+// Data emits an inline constant.  It must not be reachable by falling through
+// from the previous instruction.
+func (b *Builder) Data(data []byte) {
+	if b.err != nil {
+		return
+	}
+
+	if !b.terminated {
+		b.fail(errors.New("build: inline constant follows an instruction which doesn't Return, Skip or LoopBack"))
+		return
+	}
+
+	b.data = append(b.data, [2]int{len(b.code), len(b.code) + len(data)})
+	b.code = append(b.code, data...)
+}
+
+// Bytecode resolves labels and constant references, and encodes the program.
+// The result has been accepted by pbf.NewProgram.
+func (b *Builder) Bytecode() ([]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if !b.terminated {
+		return nil, errNoReturn
+	}
+
+	buf := b.fieldSection()
+	insnoffset := len(buf)
+	grown := b.layout()
+	code := b.expand(grown)
+
+	for _, ref := range b.skips {
+		target := b.labels[ref.label]
+		if target < 0 {
+			return nil, fmt.Errorf("build: label %d not marked", ref.label)
+		}
+		if target == len(b.code) {
+			return nil, fmt.Errorf("build: label %d is marked after the last instruction", ref.label)
+		}
+		for _, r := range b.data {
+			if target >= r[0] && target < r[1] {
+				return nil, fmt.Errorf("build: label %d is a jump target but marks an inline constant", ref.label)
+			}
+		}
+
+		pos := relocate(grown, ref.pos)
+		opcode := op.Code(code[pos])
+		offset := relocate(grown, target) - (pos + opcode.Size())
+
+		switch {
+		case opcode < 192:
+			binary.LittleEndian.PutUint16(code[pos+1:], uint16(offset))
+
+		case opcode == op.LoopBack:
+			binary.LittleEndian.PutUint64(code[pos+1:], uint64(-offset))
+
+		default:
+			if uint64(offset) > math.MaxUint32 {
+				return nil, fmt.Errorf("build: jump to label %d is too long: %d bytes", ref.label, offset)
+			}
+			if opcode == op.LoopNext {
+				binary.LittleEndian.PutUint32(code[pos+1:], uint32(offset))
+			} else {
+				binary.LittleEndian.PutUint64(code[pos+1:], uint64(offset))
+			}
+		}
+	}
+
+	var pool []byte
+	addrs := make([]int, len(b.consts))
+	for i, data := range b.consts {
+		addrs[i] = insnoffset + len(code) + len(pool)
+		pool = append(pool, data...)
+	}
+
+	for _, ref := range b.constrefs {
+		var addr, size uint64
+		if ref.index < 0 {
+			target := b.labels[ref.label]
+			if target < 0 {
+				return nil, fmt.Errorf("build: label %d not marked", ref.label)
+			}
+			addr = uint64(insnoffset + relocate(grown, target))
+			size = uint64(ref.length)
+		} else {
+			addr = uint64(addrs[ref.index])
+			size = uint64(len(b.consts[ref.index]))
+		}
+		binary.LittleEndian.PutUint64(code[relocate(grown, ref.pos):], addr|size<<32)
+	}
+
+	buf = append(buf, code...)
+	buf = append(buf, pool...)
+
+	if _, err := pbf.NewProgram(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// layout determines which short jumps must be replaced with long ones, and
+// returns their instruction offsets in ascending order.  Each replacement
+// grows the code, which may make other jumps too long.
+func (b *Builder) layout() []int {
+	var grown []int
+
+	for changed := true; changed; {
+		changed = false
+
+		for _, ref := range b.skips {
+			code := op.Code(b.code[ref.pos])
+			target := b.labels[ref.label]
+			if code >= 192 || target < 0 || isGrown(grown, ref.pos) {
+				continue
+			}
+
+			end := relocate(grown, ref.pos) + code.Size()
+			if relocate(grown, target)-end > 0xffff {
+				grown = append(grown, ref.pos)
+				sort.Ints(grown)
+				changed = true
+			}
+		}
+	}
+
+	return grown
+}
+
+// expand the code by replacing the grown jumps with long ones.
+func (b *Builder) expand(grown []int) []byte {
+	code := make([]byte, 0, relocate(grown, len(b.code)))
+	prev := 0
+
+	for _, pos := range grown {
+		code = append(code, b.code[prev:pos]...)
+		code = append(code, byte(op.Code(b.code[pos]).Long()), 0, 0, 0, 0, 0, 0, 0, 0)
+		prev = pos + op.Skip.Size()
+	}
+
+	return append(code, b.code[prev:]...)
+}
+
+// relocate an offset of the unexpanded code.
+func relocate(grown []int, pos int) int {
+	n := sort.SearchInts(grown, pos) // Jumps before pos.
+	return pos + n*(op.SkipLong.Size()-op.Skip.Size())
+}
+
+func isGrown(grown []int, pos int) bool {
+	i := sort.SearchInts(grown, pos)
+	return i < len(grown) && grown[i] == pos
+}
+
+// fieldSection encodes the header and the field specs.  The wide format is
+// used if there are more than 255 fields.
+func (b *Builder) fieldSection() []byte {
+	var buf []byte
+	if len(b.fields) > 0xff {
+		buf = append(buf, bytecodeHeaderWide...)
+		buf = append(buf, byte(len(b.fields)), byte(len(b.fields)>>8))
+	} else {
+		buf = append(buf, bytecodeHeader...)
+		buf = append(buf, byte(len(b.fields)))
+	}
+
+	for _, enc := range b.fields {
+		buf = append(buf, enc...)
+	}
+	return buf
+}
@@ -0,0 +1,799 @@
+package build_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/build"
+	"github.com/ninchat/pbf/field"
+	"github.com/ninchat/pbf/internal/test"
+	"github.com/ninchat/pbf/op"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// expect emits instructions which return false unless the status is true.
+func expect(b *build.Builder) {
+	l := b.NewLabel()
+	b.OpSkip(op.SkipTrue, l)
+	b.Op(op.ReturnFalse)
+	b.Mark(l)
+}
+
+func TestBuilder(t *testing.T) {
+	b := build.New()
+
+	a := b.AddField(build.NewFieldSpec(1, 0))
+	c := b.AddField(build.NewFieldSpec(3, 0))
+	e := b.AddField(build.NewFieldSpec(5, field.ModZigZag))
+	i := b.AddField(build.NewFieldSpec(9, field.ModFloat))
+	k := b.AddField(build.NewFieldSpec(11, 0))
+	l := b.AddField(build.NewFieldSpec(12, 0))
+	ny := b.AddField(build.NewFieldSpec(14, field.ModMessage).Sub(2, 0))
+	oz0 := b.AddField(build.NewFieldSpec(15, field.ModMessage).SubPacked(1, protowire.VarintType).Sub(0, field.ModZigZag))
+	q2x := b.AddField(build.NewFieldSpec(17, field.ModRepeated).Sub(2, field.ModMessage).Sub(1, 0))
+	m := b.AddField(build.NewFieldSpec(13, 0))
+
+	if b.AddField(build.NewFieldSpec(3, 0)) != c {
+		t.Error("duplicate field spec got a new index")
+	}
+	if n := b.FieldCount(); n != 10 {
+		t.Error(n)
+	}
+
+	b.OpField(op.LoadR1FieldScalar, a)
+	b.Op(op.LoadConstScalar1)
+	b.Op(op.CompareUnsignedEQ)
+	expect(b)
+
+	b.OpField(op.LoadR1FieldScalar, c)
+	b.LoadConstScalar(3)
+	b.Op(op.CompareSignedEQ)
+	expect(b)
+
+	b.OpField(op.LoadR1FieldScalar, e)
+	b.LoadConstScalar(uint64(-5 & math.MaxUint64))
+	b.Op(op.CompareSignedEQ)
+	expect(b)
+
+	b.OpField(op.LoadR1FieldScalar, i)
+	b.LoadConstScalar(math.Float64bits(float64(float32(math.Pi))))
+	b.Op(op.CompareFloatEQ)
+	expect(b)
+
+	b.OpField(op.LoadR1FieldBytes, k)
+	b.LoadConstBytes([]byte("PBF"))
+	b.Op(op.CompareBytesEQ)
+	expect(b)
+
+	b.OpField(op.LoadR1FieldBytes, l)
+	b.LoadConstBytes([]byte("Hello, world!"))
+	b.Op(op.CompareBytesEQ)
+	expect(b)
+
+	b.OpField(op.LoadR1FieldBytes, k)
+	b.LoadConstBytes([]byte("PBF"))
+	b.Op(op.CompareBytesEQ)
+	expect(b)
+
+	b.OpField(op.LoadR1FieldScalar, ny)
+	b.LoadConstScalar(56789)
+	b.Op(op.CompareSignedEQ)
+	expect(b)
+
+	b.OpField(op.LoadR1FieldScalar, oz0)
+	b.LoadConstScalar(uint64(-3 & math.MaxUint64))
+	b.Op(op.CompareSignedEQ)
+	expect(b)
+
+	b.OpField(op.LoadR1FieldScalar, q2x)
+	b.LoadConstScalar(102)
+	b.Op(op.CompareSignedEQ)
+	expect(b)
+
+	b.OpField(op.LoadR1FieldVector, m)
+	b.LoadConstScalar(4)
+	b.Op(op.ContainsVarint)
+	expect(b)
+
+	b.Op(op.ReturnTrue)
+
+	bytecode, err := b.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := pbf.NewMachine(prog).Filter(test.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error(ok)
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	b := build.New()
+	b.Op(op.ReturnFalse)
+	b.Op(op.ReturnTrue)
+	if _, err := b.Bytecode(); err != nil {
+		t.Error(err)
+	}
+
+	b = build.New()
+	b.Op(op.LoadConstScalar1)
+	if _, err := b.Bytecode(); err == nil {
+		t.Error("program without Return")
+	}
+
+	b = build.New()
+	l := b.NewLabel()
+	b.OpSkip(op.Skip, l)
+	if _, err := b.Bytecode(); err == nil {
+		t.Error("unmarked label")
+	}
+
+	b = build.New()
+	l = b.NewLabel()
+	b.Mark(l)
+	b.Op(op.ReturnTrue)
+	b.OpSkip(op.Skip, l)
+	if err := b.Err(); err == nil {
+		t.Error("backward jump")
+	}
+
+	b = build.New()
+	for i := int32(0); i < 255; i++ {
+		b.AddField(build.NewFieldSpec(i, 0))
+	}
+	b.Op(op.ReturnTrue)
+	if bytecode, err := b.Bytecode(); err != nil {
+		t.Error(err)
+	} else if n := bytecode[4]; n != 255 {
+		t.Error("field count:", n)
+	}
+
+	b = build.New()
+	for i := int32(0); i <= 0xffff; i++ {
+		b.AddField(build.NewFieldSpec(i, 0))
+	}
+	if err := b.Err(); err == nil {
+		t.Error("too many fields")
+	}
+
+	b = build.New()
+	b.AddField(build.NewFieldSpec(1, field.ModMessage))
+	if err := b.Err(); err == nil {
+		t.Error("intermediary field spec")
+	}
+
+	b = build.New()
+	b.OpField(op.LoadR0FieldScalar, 0)
+	if err := b.Err(); err == nil {
+		t.Error("undeclared field")
+	}
+
+	b = build.New()
+	x := b.AddField(build.NewFieldSpec(1, 0))
+	b.OpField(op.LoadR1FieldScalar, x)
+	b.OpField(op.LoadR0FieldBytes, x)
+	b.Op(op.ReturnTrue)
+	if _, err := b.Bytecode(); err == nil {
+		t.Error("conflicting field access modes")
+	}
+
+	b = build.New()
+	x = b.AddField(build.NewFieldSpec(1, 0))
+	l = b.NewLabel()
+	b.OpLoopNext(x, l)
+	b.Mark(l)
+	b.Op(op.ReturnTrue)
+	if _, err := b.Bytecode(); err == nil {
+		t.Error("loop over a field without Each node")
+	}
+
+	b = build.New()
+	x = b.AddField(build.NewFieldSpec(1, 0))
+	l = b.NewLabel()
+	b.OpLoopBack(l)
+	if err := b.Err(); err == nil {
+		t.Error("forward loop back")
+	}
+
+	b = build.New()
+	x = b.AddField(build.NewFieldSpec(17, 0))
+	b.AddField(build.NewFieldSpec(17, field.ModEach).Sub(1, 0))
+	l = b.NewLabel()
+	exit := b.NewLabel()
+	b.Mark(l)
+	b.OpField(op.CheckField, x)
+	b.OpLoopNext(x, exit)
+	b.OpLoopBack(l)
+	b.Mark(exit)
+	b.Op(op.ReturnTrue)
+	if _, err := b.Bytecode(); err == nil {
+		t.Error("loop back to an instruction other than LoopNext")
+	}
+
+	b = build.New()
+	x = b.AddField(build.NewFieldSpec(17, 0))
+	b.AddField(build.NewFieldSpec(17, field.ModEach).Sub(1, 0))
+	l = b.NewLabel()
+	exit = b.NewLabel()
+	b.Mark(l)
+	b.OpLoopNext(x, exit)
+	b.Op(op.ReturnTrue)
+	b.Mark(exit)
+	b.OpLoopBack(l)
+	if _, err := b.Bytecode(); err == nil {
+		t.Error("loop back from the exit path")
+	}
+
+	b = build.New()
+	x = b.AddField(build.NewFieldSpec(17, 0))
+	b.AddField(build.NewFieldSpec(17, field.ModEach).Sub(1, 0))
+	l = b.NewLabel()
+	exit = b.NewLabel()
+	inner := b.NewLabel()
+	b.Mark(l)
+	b.OpLoopNext(x, exit)
+	b.OpLoopNext(x, inner)
+	b.OpLoopBack(l)
+	b.Mark(inner)
+	b.OpLoopBack(l)
+	b.Mark(exit)
+	b.Op(op.ReturnTrue)
+	if _, err := b.Bytecode(); err == nil {
+		t.Error("loop inside itself")
+	}
+
+	b = build.New()
+	x = b.AddField(build.NewFieldSpec(17, 0))
+	b.AddField(build.NewFieldSpec(17, field.ModEach).Sub(1, 0))
+	l = b.NewLabel()
+	exit = b.NewLabel()
+	inner = b.NewLabel()
+	b.OpField(op.CheckField, x)
+	b.OpSkip(op.SkipFalse, inner)
+	b.Mark(l)
+	b.OpLoopNext(x, exit)
+	b.Mark(inner)
+	b.OpLoopBack(l)
+	b.Mark(exit)
+	b.Op(op.ReturnTrue)
+	if _, err := b.Bytecode(); err == nil {
+		t.Error("jump into a loop")
+	}
+
+	b = build.New()
+	x = b.AddField(build.NewFieldSpec(1, 0))
+	l = b.NewLabel()
+	b.OpField(op.LoadR1FieldScalar, x)
+	b.LoadConstScalar(1)
+	b.Op(op.CompareUnsignedEQ)
+	b.OpSkip(op.SkipFalse, l)
+	b.LoadConstBytes([]byte("x"))
+	b.Mark(l)
+	b.Op(op.CompareUnsignedEQ)
+	b.Op(op.ReturnTrue)
+	if _, err := b.Bytecode(); err == nil || !strings.Contains(err.Error(), "execution path") {
+		t.Error("conflicting register states:", err)
+	}
+}
+
+// buildBranches of 500 clauses.
+func buildBranches(t testing.TB) []byte {
+	b := build.New()
+	a := b.AddField(build.NewFieldSpec(1, 0))
+	l := b.AddField(build.NewFieldSpec(12, 0))
+
+	// The clauses join after each other, and R0 contains a scalar or bytes
+	// at every join point.
+	for i := 0; i < 500; i++ {
+		next := b.NewLabel()
+		b.OpField(op.LoadR1FieldScalar, a)
+		b.LoadConstScalar(uint64(i))
+		b.Op(op.CompareUnsignedEQ)
+		b.OpSkip(op.SkipFalse, next)
+		b.OpField(op.LoadR1FieldBytes, l)
+		b.LoadConstBytes([]byte("Hello"))
+		b.Op(op.HasPrefixBytes)
+		b.Mark(next)
+	}
+	b.OpField(op.LoadR1FieldScalar, a)
+	b.LoadConstScalar(1)
+	b.Op(op.CompareUnsignedEQ)
+	expect(b)
+	b.Op(op.ReturnTrue)
+
+	bytecode, err := b.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytecode
+}
+
+func TestBuilderBranches(t *testing.T) {
+	prog, err := pbf.NewProgram(buildBranches(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := pbf.NewMachine(prog).Filter(test.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error(ok)
+	}
+}
+
+func BenchmarkPrepareBranches(b *testing.B) {
+	bytecode := buildBranches(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := pbf.NewProgram(bytecode); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBuilderNotes(t *testing.T) {
+	b := build.New()
+	b.Note("first")
+	b.OpField(op.CheckField, b.AddField(build.NewFieldSpec(1, 0)))
+	b.Op(op.ReturnFalse)
+	b.Note("second")
+	b.Note("third")
+	b.OpField(op.CheckField, b.AddField(build.NewFieldSpec(2, 0)))
+	b.Op(op.ReturnTrue)
+
+	bytecode, err := b.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notes := b.Notes()
+	if len(notes) != 2 {
+		t.Error(notes)
+	}
+	if s := notes[15]; s != "first" || bytecode[15] != byte(op.CheckField) {
+		t.Error(s)
+	}
+	if s := notes[18]; s != "second; third" || bytecode[18] != byte(op.CheckField) {
+		t.Error(s)
+	}
+}
+
+func TestBuilderWide(t *testing.T) {
+	b := build.New()
+
+	for i := int32(0); i < 298; i++ {
+		b.AddField(build.NewFieldSpec(1000+i, 0))
+	}
+	a := b.AddField(build.NewFieldSpec(1, 0))
+	l := b.AddField(build.NewFieldSpec(12, 0))
+
+	b.OpField(op.CheckField, 5)
+	l1 := b.NewLabel()
+	b.OpSkip(op.SkipFalse, l1)
+	b.Op(op.ReturnFalse)
+	b.Mark(l1)
+
+	b.OpField(op.LoadR1FieldScalar, a)
+	b.Op(op.LoadConstScalar1)
+	b.Op(op.CompareUnsignedEQ)
+	expect(b)
+
+	b.OpField(op.LoadR1FieldBytesWide, l)
+	b.LoadConstBytes([]byte("Hello, world!"))
+	b.Op(op.CompareBytesEQ)
+	expect(b)
+
+	b.Op(op.ReturnTrue)
+
+	bytecode, err := b.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bytecode[:6]) != "PBF\x01\x2c\x01" {
+		t.Errorf("%q", bytecode[:6])
+	}
+
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := prog.FieldCount(); n != 300 {
+		t.Error(n)
+	}
+
+	m := pbf.NewMachine(prog)
+	ok, err := m.Filter(test.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error(ok)
+	}
+	if v, found := m.GetRawValueWide(a); !found || v != 1 {
+		t.Error(v, found)
+	}
+}
+
+func TestBuilderLongSkip(t *testing.T) {
+	b := build.New()
+	a := b.AddField(build.NewFieldSpec(1, 0))
+	k := b.AddField(build.NewFieldSpec(11, 0))
+
+	start := b.NewLabel()
+	b.OpSkip(op.SkipLong, start)
+	b.Mark(start)
+
+	// The first jump fits in 16 bits until the second one is replaced.
+	x := b.NewLabel()
+	y := b.NewLabel()
+	data := b.NewLabel()
+	b.OpField(op.CheckField, a)
+	b.OpSkip(op.SkipTrue, x)
+	b.OpSkip(op.SkipTrue, y)
+	b.Op(op.ReturnFalse)
+	b.Mark(data)
+	b.Data(append([]byte("PBF"), make([]byte, 0xfff8-3)...))
+
+	b.Mark(x)
+	b.Note("x")
+	b.OpField(op.LoadR1FieldBytes, k)
+	b.LoadConstBytesAt(data, 3)
+	b.Op(op.CompareBytesEQ)
+	expect(b)
+	b.Op(op.ReturnTrue)
+
+	b.Mark(y)
+	b.Op(op.ReturnFalse)
+
+	bytecode, err := b.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insnoffset := 4 + 1 + 5 + 5
+	for _, off := range []int{0, 11, 20} {
+		if code := op.Code(bytecode[insnoffset+off]); code != op.SkipLong && code != op.SkipTrueLong {
+			t.Errorf("%d: %s", off, code)
+		}
+	}
+
+	notes := b.Notes()
+	for off, note := range notes {
+		if note != "x" || op.Code(bytecode[off]) != op.LoadR1FieldBytes {
+			t.Error(off, note)
+		}
+	}
+
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := pbf.NewMachine(prog).Filter(test.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error(ok)
+	}
+}
+
+// buildQuantifier over the x fields of the repeated q field: any x or all x
+// satisfy the comparison with the constant.
+func buildQuantifier(t *testing.T, all bool, cmp op.Code, value uint64) *pbf.Program {
+	t.Helper()
+
+	b := build.New()
+	q := b.AddField(build.NewFieldSpec(17, 0))
+	x := b.AddField(build.NewFieldSpec(17, field.ModEach).Sub(1, 0))
+
+	loop := b.NewLabel()
+	exit := b.NewLabel()
+	b.Mark(loop)
+	b.OpLoopNext(q, exit)
+	b.OpField(op.LoadR1FieldScalar, x)
+	b.LoadConstScalar(value)
+	b.Op(cmp)
+	next := b.NewLabel()
+	b.OpSkip(op.SkipIf(all), next)
+	b.Op(op.Return(!all))
+	b.Mark(next)
+	b.OpLoopBack(loop)
+	b.Mark(exit)
+	b.Op(op.Return(all))
+
+	bytecode, err := b.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prog
+}
+
+func TestBuilderLoop(t *testing.T) {
+	for _, c := range []struct {
+		all    bool
+		cmp    op.Code
+		value  uint64
+		result bool
+	}{
+		{false, op.CompareSignedGT, 101, true},
+		{false, op.CompareSignedGT, 102, false},
+		{false, op.CompareSignedEQ, 100, true},
+		{true, op.CompareSignedGE, 100, true},
+		{true, op.CompareSignedGE, 101, false},
+		{true, op.CompareSignedNE, 103, true},
+	} {
+		m := pbf.NewMachine(buildQuantifier(t, c.all, c.cmp, c.value))
+
+		for i := 0; i < 2; i++ {
+			ok, err := m.Filter(test.Data())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != c.result {
+				t.Errorf("all=%t %s %d: %t", c.all, c.cmp, c.value, ok)
+			}
+		}
+	}
+}
+
+func TestBuilderQuantifier(t *testing.T) {
+	pi := float64(float32(math.Pi))
+
+	for _, c := range []struct {
+		spec   *build.FieldSpec
+		enc    op.ScalarEncoding
+		all    bool
+		cmp    op.Code
+		value  uint64
+		result bool
+	}{
+		{build.NewFieldSpec(13, 0), op.Varint, false, op.CompareUnsignedGT, 4, true},
+		{build.NewFieldSpec(13, 0), op.Varint, false, op.CompareUnsignedGT, 5, false},
+		{build.NewFieldSpec(13, 0), op.Varint, true, op.CompareUnsignedGE, 1, true},
+		{build.NewFieldSpec(13, 0), op.Varint, true, op.CompareSignedLT, 5, false},
+		{build.NewFieldSpec(15, field.ModMessage).Sub(1, 0), op.ZigZag, false, op.CompareSignedLT, uint64(-2 & math.MaxUint64), true},
+		{build.NewFieldSpec(15, field.ModMessage).Sub(1, 0), op.ZigZag, true, op.CompareSignedGE, uint64(-3 & math.MaxUint64), true},
+		{build.NewFieldSpec(15, field.ModMessage).Sub(1, 0), op.ZigZag, true, op.CompareSignedNE, 0, false},
+		{build.NewFieldSpec(20, 0), op.Fixed32, false, op.CompareFloatEQ, math.Float64bits(pi), true},
+		{build.NewFieldSpec(20, 0), op.Fixed32, false, op.CompareFloatGT, math.Float64bits(5.5), false},
+		{build.NewFieldSpec(20, 0), op.Fixed32, true, op.CompareFloatGT, math.Float64bits(1), true},
+		{build.NewFieldSpec(20, 0), op.Fixed32, true, op.CompareFloatLT, math.Float64bits(5.5), false},
+		{build.NewFieldSpec(21, 0), op.Fixed64, false, op.CompareFloatGE, math.Float64bits(5.5), true},
+		{build.NewFieldSpec(21, 0), op.Fixed64, true, op.CompareFloatLE, math.Float64bits(5.5), true},
+		{build.NewFieldSpec(21, 0), op.Fixed64, true, op.CompareFloatNE, math.Float64bits(math.Pi), false},
+		{build.NewFieldSpec(19, 0), op.Fixed64, false, op.CompareUnsignedEQ, 0, false},
+		{build.NewFieldSpec(19, 0), op.Fixed64, true, op.CompareUnsignedEQ, 0, true},
+	} {
+		code := op.Quantifier(c.enc, c.all)
+
+		b := build.New()
+		b.OpField(op.LoadR1FieldVector, b.AddField(c.spec))
+		b.LoadConstScalar(c.value)
+		b.OpQuantifier(code, c.cmp)
+		l := b.NewLabel()
+		b.OpSkip(op.SkipTrue, l)
+		b.Op(op.ReturnFalse)
+		b.Mark(l)
+		b.Op(op.ReturnTrue)
+
+		bytecode, err := b.Bytecode()
+		if err != nil {
+			t.Fatal(code, c.cmp, err)
+		}
+
+		prog, err := pbf.NewProgram(bytecode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ok, err := pbf.NewMachine(prog).Filter(test.Data())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != c.result {
+			t.Errorf("%s %s %s %#x: %t", c.spec, code, c.cmp, c.value, ok)
+		}
+	}
+
+	for _, c := range []struct {
+		code op.Code
+		cmp  op.Code
+	}{
+		{op.AnyVarint, op.CompareFloatLT},
+		{op.AllZigZag, op.CompareUnsignedEQ},
+		{op.AnyFixed32, op.CompareBytesEQ},
+	} {
+		b := build.New()
+		b.OpField(op.LoadR1FieldVector, b.AddField(build.NewFieldSpec(13, 0)))
+		b.Op(op.LoadConstScalar0)
+		b.OpQuantifier(c.code, c.cmp)
+		b.Op(op.ReturnTrue)
+		if _, err := b.Bytecode(); err == nil {
+			t.Errorf("%s %s", c.code, c.cmp)
+		}
+	}
+
+	b := build.New()
+	b.OpQuantifier(op.AnyVarint, op.ReturnTrue)
+	if err := b.Err(); err == nil {
+		t.Error("quantifier with a non-comparison opcode")
+	}
+}
+
+func TestBuilderCount(t *testing.T) {
+	b := build.New()
+	q := b.AddField(build.NewFieldSpec(17, field.ModCount))
+	q2x := b.AddField(build.NewFieldSpec(17, field.ModRepeated).Sub(2, field.ModMessage).Sub(1, 0))
+	p := b.AddField(build.NewFieldSpec(16, field.ModCount))
+	s := b.AddField(build.NewFieldSpec(19, field.ModCount))
+	l := b.AddField(build.NewFieldSpec(12, 0))
+	m := b.AddField(build.NewFieldSpec(13, 0))
+	oz := b.AddField(build.NewFieldSpec(15, field.ModMessage).Sub(1, 0))
+	tt := b.AddField(build.NewFieldSpec(20, 0))
+	u := b.AddField(build.NewFieldSpec(21, 0))
+
+	check := func(value uint64) {
+		b.LoadConstScalar(value)
+		b.Op(op.CompareUnsignedEQ)
+		expect(b)
+	}
+
+	b.OpField(op.LoadR1FieldScalar, q)
+	check(3)
+	b.OpField(op.LoadR1FieldScalar, q2x)
+	check(102)
+	b.OpField(op.LoadR1FieldScalar, p)
+	check(4)
+	b.OpField(op.LoadR1FieldScalar, s)
+	check(0)
+
+	b.OpField(op.LoadR1FieldBytes, l)
+	b.Op(op.Length(op.R1))
+	check(13)
+	b.LoadConstBytes([]byte("PBF"))
+	b.Op(op.Length(op.R0))
+	b.Op(op.CompareUnsignedGT)
+	expect(b)
+
+	b.OpField(op.LoadR1FieldVector, m)
+	b.Op(op.Count(op.R1, op.Varint))
+	check(5)
+	b.OpField(op.LoadR1FieldVector, oz)
+	b.Op(op.Count(op.R1, op.ZigZag))
+	check(6)
+	b.OpField(op.LoadR1FieldVector, tt)
+	b.Op(op.Count(op.R1, op.Fixed32))
+	check(5)
+	b.OpField(op.LoadR0FieldVector, u)
+	b.Op(op.Count(op.R0, op.Fixed64))
+	b.OpField(op.LoadR1FieldVector, tt)
+	b.Op(op.Count(op.R1, op.Fixed32))
+	b.Op(op.CompareUnsignedEQ)
+	expect(b)
+
+	b.Op(op.ReturnTrue)
+
+	bytecode, err := b.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	machine := pbf.NewMachine(prog)
+	ok, err := machine.Filter(test.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error(ok)
+	}
+	if n, found, err := machine.GetUint64(q); err != nil || !found || n != 3 {
+		t.Error(n, found, err)
+	}
+	if n, found, err := machine.GetUint64(s); err != nil || found || n != 0 {
+		t.Error(n, found, err)
+	}
+
+	b = build.New()
+	b.OpField(op.LoadR1FieldVector, b.AddField(build.NewFieldSpec(17, field.ModCount)))
+	b.Op(op.ReturnTrue)
+	if _, err := b.Bytecode(); err == nil {
+		t.Error("count field loaded as vector")
+	}
+
+	b = build.New()
+	b.OpField(op.LoadR1FieldScalar, b.AddField(build.NewFieldSpec(1, 0)))
+	b.Op(op.Length(op.R1))
+	b.Op(op.ReturnTrue)
+	if _, err := b.Bytecode(); err == nil {
+		t.Error("length of a scalar")
+	}
+}
+
+func TestBuilderAffix(t *testing.T) {
+	for i, c := range []struct {
+		code   op.Code
+		field  int32
+		substr string
+		result bool
+	}{
+		{op.HasPrefixBytes, 12, "Hello", true},
+		{op.HasPrefixBytes, 12, "world", false},
+		{op.HasPrefixBytes, 12, "", true},
+		{op.HasPrefixBytes, 11, "PBF!", false},
+		{op.HasSuffixBytes, 12, "world!", true},
+		{op.HasSuffixBytes, 12, "Hello", false},
+		{op.HasSuffixBytes, 11, "PBF", true},
+		{op.ContainsBytes, 12, ", w", true},
+		{op.ContainsBytes, 12, "World", false},
+		{op.ContainsBytes, 11, "B", true},
+		{op.ContainsBytes, 19, "", true},
+		{op.ContainsBytes, 19, "x", false},
+	} {
+		b := build.New()
+		b.OpField(op.LoadR1FieldBytes, b.AddField(build.NewFieldSpec(c.field, 0)))
+		b.LoadConstBytes([]byte(c.substr))
+		b.Op(c.code)
+		expect(b)
+		b.Op(op.ReturnTrue)
+
+		bytecode, err := b.Bytecode()
+		if err != nil {
+			t.Fatal(i, err)
+		}
+
+		prog, err := pbf.NewProgram(bytecode)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+
+		ok, err := pbf.NewMachine(prog).Filter(test.Data())
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if ok != c.result {
+			t.Error(i, c.code, c.substr, ok)
+		}
+	}
+
+	b := build.New()
+	b.OpField(op.LoadR1FieldVector, b.AddField(build.NewFieldSpec(13, 0)))
+	b.LoadConstScalar(1)
+	b.Op(op.ContainsBytes)
+	b.Op(op.ReturnTrue)
+	if _, err := b.Bytecode(); err == nil {
+		t.Error("substring of a vector")
+	}
+
+	b = build.New()
+	b.OpField(op.LoadR1FieldBytes, b.AddField(build.NewFieldSpec(12, 0)))
+	b.LoadConstScalar(1)
+	b.Op(op.HasPrefixBytes)
+	b.Op(op.ReturnTrue)
+	if _, err := b.Bytecode(); err == nil {
+		t.Error("prefix is a scalar")
+	}
+}
@@ -0,0 +1,245 @@
+package build
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ninchat/pbf/field"
+	"github.com/ninchat/pbf/op"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Field which has been resolved against a message descriptor.
+type Field struct {
+	Spec     *FieldSpec                   // Leaf field spec.
+	Desc     protoreflect.FieldDescriptor // Protobuf field.
+	Kind     op.FieldKind                 // How the field is loaded.
+	Value    op.ValueKind                 // How the value or vector elements are compared.
+	Encoding op.ScalarEncoding            // Meaningful only if Kind is FieldVector.
+}
+
+// ResolveField finds a field of a message type, and determines its field spec
+// chain and value representation.  The path consists of field names separated
+// by dots, and element indexes of repeated fields in brackets (e.g. "q[1].x"
+// or "o.z").
+//
+// A message field is loaded as bytes when it's the last element of the path.
+// A packed repeated field is loaded as a vector when no index is specified.
+func ResolveField(md protoreflect.MessageDescriptor, path string) (*Field, error) {
+	elems, err := splitPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec *FieldSpec
+
+	for i := 0; i < len(elems); i++ {
+		name := elems[i]
+		if isIndex(name) {
+			return nil, fmt.Errorf("build: %s: unexpected index", path)
+		}
+
+		fd := md.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			return nil, fmt.Errorf("build: %s: message %s has no field %q", path, md.FullName(), name)
+		}
+		if fd.IsMap() {
+			return nil, fmt.Errorf("build: %s: map field %q is not supported", path, name)
+		}
+		if fd.Kind() == protoreflect.GroupKind {
+			return nil, fmt.Errorf("build: %s: group field %q is not supported", path, name)
+		}
+
+		num := int32(fd.Number())
+		last := i == len(elems)-1
+
+		if fd.IsList() {
+			if last {
+				if !fd.IsPacked() {
+					return nil, fmt.Errorf("build: %s: repeated field %q is not packed, so it requires an index", path, name)
+				}
+				return newVectorField(spec.Sub(num, 0), fd), nil
+			}
+
+			i++
+			if !isIndex(elems[i]) {
+				return nil, fmt.Errorf("build: %s: repeated field %q requires an index", path, name)
+			}
+			index, err := strconv.ParseInt(elems[i][1:len(elems[i])-1], 10, 32)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("build: %s: invalid index %s", path, elems[i])
+			}
+			last = i == len(elems)-1
+
+			if fd.IsPacked() {
+				spec = spec.SubPacked(num, packedSubtype(fd))
+			} else {
+				spec = spec.Sub(num, field.ModRepeated)
+			}
+			num = int32(index)
+		}
+
+		if fd.Message() != nil && !last {
+			spec = spec.Sub(num, field.ModMessage)
+			md = fd.Message()
+			continue
+		}
+
+		if !last {
+			return nil, fmt.Errorf("build: %s: field %q is not a message", path, name)
+		}
+
+		return newScalarField(spec.Sub(num, leafMod(fd)), fd)
+	}
+
+	return nil, fmt.Errorf("build: empty field path")
+}
+
+// FindMessage type in a descriptor set.
+func FindMessage(set *descriptorpb.FileDescriptorSet, name protoreflect.FullName) (protoreflect.MessageDescriptor, error) {
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := files.FindDescriptorByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("build: %s is not a message type", name)
+	}
+	return md, nil
+}
+
+func newScalarField(spec *FieldSpec, fd protoreflect.FieldDescriptor) (*Field, error) {
+	f := &Field{
+		Spec: spec,
+		Desc: fd,
+		Kind: op.FieldScalar,
+	}
+
+	switch fd.Kind() {
+	case protoreflect.BoolKind, protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind:
+		f.Value = op.Unsigned
+
+	case protoreflect.EnumKind, protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Sint32Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		f.Value = op.Signed
+
+	case protoreflect.Sfixed32Kind:
+		// Fixed32 values are not sign-extended during decoding.
+		return nil, fmt.Errorf("build: sfixed32 field %s is not supported", fd.FullName())
+
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		f.Value = op.Float
+
+	default: // String, bytes or message.
+		f.Kind = op.FieldBytes
+		f.Value = op.Bytes
+	}
+
+	return f, nil
+}
+
+func newVectorField(spec *FieldSpec, fd protoreflect.FieldDescriptor) *Field {
+	f := &Field{
+		Spec:  spec,
+		Desc:  fd,
+		Kind:  op.FieldVector,
+		Value: op.Unsigned,
+	}
+
+	switch fd.Kind() {
+	case protoreflect.EnumKind, protoreflect.Int32Kind, protoreflect.Int64Kind:
+		f.Value = op.Signed
+	case protoreflect.Sint32Kind, protoreflect.Sint64Kind:
+		f.Value = op.Signed
+		f.Encoding = op.ZigZag
+	case protoreflect.Fixed32Kind:
+		f.Encoding = op.Fixed32
+	case protoreflect.Sfixed32Kind:
+		f.Value = op.Signed
+		f.Encoding = op.Fixed32
+	case protoreflect.FloatKind:
+		f.Value = op.Float
+		f.Encoding = op.Fixed32
+	case protoreflect.Fixed64Kind:
+		f.Encoding = op.Fixed64
+	case protoreflect.Sfixed64Kind:
+		f.Value = op.Signed
+		f.Encoding = op.Fixed64
+	case protoreflect.DoubleKind:
+		f.Value = op.Float
+		f.Encoding = op.Fixed64
+	}
+
+	return f
+}
+
+func leafMod(fd protoreflect.FieldDescriptor) field.Mod {
+	switch fd.Kind() {
+	case protoreflect.Sint32Kind, protoreflect.Sint64Kind:
+		return field.ModZigZag
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return field.ModFloat
+	default:
+		return 0
+	}
+}
+
+func packedSubtype(fd protoreflect.FieldDescriptor) protowire.Type {
+	switch fd.Kind() {
+	case protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind, protoreflect.FloatKind:
+		return protowire.Fixed32Type
+	case protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind, protoreflect.DoubleKind:
+		return protowire.Fixed64Type
+	default:
+		return protowire.VarintType
+	}
+}
+
+// splitPath into names and bracketed indexes.
+func splitPath(path string) ([]string, error) {
+	var elems []string
+
+	for s := path; s != ""; {
+		switch {
+		case s[0] == '[':
+			n := strings.IndexByte(s, ']')
+			if n < 0 {
+				return nil, fmt.Errorf("build: %s: unterminated index", path)
+			}
+			elems = append(elems, s[:n+1])
+			s = s[n+1:]
+
+		default:
+			if len(elems) > 0 {
+				if s[0] != '.' {
+					return nil, fmt.Errorf("build: %s: invalid syntax", path)
+				}
+				s = s[1:]
+			}
+			n := strings.IndexAny(s, ".[")
+			if n < 0 {
+				n = len(s)
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("build: %s: invalid syntax", path)
+			}
+			elems = append(elems, s[:n])
+			s = s[n:]
+		}
+	}
+
+	return elems, nil
+}
+
+func isIndex(elem string) bool {
+	return strings.HasPrefix(elem, "[")
+}
@@ -0,0 +1,92 @@
+package build_test
+
+import (
+	"testing"
+
+	"github.com/ninchat/pbf/build"
+	"github.com/ninchat/pbf/internal/test"
+	"github.com/ninchat/pbf/op"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestResolveField(t *testing.T) {
+	md := (&test.Test{}).ProtoReflect().Descriptor()
+
+	for _, x := range []struct {
+		path  string
+		spec  string
+		kind  op.FieldKind
+		value op.ValueKind
+		enc   op.ScalarEncoding
+	}{
+		{"a", "1", op.FieldScalar, op.Unsigned, 0},
+		{"d", "4", op.FieldScalar, op.Signed, 0},
+		{"e", "5.ZigZag", op.FieldScalar, op.Signed, 0},
+		{"i", "9.Float", op.FieldScalar, op.Float, 0},
+		{"j", "10.Float", op.FieldScalar, op.Float, 0},
+		{"l", "12", op.FieldBytes, op.Bytes, 0},
+		{"m", "13", op.FieldVector, op.Unsigned, op.Varint},
+		{"m[3]", "13.Packed.Varint 3", op.FieldScalar, op.Unsigned, 0},
+		{"n", "14", op.FieldBytes, op.Bytes, 0},
+		{"n.y", "14.Message 2", op.FieldScalar, op.Signed, 0},
+		{"o.z", "15.Message 1", op.FieldVector, op.Signed, op.ZigZag},
+		{"o.z[0]", "15.Message 1.Packed.Varint 0.ZigZag", op.FieldScalar, op.Signed, 0},
+		{"p[1]", "16.Repeated 1.ZigZag", op.FieldScalar, op.Signed, 0},
+		{"q[1]", "17.Repeated 1", op.FieldBytes, op.Bytes, 0},
+		{"q[2].x", "17.Repeated 2.Message 1", op.FieldScalar, op.Signed, 0},
+		{"t", "20", op.FieldVector, op.Float, op.Fixed32},
+		{"t[2]", "20.Packed.Fixed32 2.Float", op.FieldScalar, op.Float, 0},
+		{"u", "21", op.FieldVector, op.Float, op.Fixed64},
+	} {
+		f, err := build.ResolveField(md, x.path)
+		if err != nil {
+			t.Error(x.path, err)
+			continue
+		}
+		if s := f.Spec.String(); s != x.spec {
+			t.Error(x.path, s)
+		}
+		if f.Kind != x.kind || f.Value != x.value || f.Encoding != x.enc {
+			t.Error(x.path, f.Kind, f.Value, f.Encoding)
+		}
+	}
+
+	for _, path := range []string{
+		"",
+		"nonexistent",
+		"a.b",
+		"a[0]",
+		"p",
+		"q.x",
+		"q[1]x",
+		"q[-1]",
+		"q[1",
+		"n..y",
+		"[0]",
+	} {
+		if _, err := build.ResolveField(md, path); err == nil {
+			t.Errorf("no error: %q", path)
+		}
+	}
+}
+
+func TestFindMessage(t *testing.T) {
+	set := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{
+			protodesc.ToFileDescriptorProto(test.File_test_proto),
+		},
+	}
+
+	md, err := build.FindMessage(set, "pbf.internal.test.Sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Fields().Len() != 2 {
+		t.Error(md.Fields().Len())
+	}
+
+	if _, err := build.FindMessage(set, "pbf.internal.test.Nonexistent"); err == nil {
+		t.Error("nonexistent message")
+	}
+}
@@ -0,0 +1,126 @@
+package build
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ninchat/pbf/field"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var errFieldSpecInvalid = errors.New("build: invalid field specification")
+
+// FieldSpec is a node of a field specification path.  The specs passed to
+// Builder.AddField must be leaf nodes; their ancestors are intermediary nodes.
+type FieldSpec struct {
+	Num     int32          // Protobuf field number or sequence index.
+	Mod     field.Mod      // Field decoding modifier.
+	Subtype protowire.Type // Meaningful only if ModPacked.
+	Parent  *FieldSpec     // Intermediary node or nil.
+}
+
+// NewFieldSpec creates a top-level field spec.
+func NewFieldSpec(num int32, mod field.Mod) *FieldSpec {
+	return &FieldSpec{Num: num, Mod: mod}
+}
+
+// NewPackedFieldSpec creates a top-level ModPacked field spec.
+func NewPackedFieldSpec(num int32, subtype protowire.Type) *FieldSpec {
+	return &FieldSpec{Num: num, Mod: field.ModPacked, Subtype: subtype}
+}
+
+// Sub creates a child node.  If f is nil, a top-level node is created.
+func (f *FieldSpec) Sub(num int32, mod field.Mod) *FieldSpec {
+	return &FieldSpec{Num: num, Mod: mod, Parent: f}
+}
+
+// SubPacked creates a ModPacked child node.  If f is nil, a top-level node is
+// created.
+func (f *FieldSpec) SubPacked(num int32, subtype protowire.Type) *FieldSpec {
+	return &FieldSpec{Num: num, Mod: field.ModPacked, Subtype: subtype, Parent: f}
+}
+
+// String representation is similar to the one used by the assembler.
+func (f *FieldSpec) String() string {
+	s := field.FormatNode(f.Num, f.Mod, f.Subtype)
+	if f.Parent != nil {
+		s = f.Parent.String() + " " + s
+	}
+	return s
+}
+
+// encode the whole path, from the top-level node to this leaf node.
+func (f *FieldSpec) encode() ([]byte, error) {
+	if !f.Mod.IsLeaf() {
+		return nil, fmt.Errorf("build: field spec %s is not a leaf node", f)
+	}
+
+	var path []*FieldSpec
+	for n := f; n != nil; n = n.Parent {
+		path = append([]*FieldSpec{n}, path...)
+	}
+
+	var b []byte
+	for _, n := range path {
+		if n.Num < 0 || !n.Mod.IsValid() {
+			return nil, errFieldSpecInvalid
+		}
+		if n != f && n.Mod.IsLeaf() {
+			return nil, fmt.Errorf("build: field spec %s has leaf node as intermediary", f)
+		}
+
+		var x [4]byte
+		binary.LittleEndian.PutUint32(x[:], uint32(n.Num))
+		b = append(b, x[:]...)
+		b = append(b, byte(n.Mod))
+
+		if n.Mod == field.ModPacked {
+			switch n.Subtype {
+			case protowire.VarintType, protowire.Fixed32Type, protowire.Fixed64Type, protowire.BytesType:
+			default:
+				return nil, fmt.Errorf("build: field spec %s has invalid packed subtype", f)
+			}
+			b = append(b, byte(n.Subtype))
+		}
+	}
+	return b, nil
+}
+
+// ParseFieldSection decodes the field specs of a program, and returns the
+// offset of its instruction section.  The bytecode must be accepted by
+// pbf.NewProgram.
+func ParseFieldSection(bytecode []byte) (specs []*FieldSpec, insnoffset int) {
+	count := int(bytecode[4])
+	off := 5
+	if bytecode[3] != 0 {
+		count = int(binary.LittleEndian.Uint16(bytecode[4:]))
+		off = 6
+	}
+
+	for i := 0; i < count; i++ {
+		var spec *FieldSpec
+
+		for {
+			spec = &FieldSpec{
+				Num:    int32(binary.LittleEndian.Uint32(bytecode[off:])),
+				Mod:    field.Mod(bytecode[off+4]),
+				Parent: spec,
+			}
+			off += 5
+
+			if spec.Mod == field.ModPacked {
+				spec.Subtype = protowire.Type(bytecode[off])
+				off++
+			}
+
+			if spec.Mod.IsLeaf() {
+				break
+			}
+		}
+
+		specs = append(specs, spec)
+	}
+
+	return specs, off
+}
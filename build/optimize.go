@@ -0,0 +1,715 @@
+package build
+
+import (
+	"sort"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/field"
+	"github.com/ninchat/pbf/op"
+)
+
+// Optimize a bytecode program.  The result is equivalent to the original
+// program, but smaller and faster:
+//
+//   - Loads of the field or the constant which a register already contains are
+//     eliminated.
+//   - Comparisons whose result is known are folded into the jumps which depend
+//     on them.
+//   - Jumps to jumps are threaded.
+//   - Unreachable code, instructions whose results are not used, and field
+//     specs which are not used by any instruction are removed; the remaining
+//     fields are reindexed.
+//   - Constants are deduplicated.
+//
+// Field indexes and instruction offsets change, so the values which are
+// retrieved from a Machine after filtering must be looked up by field spec.
+// Messages which can't be decoded may be reported differently, since fields
+// which don't affect filtering decisions are no longer decoded.  Bytecode with
+// field specs which can't be declared using FieldSpec is rejected.
+func Optimize(bytecode []byte) ([]byte, error) {
+	if _, err := pbf.NewProgram(bytecode); err != nil {
+		return nil, err
+	}
+
+	o := newOptimizer(bytecode)
+	for o.pass() {
+	}
+	return o.emit()
+}
+
+type optimizer struct {
+	specs []*FieldSpec
+	insns map[int]*insn // Instructions by original bytecode offset.
+	entry int
+}
+
+type insn struct {
+	code    op.Code // Narrow or short opcode.
+	arg     uint64  // Field index, comparison opcode or scalar value.
+	data    []byte  // Constant of LoadConstBytes.
+	next    int     // Offset of the next instruction, or -1 if execution doesn't continue.
+	target  int     // Jump target of a skip, LoopNext or LoopBack instruction.
+	removed bool    // Execution continues at next without effect.
+}
+
+func newOptimizer(bytecode []byte) *optimizer {
+	specs, insnoffset := ParseFieldSection(bytecode)
+
+	o := &optimizer{
+		specs: specs,
+		insns: make(map[int]*insn),
+		entry: insnoffset,
+	}
+
+	for queue := []int{o.entry}; len(queue) > 0; {
+		off := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+
+		if _, done := o.insns[off]; done {
+			continue
+		}
+
+		n := decodeInsn(bytecode, off)
+		o.insns[off] = n
+
+		if n.next >= 0 {
+			queue = append(queue, n.next)
+		}
+		if n.target >= 0 && n.code != op.LoopBack {
+			queue = append(queue, n.target)
+		}
+	}
+
+	return o
+}
+
+// decodeInsn at the given offset of verified bytecode.
+func decodeInsn(bytecode []byte, off int) *insn {
+	code := op.Code(bytecode[off])
+	end := off + code.Size()
+	n := &insn{
+		code:   code.Narrow().Short(),
+		arg:    code.Arg(bytecode[off+1:]),
+		next:   end,
+		target: -1,
+	}
+
+	switch {
+	case n.code.IsSkip():
+		n.target = end + int(n.arg)
+		n.arg = 0
+
+	case n.code == op.LoopNext:
+		index, exit := op.SplitLoopNextArg(n.arg)
+		n.target = end + int(exit)
+		n.arg = uint64(index)
+
+	case n.code == op.LoopBack:
+		n.target = end - int(n.arg)
+		n.arg = 0
+
+	case n.code == op.LoadConstBytes:
+		start, size := uint32(n.arg), uint32(n.arg>>32)
+		n.data = bytecode[start : start+size]
+		n.arg = 0
+	}
+
+	if !n.code.Continues() {
+		n.next = -1
+	}
+	return n
+}
+
+// pass simplifies the reachable instructions, and indicates whether something
+// was changed.
+func (o *optimizer) pass() bool {
+	order := o.reachable()
+	states := o.propagate(order)
+
+	changed := false
+	for _, off := range order {
+		if n := o.insns[off]; !n.removed && o.simplify(n, states[off]) {
+			changed = true
+		}
+	}
+
+	if entry := o.resolve(o.entry, statusUnknown); entry != o.entry {
+		o.entry = entry
+		changed = true
+	}
+
+	if o.eliminate(o.reachable()) {
+		changed = true
+	}
+	return changed
+}
+
+// reachable instruction offsets in ascending order.
+func (o *optimizer) reachable() []int {
+	seen := make(map[int]bool)
+	var order []int
+
+	for queue := []int{o.entry}; len(queue) > 0; {
+		off := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+
+		if seen[off] {
+			continue
+		}
+		seen[off] = true
+		order = append(order, off)
+
+		n := o.insns[off]
+		if n.next >= 0 {
+			queue = append(queue, n.next)
+		}
+		if !n.removed && n.target >= 0 && n.code != op.LoopBack {
+			queue = append(queue, n.target)
+		}
+	}
+
+	sort.Ints(order)
+	return order
+}
+
+type status uint8
+
+const (
+	statusUnknown = status(iota)
+	statusFalse
+	statusTrue
+)
+
+func statusOf(b bool) status {
+	if b {
+		return statusTrue
+	}
+	return statusFalse
+}
+
+type regKind uint8
+
+const (
+	regUnknown = regKind(iota)
+	regField
+	regScalar
+	regBytes
+)
+
+// regValue describes the contents of a register.
+type regValue struct {
+	kind  regKind
+	field op.FieldKind // Meaningful only if regField.
+	value uint64       // Field index or scalar constant.
+	data  string       // Meaningful only if regBytes.
+}
+
+// optState before or after an instruction.
+type optState struct {
+	reg    [2]regValue
+	status status
+}
+
+func (s *optState) merge(other optState) {
+	for i := range s.reg {
+		if s.reg[i] != other.reg[i] {
+			s.reg[i] = regValue{}
+		}
+	}
+	if s.status != other.status {
+		s.status = statusUnknown
+	}
+}
+
+// propagate the register contents and the status flag through the reachable
+// instructions.  The jumps are forward, except LoopBack whose target forgets
+// the state, so the states before the instructions are final when they are
+// processed in ascending order.
+func (o *optimizer) propagate(order []int) map[int]optState {
+	states := make(map[int]optState, len(order))
+	seen := make(map[int]bool, len(order))
+
+	flow := func(off int, s optState) {
+		if seen[off] {
+			prev := states[off]
+			prev.merge(s)
+			s = prev
+		}
+		states[off] = s
+		seen[off] = true
+	}
+
+	flow(o.entry, optState{})
+
+	for _, off := range order {
+		n := o.insns[off]
+		s := states[off]
+
+		if n.removed {
+			flow(n.next, s)
+			continue
+		}
+
+		out := transfer(n, s)
+
+		switch {
+		case n.code == op.SkipFalse || n.code == op.SkipTrue:
+			taken := n.code.Option()
+			out.status = statusOf(taken)
+			flow(n.target, out)
+			out.status = statusOf(!taken)
+			flow(n.next, out)
+
+		case n.code == op.Skip || n.code == op.LoopNext:
+			flow(n.target, out)
+			if n.next >= 0 {
+				flow(n.next, out)
+			}
+
+		case n.next >= 0:
+			flow(n.next, out)
+		}
+	}
+
+	return states
+}
+
+// transfer the state through an instruction.
+func transfer(n *insn, s optState) optState {
+	code := n.code
+
+	switch {
+	case code == op.LoadConstScalar0 || code == op.LoadConstScalar1:
+		s.reg[0] = regValue{kind: regScalar, value: uint64(code - op.LoadConstScalar0)}
+
+	case code == op.LoadConstScalar:
+		s.reg[0] = regValue{kind: regScalar, value: n.arg}
+
+	case code == op.LoadConstBytes:
+		s.reg[0] = regValue{kind: regBytes, data: string(n.data)}
+
+	case code == op.LengthR0Bytes && s.reg[0].kind == regBytes:
+		s.reg[0] = regValue{kind: regScalar, value: uint64(len(s.reg[0].data))}
+
+	case code.IsCount():
+		s.reg[code.Reg()] = regValue{}
+
+	case code.HasFieldIndex() && code != op.CheckField:
+		s.reg[code.Reg()] = loadedField(code, n.arg)
+
+	case code == op.LoopNext:
+		// The state of LoopBack instructions isn't propagated.
+		s = optState{}
+
+	case code.SetsStatus():
+		s.status = foldStatus(code, s.reg)
+	}
+
+	return s
+}
+
+func loadedField(code op.Code, index uint64) regValue {
+	return regValue{
+		kind:  regField,
+		field: op.FieldKind((code - op.LoadR0FieldScalar) &^ 1),
+		value: index,
+	}
+}
+
+// foldStatus of a comparison whose result is known, or return statusUnknown.
+// R1 can't be loaded with a constant, but a comparison between a field and
+// itself is known, and so are the unary floating-point comparisons of a
+// constant.
+func foldStatus(code op.Code, reg [2]regValue) status {
+	switch code {
+	case op.CompareFloatInfPos, op.CompareFloatInfNeg, op.CompareFloatNaN:
+		if reg[0].kind != regScalar {
+			return statusUnknown
+		}
+		// Negative infinity is 0xfff0000000000000.
+		switch f := reg[0].value; code {
+		case op.CompareFloatInfPos:
+			return statusOf(f == 0x7ff0000000000000)
+		case op.CompareFloatInfNeg:
+			return statusOf(f == 0xfff0000000000000)
+		default:
+			return statusOf(f&0x7fffffffffffffff > 0x7ff0000000000000)
+		}
+	}
+
+	if reg[0].kind != regField || reg[0] != reg[1] {
+		return statusUnknown
+	}
+
+	switch {
+	case code == op.HasPrefixBytes || code == op.HasSuffixBytes || code == op.ContainsBytes:
+		return statusTrue
+
+	case code.IsCompare() && code.Kind() != op.Float:
+		switch code.Cmp() {
+		case op.CmpGE, op.CmpEQ, op.CmpLE:
+			return statusTrue
+		default:
+			return statusFalse
+		}
+	}
+
+	return statusUnknown
+}
+
+// simplify an instruction, and retarget its jumps.  The state is the one
+// before the instruction.
+func (o *optimizer) simplify(n *insn, s optState) bool {
+	orig := *n
+
+	switch code := n.code; {
+	case code.HasFieldIndex() && code != op.CheckField:
+		if s.reg[code.Reg()] == loadedField(code, n.arg) {
+			n.removed = true
+		}
+
+	case code == op.LoadConstScalar0 || code == op.LoadConstScalar1 || code == op.LoadConstScalar:
+		if r := transfer(n, optState{}).reg[0]; s.reg[0] == r {
+			n.removed = true
+		} else if r.value <= 1 {
+			n.code = op.LoadConstScalar0 + op.Code(r.value)
+		}
+
+	case code == op.LoadConstBytes:
+		if s.reg[0] == (regValue{kind: regBytes, data: string(n.data)}) {
+			n.removed = true
+		}
+
+	case code == op.LengthR0Bytes:
+		if s.reg[0].kind == regBytes {
+			n.code = op.LoadConstScalar
+			n.arg = uint64(len(s.reg[0].data))
+			if n.arg <= 1 {
+				n.code = op.LoadConstScalar0 + op.Code(n.arg)
+			}
+		}
+
+	case code == op.SkipFalse || code == op.SkipTrue:
+		if s.status != statusUnknown {
+			if s.status == statusOf(code.Option()) {
+				n.code = op.Skip
+				n.next = -1
+			} else {
+				n.removed = true
+			}
+		}
+	}
+
+	if !n.removed {
+		out := transfer(n, s)
+
+		switch code := n.code; {
+		case code == op.SkipFalse || code == op.SkipTrue:
+			taken := code.Option()
+			n.target = o.resolve(n.target, statusOf(taken))
+			n.next = o.resolve(n.next, statusOf(!taken))
+			if n.target == n.next {
+				n.removed = true
+			}
+
+		case code == op.Skip:
+			n.target = o.resolve(n.target, out.status)
+
+		case code == op.LoopNext:
+			// The loop is exited at the target, so it isn't moved past the
+			// following instructions.
+			n.target = o.forward(n.target)
+			n.next = o.resolve(n.next, out.status)
+
+		case n.next >= 0:
+			n.next = o.resolve(n.next, out.status)
+		}
+	}
+
+	return n.code != orig.code || n.arg != orig.arg || n.next != orig.next || n.target != orig.target || n.removed
+}
+
+// resolve the instruction which is executed when execution continues at the
+// given offset with the given status flag.
+func (o *optimizer) resolve(off int, st status) int {
+	for {
+		n := o.insns[off]
+
+		switch {
+		case n.removed:
+			off = n.next
+
+		case n.code == op.Skip:
+			off = n.target
+
+		case (n.code == op.SkipFalse || n.code == op.SkipTrue) && st != statusUnknown:
+			if st == statusOf(n.code.Option()) {
+				off = n.target
+			} else {
+				off = n.next
+			}
+
+		default:
+			return off
+		}
+	}
+}
+
+// forward past removed instructions.
+func (o *optimizer) forward(off int) int {
+	for o.insns[off].removed {
+		off = o.insns[off].next
+	}
+	return off
+}
+
+const (
+	liveR0 = 1 << iota
+	liveR1
+	liveStatus
+)
+
+// eliminate instructions whose results are not used, and indicate whether
+// something was removed.
+func (o *optimizer) eliminate(order []int) bool {
+	livein := make(map[int]int, len(order))
+	changed := false
+
+	for i := len(order) - 1; i >= 0; i-- {
+		off := order[i]
+		n := o.insns[off]
+
+		if n.removed {
+			livein[off] = livein[n.next]
+			continue
+		}
+
+		var liveout int
+		if n.next >= 0 {
+			liveout |= livein[n.next]
+		}
+		switch {
+		case n.code.IsSkip() || n.code == op.LoopNext:
+			liveout |= livein[n.target]
+		case n.code == op.LoopBack:
+			// LoopNext forgets the registers.
+			liveout |= liveStatus
+		}
+
+		uses, defs, effect := usage(n.code)
+		if !effect && liveout&defs == 0 {
+			n.removed = true
+			livein[off] = liveout
+			changed = true
+			continue
+		}
+
+		livein[off] = liveout&^defs | uses
+	}
+
+	return changed
+}
+
+// usage of the registers and the status flag by an instruction, and whether it
+// has other effects.
+func usage(code op.Code) (uses, defs int, effect bool) {
+	switch {
+	case code == op.ReturnFalse || code == op.ReturnTrue || code == op.Skip || code == op.LoopBack:
+		return 0, 0, true
+
+	case code == op.SkipFalse || code == op.SkipTrue:
+		return liveStatus, 0, true
+
+	case code == op.LoopNext:
+		return 0, liveR0 | liveR1, true
+
+	case code == op.LoadConstScalar0 || code == op.LoadConstScalar1 || code == op.LoadConstScalar || code == op.LoadConstBytes:
+		return 0, liveR0, false
+
+	case code == op.CheckField:
+		return 0, liveStatus, false
+
+	case code.IsCount() || (code.HasFieldIndex() && code != op.CheckField):
+		r := 1 << code.Reg()
+		if code.IsCount() {
+			uses = r
+		}
+		return uses, r, false
+
+	case code == op.CompareFloatInfPos || code == op.CompareFloatInfNeg || code == op.CompareFloatNaN:
+		return liveR0, liveStatus, false
+
+	default:
+		return liveR0 | liveR1, liveStatus, false
+	}
+}
+
+// emit the reachable instructions in their original order.
+func (o *optimizer) emit() ([]byte, error) {
+	order := o.reachable()
+
+	var emitted []int
+	for _, off := range order {
+		if !o.insns[off].removed {
+			emitted = append(emitted, off)
+		}
+	}
+
+	b := New()
+	indexes := o.addFields(b, emitted)
+
+	labels := make(map[int]Label, len(emitted))
+	for _, off := range emitted {
+		labels[off] = b.NewLabel()
+	}
+
+	// jump to an instruction, or duplicate it if it's a Return.
+	jump := func(code op.Code, off int) {
+		if n := o.insns[off]; code == op.Skip && (n.code == op.ReturnFalse || n.code == op.ReturnTrue) {
+			b.Op(n.code)
+		} else {
+			b.OpSkip(code, labels[off])
+		}
+	}
+
+	for i, off := range emitted {
+		n := o.insns[off]
+		b.Mark(labels[off])
+
+		switch code := n.code; {
+		case code < 64:
+			b.Op(code)
+
+		case code.IsQuantifier():
+			b.OpQuantifier(code, op.Code(n.arg))
+
+		case code.HasFieldIndex():
+			b.OpField(code, indexes[int(n.arg)])
+
+		case code.IsSkip():
+			jump(code, o.forward(n.target))
+
+		case code == op.LoopNext:
+			b.OpLoopNext(indexes[int(n.arg)], labels[o.forward(n.target)])
+
+		case code == op.LoopBack:
+			b.OpLoopBack(labels[n.target])
+
+		case code == op.LoadConstScalar:
+			b.LoadConstScalar(n.arg)
+
+		case code == op.LoadConstBytes:
+			b.LoadConstBytes(n.data)
+		}
+
+		if n.next >= 0 {
+			if next := o.forward(n.next); i+1 == len(emitted) || emitted[i+1] != next {
+				jump(op.Skip, next)
+			}
+		}
+	}
+
+	return b.Bytecode()
+}
+
+// addFields which are used by the instructions, and return the new indexes by
+// original index.
+func (o *optimizer) addFields(b *Builder, emitted []int) map[int]int {
+	used := make(map[int]bool)
+	var loops []int
+
+	for _, off := range emitted {
+		n := o.insns[off]
+		if n.code.HasFieldIndex() || n.code == op.LoopNext {
+			used[int(n.arg)] = true
+		}
+		if n.code == op.LoopNext {
+			loops = append(loops, int(n.arg))
+		}
+	}
+
+	// ModEach nodes must be referenced by their loop fields, and the loop
+	// fields of LoopNext instructions must refer to ModEach nodes.  Other
+	// intermediary nodes keep their direct references too, since scalar values
+	// of a node are accepted only if it's referenced directly.
+	for changed := true; changed; {
+		changed = false
+
+		for i, spec := range o.specs {
+			if !used[i] {
+				continue
+			}
+			for n := spec.Parent; n != nil; n = n.Parent {
+				if j := o.directField(n); j >= 0 && !used[j] {
+					used[j] = true
+					if n.Mod == field.ModEach {
+						loops = append(loops, j)
+					}
+					changed = true
+				}
+			}
+		}
+
+		for _, loop := range loops {
+			if j, found := o.loopElementField(loop, used); !used[j] && found {
+				used[j] = true
+				changed = true
+			}
+		}
+	}
+
+	indexes := make(map[int]int, len(used))
+	for i, spec := range o.specs {
+		if used[i] {
+			indexes[i] = b.AddField(spec)
+		}
+	}
+	return indexes
+}
+
+// directField which refers to an intermediary node directly, or -1.  Every
+// ModEach node has one in verified bytecode.
+func (o *optimizer) directField(node *FieldSpec) int {
+	for i, spec := range o.specs {
+		if spec.Mod == 0 && spec.Num == node.Num && sameNodes(spec.Parent, node.Parent) {
+			return i
+		}
+	}
+	return -1
+}
+
+// loopElementField returns a used field below the ModEach node of a loop
+// field, or the first field directly below it.
+func (o *optimizer) loopElementField(loop int, used map[int]bool) (int, bool) {
+	first := -1
+
+	for i, spec := range o.specs {
+		for n := spec.Parent; n != nil; n = n.Parent {
+			if n.Mod != field.ModEach {
+				continue
+			}
+			if n.Num == o.specs[loop].Num && sameNodes(n.Parent, o.specs[loop].Parent) {
+				if used[i] {
+					return i, true
+				}
+				if first < 0 {
+					first = i
+				}
+			}
+			break
+		}
+	}
+
+	return first, first >= 0
+}
+
+// sameNodes compares field spec paths.
+func sameNodes(a, b *FieldSpec) bool {
+	for a != nil && b != nil {
+		if a.Num != b.Num || a.Mod != b.Mod || a.Subtype != b.Subtype {
+			return false
+		}
+		a, b = a.Parent, b.Parent
+	}
+	return a == nil && b == nil
+}
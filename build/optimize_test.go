@@ -0,0 +1,189 @@
+package build_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ninchat/pbf/asm"
+	"github.com/ninchat/pbf/build"
+	"github.com/ninchat/pbf/internal/test"
+)
+
+func TestOptimize(t *testing.T) {
+	for name, c := range map[string]struct {
+		source   string
+		expected string
+	}{
+		"redundant loads and jumps": {`
+	.field a 1
+	.field b 2
+	.field l 12
+
+	Skip @begin
+hello:	.const "Hello, world!"
+hello2:	.const "Hello, world!"
+
+begin:	LoadR1FieldScalar a
+	LoadConstScalar1
+	CompareUnsignedEQ
+	SkipFalse @fail
+	LoadR1FieldScalar a
+	LoadConstScalar 1
+	CompareUnsignedGE
+	SkipTrue @next
+	Skip @fail
+next:	LoadR1FieldBytes l
+	LoadConstBytes @hello
+	HasPrefixBytes
+	SkipFalse @check
+	Skip @ok
+check:	LoadConstBytes @hello2
+	CompareBytesEQ
+	SkipTrue @ok
+fail:	ReturnFalse
+ok:	Skip @true
+true:	ReturnTrue
+`, `
+	.field a 1
+	.field l 12
+
+	LoadR1FieldScalar a
+	LoadConstScalar1
+	CompareUnsignedEQ
+	SkipFalse @fail
+	CompareUnsignedGE
+	SkipTrue @next
+	ReturnFalse
+next:	LoadR1FieldBytes l
+	LoadConstBytes "Hello, world!"
+	HasPrefixBytes
+	SkipFalse @check
+	ReturnTrue
+check:	CompareBytesEQ
+	SkipTrue @true
+fail:	ReturnFalse
+true:	ReturnTrue
+`},
+
+		"known status": {`
+	.field a 1
+	.field b 2
+
+	LoadR1FieldScalar a
+	LoadR0FieldScalar a
+	CompareSignedLE
+	SkipFalse @fail
+	LoadConstBytes "x"
+	LengthR0Bytes
+	CompareFloatNaN
+	SkipTrue @fail
+	LoadR1FieldScalar b
+	LoadConstScalar0
+	CompareUnsignedEQ
+	SkipTrue @ok
+	LoadConstScalar 0x7ff0000000000000
+	CompareFloatInfPos
+	SkipTrue @ok
+fail:	ReturnFalse
+ok:	ReturnTrue
+`, `
+	ReturnTrue
+`},
+
+		"unused loop field": {`
+	.field q 17
+	.field x 17.Each 1
+	.field y 17.Each 2
+	.field n 17.Count
+
+loop:	LoopNext q @done
+	LoadR1FieldScalar x
+	LoadConstScalar 101
+	CompareSignedEQ
+	SkipTrue @found
+	LoopBack @loop
+found:	ReturnTrue
+done:	ReturnFalse
+`, `
+	.field q 17
+	.field x 17.Each 1
+
+loop:	LoopNext q @done
+	LoadR1FieldScalar x
+	LoadConstScalar 101
+	CompareSignedEQ
+	SkipTrue @found
+	LoopBack @loop
+found:	ReturnTrue
+done:	ReturnFalse
+`},
+
+		"unused direct reference": {`
+	.field m 13
+	.field e 13.Packed.Varint 0
+	.field k 11
+
+	LoadR1FieldScalar e
+	LoadConstScalar 1
+	CompareUnsignedEQ
+	SkipFalse @fail
+	ReturnTrue
+fail:	ReturnFalse
+`, `
+	.field m 13
+	.field e 13.Packed.Varint 0
+
+	LoadR1FieldScalar e
+	LoadConstScalar1
+	CompareUnsignedEQ
+	SkipFalse @fail
+	ReturnTrue
+fail:	ReturnFalse
+`},
+
+		"empty loop body": {`
+	.field q 17
+	.field x 17.Each 1
+
+loop:	LoopNext q @done
+	LoopBack @loop
+done:	ReturnTrue
+`, `
+	.field q 17
+	.field x 17.Each 1
+
+loop:	LoopNext q @done
+	LoopBack @loop
+done:	ReturnTrue
+`},
+	} {
+		bytecode, err := asm.Assemble([]byte(c.source))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		expected, err := asm.Assemble([]byte(c.expected))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		optimized, err := build.Optimize(bytecode)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(optimized, expected) {
+			listing, _ := asm.Disassemble(optimized)
+			t.Errorf("%s:\n%s", name, listing)
+		}
+
+		if x, y := test.Filter(t, bytecode), test.Filter(t, optimized); x != y {
+			t.Errorf("%s: %v %v", name, x, y)
+		}
+	}
+}
+
+func TestOptimizeInvalid(t *testing.T) {
+	if _, err := build.Optimize([]byte{'P', 'B', 'F', 0, 0}); err == nil {
+		t.Error("invalid bytecode was optimized")
+	}
+}
@@ -10,9 +10,12 @@ Bytecode contains a 4-byte header and two sections:
  - Fields
  - Instructions and constants
 
+The header is "PBF\0", or "PBF\1" for the wide format which supports more than
+255 fields.
+
 Field section:
 
- - Field count (1 byte)
+ - Field count (1 byte, or 2 bytes in the wide format)
  - Sequence of variable-length field specifications
 
 Field specification formats (NUM is protobuf field number or sequence index as
@@ -21,9 +24,11 @@ fixed-width 32-bit integer, and SUBTYPE is protobuf field wire type):
  - NUM 0
  - NUM ModZigZag
  - NUM ModFloat
+ - NUM ModCount
  - NUM ModPacked SUBTYPE ...
  - NUM ModMessage ...
  - NUM ModRepeated ...
+ - NUM ModEach ...
 
 Instruction-and-constant section:
 
@@ -32,8 +37,29 @@ Instruction-and-constant section:
 
 The boundary between the sections is determined by the field count.
 
+Field indexes greater than 255 can be referenced only by the instructions with
+a 2-byte field index argument (LoadR0FieldScalarWide etc.).  They may be used
+also in the original format.
+
 The Skip instruction can be used to skip over constants, or the constants may
-simply reside beyond the last Return instruction.
+simply reside beyond the last Return instruction.  A non-empty LoadConstBytes
+constant may not overlap the header or the field section.
+
+A ModCount field is the number of occurrences of the field in its message.  It
+may be declared alongside the other specs of the same field, such as a
+ModRepeated node.
+
+A repeated message field can be iterated by declaring a ModEach node, which
+must also be referenced directly by a field spec without a modifier (the loop
+field).  The fields below the node are not decoded with the message; the
+LoopNext instruction decodes the next element into them and into the loop
+field, or jumps to the loop exit after the last element.  The LoopBack
+instruction jumps backward to a LoopNext instruction.  The verifier accepts a
+LoopBack instruction only if it is located before the exit of the targeted
+loop on every execution path which reaches it, and the registers are undefined
+after LoopNext.  Loops therefore terminate: each backward jump visits a new
+element, and a loop starts from the first element only when it is entered
+without a backward jump.
 
 All integers use little-endian encoding.
 
@@ -0,0 +1,253 @@
+// Package cel translates a subset of the Common Expression Language into PBF
+// bytecode.  The expression is evaluated against a protobuf message, whose
+// fields are referenced by their names:
+//
+//	a == 1u && n.x > 1000 && k == "PBF" && 2.2 in u && has(q[2].x)
+//
+// The supported subset:
+//
+//   - Logical operators ||, && and !.
+//   - Comparison operators ==, !=, <, <=, > and >=, between a field and a
+//     literal or between two fields of the same type.  Strings and bytes are
+//     ordered lexicographically.
+//   - The in operator with a packed repeated field as the right operand.
+//   - The has() macro, mapped to the CheckField instruction.
+//   - Field selection and constant list indexes, e.g. q[1].x.
+//   - Int, uint, double, string, bytes and bool literals.  Enum fields can also
+//     be compared with enum value names.
+//
+// Parsing is done locally; the syntax is CEL's, including string literal
+// prefixes and escapes.  Constructs which cannot be lowered into bytecode
+// (arithmetic, the conditional operator, function calls, comprehension macros,
+// list and map literals and null) are reported as errors with their source
+// positions.
+package cel
+
+import (
+	"fmt"
+	"go/constant"
+	"go/token"
+	"strings"
+
+	"github.com/ninchat/pbf/expr"
+	"github.com/ninchat/pbf/op"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Parse a CEL expression into an expr syntax tree.  Errors are *expr.Error.
+func Parse(src string) (expr.Expr, error) {
+	n, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return lowerCond(n)
+}
+
+// Compile a CEL expression into bytecode.  Field paths are resolved and the
+// expression is type-checked against the message type.  Errors are
+// *expr.Error.
+func Compile(src string, md protoreflect.MessageDescriptor) ([]byte, error) {
+	x, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return expr.Compile(x, md)
+}
+
+var comparisons = map[string]op.Cmp{
+	"<":  op.CmpLT,
+	">=": op.CmpGE,
+	"==": op.CmpEQ,
+	"!=": op.CmpNE,
+	"<=": op.CmpLE,
+	">":  op.CmpGT,
+}
+
+var macros = map[string]bool{
+	"all":        true,
+	"exists":     true,
+	"exists_one": true,
+	"filter":     true,
+	"map":        true,
+}
+
+// lowerCond converts a node which is evaluated as a condition.
+func lowerCond(n *node) (expr.Expr, error) {
+	switch n.kind {
+	case nodeBinary:
+		switch n.name {
+		case "||", "&&":
+			x, err := lowerCond(n.args[0])
+			if err != nil {
+				return nil, err
+			}
+			y, err := lowerCond(n.args[1])
+			if err != nil {
+				return nil, err
+			}
+			if n.name == "||" {
+				return &expr.Or{OpPos: n.pos, X: x, Y: y}, nil
+			}
+			return &expr.And{OpPos: n.pos, X: x, Y: y}, nil
+
+		case "in":
+			x, err := lowerOperand(n.args[0])
+			if err != nil {
+				return nil, err
+			}
+			if n.args[1].kind == nodeList {
+				return nil, unsupported(n.args[1])
+			}
+			y, err := lowerPath(n.args[1])
+			if err != nil {
+				return nil, err
+			}
+			return &expr.In{OpPos: n.pos, X: x, Y: y}, nil
+		}
+
+		if cmp, ok := comparisons[n.name]; ok {
+			x, err := lowerOperand(n.args[0])
+			if err != nil {
+				return nil, err
+			}
+			y, err := lowerOperand(n.args[1])
+			if err != nil {
+				return nil, err
+			}
+			return &expr.Compare{OpPos: n.pos, Op: cmp, X: x, Y: y}, nil
+		}
+
+	case nodeUnary:
+		if n.name == "!" {
+			x, err := lowerCond(n.args[0])
+			if err != nil {
+				return nil, err
+			}
+			return &expr.Not{OpPos: n.pos, X: x}, nil
+		}
+
+	case nodeCall:
+		if n.name == "has" && n.target == nil {
+			if len(n.args) != 1 {
+				return nil, &expr.Error{Pos: n.pos, Msg: "has() takes exactly one argument"}
+			}
+			path, err := lowerPath(n.args[0])
+			if err != nil {
+				return nil, err
+			}
+			return &expr.Has{FunPos: n.pos, Path: path}, nil
+		}
+
+	case nodeIdent, nodeSelect, nodeIndex, nodeLiteral:
+		return lowerOperand(n)
+	}
+
+	return nil, unsupported(n)
+}
+
+// lowerOperand converts a field reference or a literal.
+func lowerOperand(n *node) (expr.Expr, error) {
+	switch n.kind {
+	case nodeLiteral:
+		if n.value == nil {
+			return nil, unsupported(n)
+		}
+		return &expr.Literal{ValuePos: n.pos, Value: n.value}, nil
+
+	case nodeUnary:
+		if x := n.args[0]; n.name == "-" && x.kind == nodeLiteral && (x.tok == tokInt || x.tok == tokDouble) {
+			return &expr.Literal{ValuePos: n.pos, Value: constant.UnaryOp(token.SUB, x.value, 0)}, nil
+		}
+
+	case nodeIdent, nodeSelect, nodeIndex:
+		return lowerPath(n)
+	}
+
+	return nil, unsupported(n)
+}
+
+// lowerPath converts a chain of field selections and indexes.
+func lowerPath(n *node) (*expr.Path, error) {
+	var b strings.Builder
+	pos, err := writePath(&b, n)
+	if err != nil {
+		return nil, err
+	}
+	return &expr.Path{NamePos: pos, Name: b.String()}, nil
+}
+
+func writePath(b *strings.Builder, n *node) (expr.Pos, error) {
+	switch n.kind {
+	case nodeIdent:
+		b.WriteString(n.name)
+		return n.pos, nil
+
+	case nodeSelect:
+		pos, err := writePath(b, n.args[0])
+		if err != nil {
+			return pos, err
+		}
+		b.WriteString(".")
+		b.WriteString(n.name)
+		return pos, nil
+
+	case nodeIndex:
+		pos, err := writePath(b, n.args[0])
+		if err != nil {
+			return pos, err
+		}
+		i := n.args[1]
+		if i.kind != nodeLiteral || (i.tok != tokInt && i.tok != tokUint) {
+			return pos, &expr.Error{Pos: i.pos, Msg: "index must be an integer literal"}
+		}
+		fmt.Fprintf(b, "[%s]", i.value.ExactString())
+		return pos, nil
+
+	case nodeLiteral:
+		return n.pos, &expr.Error{Pos: n.pos, Msg: fmt.Sprintf("expected field path but found %s", describe(n))}
+	}
+
+	return n.pos, unsupported(n)
+}
+
+func unsupported(n *node) error {
+	return &expr.Error{Pos: n.pos, Msg: fmt.Sprintf("%s cannot be lowered to PBF", describe(n))}
+}
+
+func describe(n *node) string {
+	switch n.kind {
+	case nodeIdent:
+		return "identifier " + n.name
+	case nodeLiteral:
+		if n.value == nil {
+			return "null"
+		}
+		return "literal " + n.name
+	case nodeSelect:
+		return "field selection ." + n.name
+	case nodeIndex:
+		return "index expression"
+	case nodeCall:
+		if macros[n.name] && n.target != nil {
+			return "macro " + n.name + "()"
+		}
+		return "function " + n.name + "()"
+	case nodeUnary:
+		if n.name == "-" {
+			return "arithmetic operator -"
+		}
+		return "operator " + n.name
+	case nodeBinary:
+		switch n.name {
+		case "+", "-", "*", "/", "%":
+			return "arithmetic operator " + n.name
+		}
+		return "operator " + n.name
+	case nodeTernary:
+		return "conditional operator"
+	case nodeList:
+		return "list literal"
+	default:
+		return "map literal"
+	}
+}
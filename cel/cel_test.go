@@ -0,0 +1,77 @@
+package cel_test
+
+import (
+	"testing"
+
+	"github.com/ninchat/pbf/cel"
+	"github.com/ninchat/pbf/internal/test"
+)
+
+func TestCEL(t *testing.T) {
+	for src, result := range map[string]bool{
+		`a == 1u && b != 1u && n.x > 1000 && "PBF" == k && 2.2 in u`:  true,
+		`a == 1u && b != 1u && n.x > 1000 && "PBF" == k && 3.14 in u`: false,
+		`a == 1 || b == 1`:                                                true,
+		`!(a == 2 || b == 1)`:                                             true,
+		`c == 3 && d < 0 && e == -5 && f < -5`:                            true,
+		`g >= 0x7f000007u && h <= 0x8000000000000008u`:                    true,
+		`i == 3.141592653589793 && j == 3.141592653589793`:                true,
+		`l == 'Hello, world!' && l > "Hello" && l != k`:                   true,
+		`l == r'Hello, world!' && l == "Hello,\x20world!"`:                true,
+		`k == b"PBF" && k == b'\x50\102F' && k == """PBF""" && k < "PBG"`: true,
+		`m[3] == 4 && n.y == 56789 && o.z[0] == -3 && q[2].x == 102`:      true,
+		`4 in m && -3 in o.z && !(-4 in o.z)`:                             true,
+		`has(a) && has(q[2]) && has(n.x) && !has(s)`:                      true,
+		`true && (false || c != 3)`:                                       false,
+		"// comment\na == 1 &&\n\tb == 2":                                 true,
+	} {
+		if ok := test.FilterSource(t, src, cel.Compile); ok != result {
+			t.Errorf("%s: %v", src, ok)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for src, msg := range map[string]string{
+		`a + 1 == 2`:              "1:3: arithmetic operator + cannot be lowered to PBF",
+		`a == -b`:                 "1:6: arithmetic operator - cannot be lowered to PBF",
+		`a == 1 ? b == 1 : false`: "1:8: conditional operator cannot be lowered to PBF",
+		`size(l) > 3`:             "1:1: function size() cannot be lowered to PBF",
+		`l.startsWith("H")`:       "1:3: function startsWith() cannot be lowered to PBF",
+		`m.exists(x, x > 3)`:      "1:3: macro exists() cannot be lowered to PBF",
+		`a in [1, 2]`:             "1:6: list literal cannot be lowered to PBF",
+		`{"x": 1}["x"] == 1`:      "1:1: map literal cannot be lowered to PBF",
+		`s == null`:               "1:6: null cannot be lowered to PBF",
+		`m[a] == 1`:               "1:3: index must be an integer literal",
+		`has(1)`:                  "1:5: expected field path but found literal 1",
+		`a == 1 &&`:               "1:10: unexpected end of expression",
+		`a == 1 @`:                "1:8: unexpected character '@'",
+		`l == "x`:                 "1:6: unterminated string",
+		`l == "\q"`:               "1:6: invalid escape sequence: \\q",
+		"a == 1 &&\nc = 3":        "2:3: unexpected character '='",
+	} {
+		_, err := cel.Parse(src)
+		if err == nil {
+			t.Errorf("%q: no error", src)
+		} else if err.Error() != msg {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	md := (&test.Test{}).ProtoReflect().Descriptor()
+
+	for src, msg := range map[string]string{
+		`a == -1`:  "1:6: constant -1 overflows uint32 field a",
+		`x == 1`:   "1:1: ",
+		`a == "x"`: "1:6: ",
+	} {
+		_, err := cel.Compile(src, md)
+		if err == nil {
+			t.Errorf("%q: no error", src)
+		} else if s := err.Error(); len(s) < len(msg) || s[:len(msg)] != msg {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+}
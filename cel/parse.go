@@ -0,0 +1,654 @@
+package cel
+
+import (
+	"fmt"
+	"go/constant"
+	"go/token"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ninchat/pbf/expr"
+)
+
+type tokenKind int
+
+const (
+	tokEOF = tokenKind(iota)
+	tokIdent
+	tokInt
+	tokUint
+	tokDouble
+	tokString
+	tokBytes
+	tokOp
+)
+
+type lexer struct {
+	src  string
+	off  int
+	line int
+	col  int
+
+	// Current token.
+	kind  tokenKind
+	text  string
+	value constant.Value
+	pos   expr.Pos
+}
+
+var operators = []string{
+	"||", "&&", "==", "!=", "<=", ">=",
+	"<", ">", "!", "+", "-", "*", "/", "%", "?", ":", ".", ",", "(", ")", "[", "]", "{", "}",
+}
+
+func (l *lexer) position() expr.Pos {
+	return expr.Pos{Offset: l.off, Line: l.line, Column: l.col}
+}
+
+func (l *lexer) advance(n int) {
+	for _, c := range []byte(l.src[l.off : l.off+n]) {
+		if c == '\n' {
+			l.line++
+			l.col = 1
+		} else {
+			l.col++
+		}
+	}
+	l.off += n
+}
+
+// next token.
+func (l *lexer) next() error {
+	for l.off < len(l.src) {
+		switch c := l.src[l.off]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			l.advance(1)
+			continue
+		case strings.HasPrefix(l.src[l.off:], "//"):
+			n := strings.IndexByte(l.src[l.off:], '\n')
+			if n < 0 {
+				n = len(l.src) - l.off
+			}
+			l.advance(n)
+			continue
+		}
+		break
+	}
+
+	l.pos = l.position()
+	l.value = nil
+
+	if l.off == len(l.src) {
+		l.kind = tokEOF
+		l.text = ""
+		return nil
+	}
+
+	s := l.src[l.off:]
+	c := s[0]
+
+	switch {
+	case isDigit(c) || (c == '.' && len(s) > 1 && isDigit(s[1])):
+		return l.number(s)
+
+	case c == '"' || c == '\'':
+		return l.quoted(s, false, false)
+
+	case (c == 'r' || c == 'R' || c == 'b' || c == 'B') && len(s) > 1:
+		raw := c == 'r' || c == 'R'
+		bytes := c == 'b' || c == 'B'
+		prefix := 1
+		if len(s) > 2 && (s[1] == 'r' || s[1] == 'R' || s[1] == 'b' || s[1] == 'B') && (s[1]|0x20) != (c|0x20) {
+			raw = true
+			bytes = true
+			prefix = 2
+		}
+		if s[prefix] == '"' || s[prefix] == '\'' {
+			l.advance(prefix)
+			return l.quoted(l.src[l.off:], raw, bytes)
+		}
+	}
+
+	if isIdentStart(c) {
+		n := 1
+		for n < len(s) && (isIdentStart(s[n]) || isDigit(s[n])) {
+			n++
+		}
+		l.kind = tokIdent
+		l.text = s[:n]
+		l.advance(n)
+		return nil
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(s, op) {
+			l.kind = tokOp
+			l.text = op
+			l.advance(len(op))
+			return nil
+		}
+	}
+
+	r, _ := utf8.DecodeRuneInString(s)
+	return &expr.Error{Pos: l.pos, Msg: fmt.Sprintf("unexpected character %q", r)}
+}
+
+func (l *lexer) number(s string) error {
+	n := 0
+	hex := strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X")
+	float := false
+
+	if hex {
+		n = 2
+		for n < len(s) && isHexDigit(s[n]) {
+			n++
+		}
+	} else {
+		for n < len(s) && isDigit(s[n]) {
+			n++
+		}
+		if n < len(s) && s[n] == '.' && n+1 < len(s) && isDigit(s[n+1]) {
+			float = true
+			n++
+			for n < len(s) && isDigit(s[n]) {
+				n++
+			}
+		}
+		if n < len(s) && (s[n] == 'e' || s[n] == 'E') {
+			m := n + 1
+			if m < len(s) && (s[m] == '+' || s[m] == '-') {
+				m++
+			}
+			if m < len(s) && isDigit(s[m]) {
+				float = true
+				n = m
+				for n < len(s) && isDigit(s[n]) {
+					n++
+				}
+			}
+		}
+	}
+
+	text := s[:n]
+	l.text = text
+
+	switch {
+	case float:
+		l.kind = tokDouble
+		l.value = constant.MakeFromLiteral(text, token.FLOAT, 0)
+
+	case n < len(s) && (s[n] == 'u' || s[n] == 'U'):
+		l.kind = tokUint
+		l.value = constant.MakeFromLiteral(text, token.INT, 0)
+		n++
+
+	default:
+		l.kind = tokInt
+		l.value = constant.MakeFromLiteral(text, token.INT, 0)
+	}
+
+	if l.value.Kind() == constant.Unknown {
+		return &expr.Error{Pos: l.pos, Msg: fmt.Sprintf("invalid number: %s", text)}
+	}
+
+	l.advance(n)
+	return nil
+}
+
+func (l *lexer) quoted(s string, raw, bytes bool) error {
+	quote := s[:1]
+	if strings.HasPrefix(s, strings.Repeat(quote, 3)) {
+		quote = s[:3]
+	}
+
+	var b strings.Builder
+	n := len(quote)
+
+	for {
+		if n >= len(s) || (len(quote) == 1 && s[n] == '\n') {
+			return &expr.Error{Pos: l.pos, Msg: "unterminated string"}
+		}
+		if strings.HasPrefix(s[n:], quote) {
+			n += len(quote)
+			break
+		}
+
+		if s[n] == '\\' && !raw {
+			r, size, err := unescape(s[n:])
+			if err != nil {
+				return &expr.Error{Pos: l.pos, Msg: err.Error()}
+			}
+			if r < 0 {
+				b.WriteByte(s[n+size-1])
+			} else if bytes && r < 0x100 {
+				b.WriteByte(byte(r))
+			} else {
+				b.WriteRune(r)
+			}
+			n += size
+			continue
+		}
+
+		b.WriteByte(s[n])
+		n++
+	}
+
+	if bytes {
+		l.kind = tokBytes
+	} else {
+		l.kind = tokString
+	}
+	l.text = s[:n]
+	l.value = constant.MakeString(b.String())
+	l.advance(n)
+	return nil
+}
+
+// unescape a backslash sequence.  A negative rune indicates that the last byte
+// of the sequence is taken literally.
+func unescape(s string) (r rune, size int, err error) {
+	if len(s) < 2 {
+		return 0, 0, fmt.Errorf("invalid escape sequence")
+	}
+
+	switch s[1] {
+	case 'a':
+		return '\a', 2, nil
+	case 'b':
+		return '\b', 2, nil
+	case 'f':
+		return '\f', 2, nil
+	case 'n':
+		return '\n', 2, nil
+	case 'r':
+		return '\r', 2, nil
+	case 't':
+		return '\t', 2, nil
+	case 'v':
+		return '\v', 2, nil
+	case '\\', '\'', '"', '`', '?':
+		return -1, 2, nil
+
+	case 'x', 'X', 'u', 'U':
+		digits := 2
+		switch s[1] {
+		case 'u':
+			digits = 4
+		case 'U':
+			digits = 8
+		}
+		if len(s) < 2+digits {
+			return 0, 0, fmt.Errorf("invalid escape sequence")
+		}
+		x, err := strconv.ParseUint(s[2:2+digits], 16, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid escape sequence: %s", s[:2+digits])
+		}
+		return rune(x), 2 + digits, nil
+
+	case '0', '1', '2', '3':
+		if len(s) < 4 {
+			return 0, 0, fmt.Errorf("invalid escape sequence")
+		}
+		x, err := strconv.ParseUint(s[1:4], 8, 8)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid escape sequence: %s", s[:4])
+		}
+		return rune(x), 4, nil
+
+	default:
+		return 0, 0, fmt.Errorf("invalid escape sequence: %s", s[:2])
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+type nodeKind int
+
+const (
+	nodeIdent = nodeKind(iota)
+	nodeLiteral
+	nodeSelect  // args[0].name
+	nodeIndex   // args[0][args[1]]
+	nodeCall    // name(args...) or target.name(args...)
+	nodeUnary   // name args[0]
+	nodeBinary  // args[0] name args[1]
+	nodeTernary // args[0] ? args[1] : args[2]
+	nodeList    // [args...]
+	nodeMap     // {args[0]: args[1], ...}
+)
+
+// node of CEL syntax tree.
+type node struct {
+	kind   nodeKind
+	pos    expr.Pos
+	name   string // Identifier, field, function or operator.
+	tok    tokenKind
+	value  constant.Value
+	target *node // Receiver of member call.
+	args   []*node
+}
+
+type parser struct {
+	lexer
+}
+
+func parse(src string) (*node, error) {
+	p := parser{lexer{src: src, line: 1, col: 1}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.kind != tokEOF {
+		return nil, p.unexpected()
+	}
+	return n, nil
+}
+
+func (p *parser) unexpected() error {
+	if p.kind == tokEOF {
+		return &expr.Error{Pos: p.pos, Msg: "unexpected end of expression"}
+	}
+	return &expr.Error{Pos: p.pos, Msg: fmt.Sprintf("unexpected %s", p.text)}
+}
+
+func (p *parser) isOp(ops ...string) bool {
+	if p.kind != tokOp {
+		return false
+	}
+	for _, op := range ops {
+		if p.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.isOp(op) {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+func (p *parser) parseExpr() (*node, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.isOp("?") {
+		return cond, nil
+	}
+	pos := p.pos
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	x, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	y, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	return &node{kind: nodeTernary, pos: pos, name: "?:", args: []*node{cond, x, y}}, nil
+}
+
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"<", "<=", ">=", ">", "==", "!=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) parseBinary(level int) (*node, error) {
+	if level == len(precedence) {
+		return p.parseUnary()
+	}
+
+	x, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp(precedence[level]...) || (level == 2 && p.kind == tokIdent && p.text == "in") {
+		pos := p.pos
+		op := p.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		y, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		x = &node{kind: nodeBinary, pos: pos, name: op, args: []*node{x, y}}
+	}
+
+	return x, nil
+}
+
+func (p *parser) parseUnary() (*node, error) {
+	if p.isOp("!", "-") {
+		pos := p.pos
+		op := p.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &node{kind: nodeUnary, pos: pos, name: op, args: []*node{x}}, nil
+	}
+
+	return p.parseMember()
+}
+
+func (p *parser) parseMember() (*node, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case p.isOp("."):
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if p.kind != tokIdent {
+				return nil, p.unexpected()
+			}
+			pos := p.pos
+			name := p.text
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+
+			if p.isOp("(") {
+				args, err := p.parseList(")")
+				if err != nil {
+					return nil, err
+				}
+				x = &node{kind: nodeCall, pos: pos, name: name, target: x, args: args}
+			} else {
+				x = &node{kind: nodeSelect, pos: pos, name: name, args: []*node{x}}
+			}
+
+		case p.isOp("["):
+			pos := p.pos
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			i, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &node{kind: nodeIndex, pos: pos, name: "[]", args: []*node{x, i}}
+
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (*node, error) {
+	pos := p.pos
+
+	switch p.kind {
+	case tokIdent:
+		name := p.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		switch name {
+		case "true", "false":
+			return &node{kind: nodeLiteral, pos: pos, name: name, tok: tokIdent, value: constant.MakeBool(name == "true")}, nil
+		case "null":
+			return &node{kind: nodeLiteral, pos: pos, name: name, tok: tokIdent}, nil
+		}
+
+		if p.isOp("(") {
+			args, err := p.parseList(")")
+			if err != nil {
+				return nil, err
+			}
+			return &node{kind: nodeCall, pos: pos, name: name, args: args}, nil
+		}
+		return &node{kind: nodeIdent, pos: pos, name: name}, nil
+
+	case tokInt, tokUint, tokDouble, tokString, tokBytes:
+		n := &node{kind: nodeLiteral, pos: pos, name: p.text, tok: p.kind, value: p.value}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		return n, nil
+
+	case tokOp:
+		switch p.text {
+		case "(":
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return x, nil
+
+		case "[":
+			args, err := p.parseList("]")
+			if err != nil {
+				return nil, err
+			}
+			return &node{kind: nodeList, pos: pos, name: "[]", args: args}, nil
+
+		case "{":
+			args, err := p.parseMap()
+			if err != nil {
+				return nil, err
+			}
+			return &node{kind: nodeMap, pos: pos, name: "{}", args: args}, nil
+		}
+	}
+
+	return nil, p.unexpected()
+}
+
+// parseList of comma-separated expressions, starting at the opening token.
+func (p *parser) parseList(end string) ([]*node, error) {
+	var args []*node
+
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	for !p.isOp(end) {
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, x)
+
+		if !p.isOp(",") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expect(end); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// parseMap entries, starting at the opening brace.
+func (p *parser) parseMap() ([]*node, error) {
+	var args []*node
+
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	for !p.isOp("}") {
+		k, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, k, v)
+
+		if !p.isOp(",") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
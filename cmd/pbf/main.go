@@ -0,0 +1,249 @@
+// Command pbf filters protobuf messages using PBF bytecode programs.
+//
+//	pbf filter -p prog.pbf [-o output] [input...]
+//	pbf check prog.pbf...
+//	pbf dis prog.pbf
+//
+// The filter subcommand reads varint length-delimited messages from the input
+// files (default: stdin) and writes the matching ones to the output in the same
+// format.  Messages which fail to decode are reported on stderr and treated
+// according to the filtering decision, which is made against the partially
+// decoded message; the exit status is 1 if there were errors.
+//
+// The check subcommand verifies programs, and the dis subcommand prints the
+// assembly listing of a program (see package asm).
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/asm"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const usage = `Usage:
+  %[1]s filter -p prog.pbf [-o output] [input...]
+  %[1]s check prog.pbf...
+  %[1]s dis prog.pbf
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+
+	var status int
+
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "filter":
+		status = filter(args)
+	case "check":
+		status = check(args)
+	case "dis":
+		status = dis(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprintf(os.Stdout, usage, os.Args[0])
+	default:
+		fmt.Fprintf(os.Stderr, "%s: unknown command: %s\n", os.Args[0], cmd)
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		status = 2
+	}
+
+	os.Exit(status)
+}
+
+func newFlagSet(name, args string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s %s\n", os.Args[0], name, args)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func loadProgram(filename string) (*pbf.Program, error) {
+	bytecode, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return prog, nil
+}
+
+func filter(args []string) int {
+	flags := newFlagSet("filter", "-p prog.pbf [-o output] [input...]")
+	progname := flags.String("p", "", "bytecode program filename (required)")
+	output := flags.String("o", "", "output filename (default: stdout)")
+	maxsize := flags.Int("max-size", pbf.DefaultMaxSize, "message size limit")
+	flags.Parse(args)
+
+	if *progname == "" {
+		flags.Usage()
+		return 2
+	}
+
+	prog, err := loadProgram(*progname)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var (
+		out  io.Writer = os.Stdout
+		file *os.File
+	)
+	if *output != "" {
+		file, err = os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		out = file
+	}
+	w := bufio.NewWriter(out)
+
+	inputs := flags.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	status := 0
+
+	for _, name := range inputs {
+		if err := filterFile(w, prog, name, *maxsize); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		status = 1
+	}
+	if file != nil {
+		// Write errors may be reported only when the file is closed.
+		if err := file.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func filterFile(w io.Writer, prog *pbf.Program, name string, maxsize int) error {
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	} else {
+		name = "stdin"
+	}
+
+	r := pbf.NewReader(in, prog)
+	r.MaxSize = maxsize
+
+	var (
+		buf   []byte
+		fails int
+	)
+
+	for {
+		msg, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var e *pbf.DecodeError
+			if !errors.As(err, &e) {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			fails++
+			if !r.Passed() {
+				continue
+			}
+		}
+
+		buf = protowire.AppendVarint(buf[:0], uint64(len(msg)))
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		if _, err := w.Write(msg); err != nil {
+			return err
+		}
+	}
+
+	if fails > 0 {
+		return fmt.Errorf("%s: %d decoding errors", name, fails)
+	}
+	return nil
+}
+
+func check(args []string) int {
+	flags := newFlagSet("check", "prog.pbf...")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	status := 0
+
+	for _, name := range flags.Args() {
+		prog, err := loadProgram(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: ok, %d fields\n", name, prog.FieldCount())
+	}
+
+	return status
+}
+
+func dis(args []string) int {
+	flags := newFlagSet("dis", "prog.pbf")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	bytecode, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	listing, err := asm.Disassemble(bytecode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+
+	if _, err := os.Stdout.Write(listing); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
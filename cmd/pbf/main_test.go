@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/asm"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Messages pass unless field 1 is 2.
+const filterSource = `
+.field a 1
+	LoadR1FieldScalar a
+	LoadConstScalar 2
+	CompareUnsignedEQ
+	SkipTrue @fail
+	ReturnTrue
+fail:	ReturnFalse
+`
+
+func delimit(messages ...[]byte) []byte {
+	var stream []byte
+	for _, msg := range messages {
+		stream = protowire.AppendVarint(stream, uint64(len(msg)))
+		stream = append(stream, msg...)
+	}
+	return stream
+}
+
+func TestFilterFile(t *testing.T) {
+	bytecode, err := asm.Assemble([]byte(filterSource))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		empty      = []byte{}
+		pass       = []byte{0x08, 0x01}
+		fail       = []byte{0x08, 0x02}
+		brokenPass = []byte{0x08, 0x01, 0xff}
+		brokenFail = []byte{0x08, 0x02, 0xff}
+	)
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "input")
+
+	input := delimit(empty, fail, pass, brokenFail, brokenPass, empty)
+	if err := os.WriteFile(name, input, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := filterFile(&out, prog, name, pbf.DefaultMaxSize); err == nil || err.Error() != name+": 2 decoding errors" {
+		t.Error(err)
+	}
+	if expect := delimit(empty, pass, brokenPass, empty); !bytes.Equal(out.Bytes(), expect) {
+		t.Errorf("%q", out.Bytes())
+	}
+
+	// Output can be filtered again.
+	if err := os.WriteFile(name, out.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out2 bytes.Buffer
+	if err := filterFile(&out2, prog, name, pbf.DefaultMaxSize); err == nil {
+		t.Error("no decoding errors")
+	}
+	if !bytes.Equal(out2.Bytes(), out.Bytes()) {
+		t.Errorf("%q", out2.Bytes())
+	}
+
+	// Truncated stream.
+	if err := os.WriteFile(name, input[:len(input)-3], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := filterFile(io.Discard, prog, name, pbf.DefaultMaxSize); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error(err)
+	}
+}
+
+func TestFilterOutput(t *testing.T) {
+	bytecode, err := asm.Assemble([]byte(filterSource))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	progname := filepath.Join(dir, "prog.pbf")
+	input := filepath.Join(dir, "input")
+	output := filepath.Join(dir, "output")
+
+	if err := os.WriteFile(progname, bytecode, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pass := []byte{0x08, 0x01}
+	if err := os.WriteFile(input, delimit(pass, []byte{0x08, 0x02}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := filter([]string{"-p", progname, "-o", output, input}); status != 0 {
+		t.Error(status)
+	}
+	if data, err := os.ReadFile(output); err != nil || !bytes.Equal(data, delimit(pass)) {
+		t.Errorf("%q %v", data, err)
+	}
+
+	// Write errors of the output file are reported.
+	if _, err := os.Stat("/dev/full"); err == nil {
+		if status := filter([]string{"-p", progname, "-o", "/dev/full", input}); status != 1 {
+			t.Error(status)
+		}
+	}
+}
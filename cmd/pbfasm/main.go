@@ -0,0 +1,61 @@
+// Command pbfasm assembles PBF bytecode from source code, or disassembles
+// bytecode into source code.  See package asm for the syntax.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ninchat/pbf/asm"
+)
+
+func main() {
+	disassemble := flag.Bool("d", false, "disassemble bytecode")
+	output := flag.String("o", "", "output filename (default: stdout)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-d] [-o output] [input]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var (
+		src []byte
+		err error
+	)
+	switch flag.NArg() {
+	case 0:
+		src, err = ioutil.ReadAll(os.Stdin)
+	case 1:
+		src, err = ioutil.ReadFile(flag.Arg(0))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var result []byte
+	if *disassemble {
+		result, err = asm.Disassemble(src)
+	} else {
+		result, err = asm.Assemble(src)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(result)
+	} else {
+		err = ioutil.WriteFile(*output, result, 0o644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -1,7 +1,6 @@
 package pbf
 
 import (
-	"errors"
 	"io"
 	"math"
 
@@ -9,18 +8,11 @@ import (
 	"google.golang.org/protobuf/encoding/protowire"
 )
 
-var (
-	errProtobufDeprecated = errors.New("pbf: protobuf message uses deprecated encoding")
-	errProtobufFieldType  = errors.New("pbf: protobuf message has unexpected field type")
-	errProtobufInvalid    = errors.New("pbf: protobuf message encoding is invalid")
-	errProtobufTooLong    = errors.New("pbf: protobuf message is too long")
-)
-
 // decode protobuf fields.
 func (m *Machine) decode() (err error) {
 	if len(m.protobuf) > math.MaxInt32 {
 		// Byte offsets and lengths could overflow the field data encoding.
-		return errProtobufTooLong
+		return newDecodeError(ErrProtobufTooLong, 0, 0)
 	}
 
 	if m.fieldspecarr != nil {
@@ -43,9 +35,10 @@ func (m *Machine) decodeTopMessage(buf []byte) error {
 	}
 
 	for off := 0; off < len(buf); {
+		start := off // Offset of the current field.
 		tag, typ, n := protowire.ConsumeTag(buf[off:])
 		if n < 0 {
-			return protowire.ParseError(n)
+			return fieldDecodeError(protowire.ParseError(n), start, tag, typ)
 		}
 		off += n
 
@@ -53,61 +46,61 @@ func (m *Machine) decodeTopMessage(buf []byte) error {
 		case protowire.VarintType:
 			v, n := protowire.ConsumeVarint(buf[off:])
 			if n < 0 {
-				return protowire.ParseError(n)
+				return fieldDecodeError(protowire.ParseError(n), start, tag, typ)
 			}
 			off += n
 
-			if s, found := m.getTopMessageFieldSpec(tag); found {
-				if err := m.decodeFieldScalar(&s, v); err != nil {
-					return err
+			if s := m.getTopMessageFieldSpec(tag); s != nil {
+				if err := m.decodeFieldScalar(s, v); err != nil {
+					return fieldDecodeError(err, start, tag, typ)
 				}
 			}
 
 		case protowire.Fixed32Type:
 			v, n := protowire.ConsumeFixed32(buf[off:])
 			if n < 0 {
-				return protowire.ParseError(n)
+				return fieldDecodeError(protowire.ParseError(n), start, tag, typ)
 			}
 			off += n
 
-			if s, found := m.getTopMessageFieldSpec(tag); found {
-				if err := m.decodeFieldScalar32(&s, v); err != nil {
-					return err
+			if s := m.getTopMessageFieldSpec(tag); s != nil {
+				if err := m.decodeFieldScalar32(s, v); err != nil {
+					return fieldDecodeError(err, start, tag, typ)
 				}
 			}
 
 		case protowire.Fixed64Type:
 			v, n := protowire.ConsumeFixed64(buf[off:])
 			if n < 0 {
-				return protowire.ParseError(n)
+				return fieldDecodeError(protowire.ParseError(n), start, tag, typ)
 			}
 			off += n
 
-			if s, found := m.getTopMessageFieldSpec(tag); found {
-				if err := m.decodeFieldScalar64(&s, v); err != nil {
-					return err
+			if s := m.getTopMessageFieldSpec(tag); s != nil {
+				if err := m.decodeFieldScalar64(s, v); err != nil {
+					return fieldDecodeError(err, start, tag, typ)
 				}
 			}
 
 		case protowire.BytesType:
 			b, taglen, err := consumeProtoBytes(buf[off:])
 			if err != nil {
-				return err
+				return fieldDecodeError(err, start, tag, typ)
 			}
 			off += taglen
 
-			if s, found := m.getTopMessageFieldSpec(tag); found {
-				if err := m.decodeFieldBytes(&s, off, b); err != nil {
-					return err
+			if s := m.getTopMessageFieldSpec(tag); s != nil {
+				if err := m.decodeFieldBytes(s, off, b); err != nil {
+					return fieldDecodeError(err, start, tag, typ)
 				}
 			}
 			off += len(b)
 
 		case protowire.StartGroupType, protowire.EndGroupType:
-			return errProtobufDeprecated
+			return fieldDecodeError(ErrProtobufDeprecated, start, tag, typ)
 
 		default:
-			return errProtobufInvalid
+			return fieldDecodeError(ErrProtobufInvalid, start, tag, typ)
 		}
 
 		if debugging {
@@ -135,9 +128,10 @@ func (m *Machine) decodeMessage(spec map[int32]fieldSpec, base int, buf []byte)
 	defer m.fieldrep.put(rep)
 
 	for off := 0; off < len(buf); {
+		start := off // Offset of the current field.
 		tag, typ, n := protowire.ConsumeTag(buf[off:])
 		if n < 0 {
-			return protowire.ParseError(n)
+			return fieldDecodeError(protowire.ParseError(n), base+start, tag, typ)
 		}
 		off += n
 
@@ -145,61 +139,61 @@ func (m *Machine) decodeMessage(spec map[int32]fieldSpec, base int, buf []byte)
 		case protowire.VarintType:
 			v, n := protowire.ConsumeVarint(buf[off:])
 			if n < 0 {
-				return protowire.ParseError(n)
+				return fieldDecodeError(protowire.ParseError(n), base+start, tag, typ)
 			}
 			off += n
 
-			if s, found := getMessageFieldSpec(spec, rep, int32(tag)); found {
+			if s, found := m.getMessageFieldSpec(spec, rep, int32(tag)); found {
 				if err := m.decodeFieldScalar(&s, v); err != nil {
-					return err
+					return fieldDecodeError(err, base+start, tag, typ)
 				}
 			}
 
 		case protowire.Fixed32Type:
 			v, n := protowire.ConsumeFixed32(buf[off:])
 			if n < 0 {
-				return protowire.ParseError(n)
+				return fieldDecodeError(protowire.ParseError(n), base+start, tag, typ)
 			}
 			off += n
 
-			if s, found := getMessageFieldSpec(spec, rep, int32(tag)); found {
+			if s, found := m.getMessageFieldSpec(spec, rep, int32(tag)); found {
 				if err := m.decodeFieldScalar32(&s, v); err != nil {
-					return err
+					return fieldDecodeError(err, base+start, tag, typ)
 				}
 			}
 
 		case protowire.Fixed64Type:
 			v, n := protowire.ConsumeFixed64(buf[off:])
 			if n < 0 {
-				return protowire.ParseError(n)
+				return fieldDecodeError(protowire.ParseError(n), base+start, tag, typ)
 			}
 			off += n
 
-			if s, found := getMessageFieldSpec(spec, rep, int32(tag)); found {
+			if s, found := m.getMessageFieldSpec(spec, rep, int32(tag)); found {
 				if err := m.decodeFieldScalar64(&s, v); err != nil {
-					return err
+					return fieldDecodeError(err, base+start, tag, typ)
 				}
 			}
 
 		case protowire.BytesType:
 			b, taglen, err := consumeProtoBytes(buf[off:])
 			if err != nil {
-				return err
+				return fieldDecodeError(err, base+start, tag, typ)
 			}
 			off += taglen
 
-			if s, found := getMessageFieldSpec(spec, rep, int32(tag)); found {
+			if s, found := m.getMessageFieldSpec(spec, rep, int32(tag)); found {
 				if err := m.decodeFieldBytes(&s, base+off, b); err != nil {
-					return err
+					return fieldDecodeError(err, base+start, tag, typ)
 				}
 			}
 			off += len(b)
 
 		case protowire.StartGroupType, protowire.EndGroupType:
-			return errProtobufDeprecated
+			return fieldDecodeError(ErrProtobufDeprecated, base+start, tag, typ)
 
 		default:
-			return errProtobufInvalid
+			return fieldDecodeError(ErrProtobufInvalid, base+start, tag, typ)
 		}
 
 		if debugging && base == 0 {
@@ -232,7 +226,7 @@ func (m *Machine) decodePacked(typ uint8, spec map[int32]fieldSpec, base int, bu
 			}
 			off += n
 
-			if s, found := getFieldSpec(spec, i); found {
+			if s, found := m.getFieldSpec(spec, i); found {
 				if err := m.decodeFieldScalar(&s, v); err != nil {
 					return err
 				}
@@ -247,7 +241,7 @@ func (m *Machine) decodePacked(typ uint8, spec map[int32]fieldSpec, base int, bu
 			}
 			off += n
 
-			if s, found := getFieldSpec(spec, i); found {
+			if s, found := m.getFieldSpec(spec, i); found {
 				if err := m.decodeFieldScalar32(&s, v); err != nil {
 					return err
 				}
@@ -262,7 +256,7 @@ func (m *Machine) decodePacked(typ uint8, spec map[int32]fieldSpec, base int, bu
 			}
 			off += n
 
-			if s, found := getFieldSpec(spec, i); found {
+			if s, found := m.getFieldSpec(spec, i); found {
 				if err := m.decodeFieldScalar64(&s, v); err != nil {
 					return err
 				}
@@ -277,7 +271,7 @@ func (m *Machine) decodePacked(typ uint8, spec map[int32]fieldSpec, base int, bu
 			}
 			off += taglen
 
-			if s, found := getFieldSpec(spec, i); found {
+			if s, found := m.getFieldSpec(spec, i); found {
 				if err := m.decodeFieldBytes(&s, base+off, b); err != nil {
 					return err
 				}
@@ -301,6 +295,13 @@ func (m *Machine) decodeFieldBytes(s *fieldSpec, off int, buf []byte) error {
 		return nil
 	}
 
+	if s.mod == field.ModEach {
+		// The element is decoded by LoopNext.
+		l := &m.loops[s.loop]
+		l.elems = append(l.elems, packBytesRef(off, len(buf)))
+		return nil
+	}
+
 	if s.mod == field.ModPacked {
 		return m.decodePacked(s.subtype, s.sub, off, buf)
 	}
@@ -312,31 +313,53 @@ func (m *Machine) decodeFieldScalar(s *fieldSpec, value uint64) error {
 		value = uint64(protowire.DecodeZigZag(value))
 	}
 
-	return m.setFieldScalar(s, value)
+	return m.setFieldScalar(s, value, protowire.VarintType)
 }
 
 func (m *Machine) decodeFieldScalar32(s *fieldSpec, v uint32) error {
-	var value uint64
 	if s.mod == field.ModFloat {
-		value = math.Float64bits(float64(math.Float32frombits(v)))
-	} else {
-		value = uint64(v)
+		return m.setFieldScalar(s, math.Float64bits(float64(math.Float32frombits(v))), protowire.Fixed32Type)
 	}
 
-	return m.setFieldScalar(s, value)
+	return m.setFieldScalar(s, uint64(v), protowire.Fixed32Type)
 }
 
 func (m *Machine) decodeFieldScalar64(s *fieldSpec, value uint64) error {
-	return m.setFieldScalar(s, value)
+	return m.setFieldScalar(s, value, protowire.Fixed64Type)
 }
 
-func (m *Machine) setField(s *fieldSpec, data uint64) {
+// setField records the wire type for the typed accessors.
+func (m *Machine) setField(s *fieldSpec, data uint64, typ protowire.Type) {
 	if debugging {
 		debugf("(%#x)=#%d", data, s.index)
 	}
 
 	m.fielddata[s.index] = data
+	m.fieldtype[s.index] = typ
 	m.fieldmask[s.maskslot()] |= 1 << s.maskbit()
+
+	if m.trace != nil {
+		m.traceField(s, data)
+	}
+}
+
+// countField occurrence.  The result indicates whether the field is also
+// decoded.
+func (m *Machine) countField(s *fieldSpec) bool {
+	n := m.fielddata[s.count] + 1
+
+	if debugging {
+		debugf("(%d)=#%d", n, s.count)
+	}
+
+	m.fielddata[s.count] = n
+	m.fieldmask[s.count>>6] |= 1 << uint(s.count&63)
+
+	if m.trace != nil {
+		m.trace.tracer.TraceField(int(s.count), Value{m.fieldKind(int(s.count)), n, m.protobuf})
+	}
+
+	return s.mod != field.ModCount
 }
 
 func (m *Machine) setFieldBytes(s *fieldSpec, off int, buf []byte) {
@@ -344,57 +367,75 @@ func (m *Machine) setFieldBytes(s *fieldSpec, off int, buf []byte) {
 		debugf("=Bytes%q", buf)
 	}
 
-	m.setField(s, packBytesRef(off, len(buf)))
+	m.setField(s, packBytesRef(off, len(buf)), protowire.BytesType)
 }
 
-func (m *Machine) setFieldScalar(s *fieldSpec, value uint64) error {
+// setFieldScalar fails if the field is an intermediary node, or if the program
+// loads it as bytes or as a vector: the value would be mistaken for a reference.
+func (m *Machine) setFieldScalar(s *fieldSpec, value uint64, typ protowire.Type) error {
 	if !s.indexed {
-		return errProtobufFieldType
+		return ErrProtobufFieldType
+	}
+	if mode := m.fieldmode[s.index]; mode == accessBytes || mode == accessVector {
+		return ErrProtobufFieldType
 	}
 
 	if debugging {
 		debugf("=Scalar")
 	}
 
-	m.setField(s, value)
+	m.setField(s, value, typ)
 	return nil
 }
 
-func (m *Machine) getTopMessageFieldSpec(tag protowire.Number) (s fieldSpec, found bool) {
+// getTopMessageFieldSpec returns nil if the field is not decoded.  The spec of
+// a repeated element is valid until the next call.
+func (m *Machine) getTopMessageFieldSpec(tag protowire.Number) *fieldSpec {
 	if debugging {
 		debugf(" .%d", tag)
 	}
 
 	if tag > protowire.Number(m.maxarrindex) {
-		return
+		return nil
 	}
 
-	s = m.fieldspecarr[tag]
-	found = s.mod.IsValid()
-	if !found {
-		return
+	s := &m.fieldspecarr[tag]
+	if !s.mod.IsValid() {
+		return nil
+	}
+
+	if s.counted && !m.countField(s) {
+		return nil
 	}
 
 	if s.mod == field.ModRepeated {
 		index := m.topfieldrep[tag]
 		m.topfieldrep[tag] = index + 1
 
-		s, found = s.sub[index]
+		e, found := s.sub[index]
+		if !found {
+			return nil
+		}
+		m.topelemspec = e
+		return &m.topelemspec
 	}
-	return
+	return s
 }
 
-func getFieldSpec(spec map[int32]fieldSpec, num int32) (s fieldSpec, found bool) {
+func (m *Machine) getFieldSpec(spec map[int32]fieldSpec, num int32) (s fieldSpec, found bool) {
 	if debugging {
 		debugf(" .%d", num)
 	}
 
 	s, found = spec[num]
+	if found && s.counted {
+		found = m.countField(&s)
+	}
 	return
 }
 
-func getMessageFieldSpec(spec map[int32]fieldSpec, rep map[int32]int32, num int32) (s fieldSpec, found bool) {
-	s, found = getFieldSpec(spec, num)
+func (m *Machine) getMessageFieldSpec(spec map[int32]fieldSpec, rep map[int32]int32, num int32) (s fieldSpec, found bool) {
+	s, found = m.getFieldSpec(spec, num)
 	if !found {
 		return
 	}
@@ -0,0 +1,145 @@
+package pbf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ninchat/pbf/op"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Errors returned by NewProgram are *BytecodeError values wrapping one of
+// these.
+var (
+	ErrBytecodeFormat  = errors.New("pbf: unknown bytecode format")
+	ErrBytecodeInvalid = errors.New("pbf: bytecode is invalid")
+	ErrBytecodeTooLong = errors.New("pbf: bytecode is too long")
+)
+
+// Message decoding errors are *DecodeError values wrapping one of these.
+var (
+	ErrProtobufDeprecated = errors.New("pbf: protobuf message uses deprecated encoding")
+	ErrProtobufFieldType  = errors.New("pbf: protobuf message has unexpected field type")
+	ErrProtobufInvalid    = errors.New("pbf: protobuf message encoding is invalid")
+	ErrProtobufTooLong    = errors.New("pbf: protobuf message is too long")
+)
+
+// Errors returned by the typed field value accessors of Machine are
+// *FieldError values wrapping one of these.
+var (
+	ErrFieldIndex = errors.New("pbf: field index out of bounds")
+	ErrFieldMode  = errors.New("pbf: field value cannot be retrieved as the requested type")
+)
+
+// BytecodeError describes why a program was rejected.
+type BytecodeError struct {
+	Offset      int     // Position in the bytecode.
+	Instruction bool    // Offset refers to an instruction.
+	Opcode      op.Code // Meaningful only if Instruction is true.
+	Reason      string
+	Err         error // ErrBytecodeFormat, ErrBytecodeInvalid or ErrBytecodeTooLong.
+}
+
+func (e *BytecodeError) Error() string {
+	if e.Instruction && e.Opcode.IsValid() {
+		return fmt.Sprintf("%v: %s (%s instruction at offset %d)", e.Err, e.Reason, e.Opcode, e.Offset)
+	}
+	return fmt.Sprintf("%v: %s (offset %d)", e.Err, e.Reason, e.Offset)
+}
+
+func (e *BytecodeError) Unwrap() error { return e.Err }
+
+// DecodeError describes why a protobuf message couldn't be decoded.
+type DecodeError struct {
+	Offset    int                // Position of the field's tag, or of the problem, in the message.
+	FieldPath []protowire.Number // Field numbers from the top-level message to the field, if known.
+	WireType  protowire.Type     // Meaningful only if FieldPath is not empty.
+	Reason    string
+	Err       error // ErrProtobufDeprecated, ErrProtobufFieldType, ErrProtobufInvalid or ErrProtobufTooLong.
+}
+
+func (e *DecodeError) Error() string {
+	if len(e.FieldPath) == 0 {
+		return fmt.Sprintf("%v: %s (offset %d)", e.Err, e.Reason, e.Offset)
+	}
+
+	path := make([]string, len(e.FieldPath))
+	for i, num := range e.FieldPath {
+		path[i] = fmt.Sprint(num)
+	}
+	return fmt.Sprintf("%v: %s (field %s with wire type %d at offset %d)", e.Err, e.Reason, strings.Join(path, "."), e.WireType, e.Offset)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// FieldError describes why a field value couldn't be retrieved.
+type FieldError struct {
+	Index  int    // Field index.
+	Type   string // Requested type, such as "int64".
+	Reason string
+	Err    error // ErrFieldIndex or ErrFieldMode.
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%v: %s (field #%d as %s)", e.Err, e.Reason, e.Index, e.Type)
+}
+
+func (e *FieldError) Unwrap() error { return e.Err }
+
+// newDecodeError from a sentinel or a protowire parse error.
+func newDecodeError(err error, off int, typ protowire.Type) *DecodeError {
+	e := &DecodeError{
+		Offset:   off,
+		WireType: typ,
+		Err:      err,
+	}
+
+	switch err {
+	case ErrProtobufDeprecated:
+		e.Reason = "group encoding"
+	case ErrProtobufFieldType:
+		e.Reason = "wire type doesn't match the field spec"
+	case ErrProtobufInvalid:
+		e.Reason = "unknown wire type"
+	case ErrProtobufTooLong:
+		e.Reason = "message size exceeds 2 GiB"
+	default:
+		e.Err = ErrProtobufInvalid
+		e.Reason = err.Error()
+	}
+
+	return e
+}
+
+// fieldDecodeError locates an error which occurred while decoding a field
+// whose tag starts at the given message offset.  The tag is zero if it couldn't
+// be parsed.  The field number is prepended to the path of a nested field's
+// error.
+func fieldDecodeError(err error, off int, tag protowire.Number, typ protowire.Type) error {
+	e, ok := err.(*DecodeError)
+	if !ok {
+		e = newDecodeError(err, off, typ)
+	}
+	if tag != 0 {
+		if len(e.FieldPath) == 0 {
+			// The nested message itself is malformed.
+			e.WireType = typ
+		}
+		e.FieldPath = append([]protowire.Number{tag}, e.FieldPath...)
+	}
+	return e
+}
+
+// loopDecodeError locates an error which occurred while decoding an element of
+// the repeated field at the given path.
+func loopDecodeError(err error, path []protowire.Number) error {
+	if e, ok := err.(*DecodeError); ok {
+		if len(e.FieldPath) == 0 {
+			// The element itself is malformed.
+			e.WireType = protowire.BytesType
+		}
+		e.FieldPath = append(path[:len(path):len(path)], e.FieldPath...)
+	}
+	return err
+}
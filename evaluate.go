@@ -19,6 +19,9 @@ func (m *Machine) evaluate() bool {
 		if debugging {
 			debugf("eval: %5d ", len(m.insn())-len(insn))
 		}
+		if m.trace != nil {
+			m.traceStep(len(m.bytecode) - len(insn))
+		}
 
 		opcode := op.Code(insn[0])
 		insn = insn[1:]
@@ -41,7 +44,11 @@ func (m *Machine) evaluate() bool {
 				}
 
 			case opcode < op.CompareFloatLT:
-				m.opCompareBytes(cmp)
+				if cmp.IsValid() {
+					m.opCompareBytes(cmp)
+				} else {
+					m.opHasAffixBytes(opcode.Option())
+				}
 
 			case opcode <= op.CompareFloatInfNeg:
 				if cmp.IsValid() {
@@ -50,12 +57,17 @@ func (m *Machine) evaluate() bool {
 					m.opCompareFloatInf(opcode.Option())
 				}
 
+			case opcode == op.CompareFloatNaN:
+				m.opCompareFloatNaN()
+
+			case opcode == op.ContainsBytes:
+				m.opContainsBytes()
+
+			case opcode <= op.ContainsFixed32:
+				m.opContains(opcode)
+
 			default:
-				if opcode == op.CompareFloatNaN {
-					m.opCompareFloatNaN()
-				} else {
-					m.opContains(opcode)
-				}
+				m.opCount(opcode)
 			}
 
 		case opcode < 128: // 8-bit argument.
@@ -64,23 +76,35 @@ func (m *Machine) evaluate() bool {
 
 			switch {
 			case opcode == op.CheckField:
-				m.opCheckField(arg)
+				m.opCheckField(int(arg))
+
+			case opcode >= op.AnyVarint:
+				m.opQuantifier(opcode, op.Code(arg))
 
 			default:
-				m.opLoadField(arg, opcode.Reg())
+				m.opLoadField(int(arg), opcode.Reg())
 			}
 
 		case opcode < 192: // 16-bit argument.
 			arg := binary.LittleEndian.Uint16(insn)
 			insn = insn[2:]
 
-			var offset uint16
-			if opcode == op.Skip {
-				offset = m.opSkip(arg)
-			} else {
-				offset = m.opSkipIf(arg, opcode.Option())
+			switch {
+			case opcode == op.CheckFieldWide:
+				m.opCheckField(int(arg))
+
+			case opcode >= op.LoadR0FieldScalarWide:
+				m.opLoadField(int(arg), opcode.Reg())
+
+			default:
+				var offset uint16
+				if opcode == op.Skip {
+					offset = m.opSkip(arg)
+				} else {
+					offset = m.opSkipIf(arg, opcode.Option())
+				}
+				insn = insn[offset:]
 			}
-			insn = insn[offset:]
 
 		default: // 64-bit argument.
 			arg := binary.LittleEndian.Uint64(insn)
@@ -90,17 +114,30 @@ func (m *Machine) evaluate() bool {
 			case opcode == op.LoadConstScalar:
 				m.opLoadConstScalar(arg)
 
-			default:
+			case opcode == op.LoadConstBytes:
 				m.opLoadConstBytes(arg)
+
+			case opcode == op.LoopNext:
+				insn = insn[m.opLoopNext(arg):]
+
+			case opcode == op.LoopBack:
+				insn = m.bytecode[len(m.bytecode)-len(insn)-int(m.opLoopBack(arg)):]
+
+			default:
+				var offset uint64
+				if opcode == op.SkipLong {
+					offset = m.opSkipLong(arg)
+				} else {
+					offset = m.opSkipIfLong(arg, opcode.Option())
+				}
+				insn = insn[offset:]
 			}
 		}
 	}
 }
 
-func (m *Machine) opCheckField(index uint8) {
-	slot := index >> 6
-	bit := index & 63
-	m.status = m.fieldmask[slot]&(1<<bit) != 0
+func (m *Machine) opCheckField(index int) {
+	m.status = m.fieldFound(index)
 
 	if debugging {
 		debugf("Status := CheckField[#%d] = %t\n", index, m.status)
@@ -132,6 +169,35 @@ func (m *Machine) opCompareBytes(cmp op.Cmp) {
 	}
 }
 
+func (m *Machine) opHasAffixBytes(suffix bool) {
+	r1 := m.getBytes(m.reg[1])
+	r0 := m.getBytes(m.reg[0])
+
+	if suffix {
+		m.status = bytes.HasSuffix(r1, r0)
+
+		if debugging {
+			debugf("Status := HasSuffixBytes %q %q = %t\n", r1, r0, m.status)
+		}
+	} else {
+		m.status = bytes.HasPrefix(r1, r0)
+
+		if debugging {
+			debugf("Status := HasPrefixBytes %q %q = %t\n", r1, r0, m.status)
+		}
+	}
+}
+
+func (m *Machine) opContainsBytes() {
+	r1 := m.getBytes(m.reg[1])
+	r0 := m.getBytes(m.reg[0])
+	m.status = bytes.Contains(r1, r0)
+
+	if debugging {
+		debugf("Status := ContainsBytes %q %q = %t\n", r1, r0, m.status)
+	}
+}
+
 func (m *Machine) opCompareFloat(cmp op.Cmp) {
 	r1 := math.Float64frombits(m.reg[1])
 	r0 := math.Float64frombits(m.reg[0])
@@ -264,6 +330,38 @@ func (m *Machine) opContains(opcode op.Code) {
 	}
 }
 
+func (m *Machine) opQuantifier(opcode, cmp op.Code) {
+	r1 := m.getBytes(m.reg[1])
+	r0 := m.reg[0]
+	m.status = quantify(r1, opcode.Encoding(), cmp, r0, opcode.Option())
+
+	if debugging {
+		debugf("Status := %s %v %s %#x = %t\n", opcode, r1, cmp, r0, m.status)
+	}
+}
+
+func (m *Machine) opCount(opcode op.Code) {
+	r := opcode.Reg()
+	b := m.getBytes(m.reg[r])
+
+	var n int
+	switch opcode &^ 1 {
+	case op.LengthR0Bytes:
+		n = len(b)
+	case op.CountR0Varint:
+		n = countVarint(b)
+	case op.CountR0Fixed64:
+		n = len(b) / 8
+	default:
+		n = len(b) / 4
+	}
+	m.reg[r] = uint64(n)
+
+	if debugging {
+		debugf("%s     := %s %v = %d\n", r, opcode, b, n)
+	}
+}
+
 func (m *Machine) opLoadConstBytes(arg uint64) {
 	m.reg[0] = arg | constBytesFieldFlag
 
@@ -292,7 +390,7 @@ func (m *Machine) opLoadConstScalarBool(value bool) {
 	}
 }
 
-func (m *Machine) opLoadField(index uint8, r op.Reg) {
+func (m *Machine) opLoadField(index int, r op.Reg) {
 	m.reg[r] = m.fielddata[index]
 
 	if debugging {
@@ -301,6 +399,10 @@ func (m *Machine) opLoadField(index uint8, r op.Reg) {
 }
 
 func (m *Machine) opReturn(status bool) bool {
+	if m.trace != nil {
+		m.traceStep(-1)
+	}
+
 	if debugging {
 		debugf("          Return[%t]\n", status)
 	}
@@ -329,6 +431,93 @@ func (m *Machine) opSkipIf(offset uint16, status bool) uint16 {
 	return result
 }
 
+func (m *Machine) opSkipLong(offset uint64) uint64 {
+	if debugging {
+		debugf("          SkipLong %d = %d\n", offset, offset)
+	}
+
+	return offset
+}
+
+func (m *Machine) opSkipIfLong(offset uint64, status bool) uint64 {
+	var result uint64
+	if m.status == status {
+		result = offset
+	}
+
+	if debugging {
+		debugf("          SkipLong[%t] %d = %d\n", status, offset, result)
+	}
+
+	return result
+}
+
+// opLoopNext decodes the next element of a repeated message field, or returns
+// the exit offset when there are no more elements.  The iteration starts from
+// the first element unless LoopBack was executed.
+func (m *Machine) opLoopNext(arg uint64) uint64 {
+	index, exit := op.SplitLoopNextArg(arg)
+	id := m.fieldloop[index]
+	spec := &m.program.loops[id]
+	l := &m.loops[id]
+
+	if !m.loopback {
+		l.next = 0
+	}
+	m.loopback = false
+
+	// Forget the previous element.
+	for _, i := range spec.fields {
+		m.fielddata[i] = 0
+		m.fieldmask[i>>6] &^= 1 << uint(i&63)
+	}
+	for _, i := range spec.loops {
+		m.loops[i] = loopState{elems: m.loops[i].elems[:0]}
+	}
+
+	if l.next >= len(l.elems) {
+		m.fielddata[index] = 0
+		m.fieldmask[index>>6] &^= 1 << uint(index&63)
+
+		if debugging {
+			debugf("          LoopNext[#%d] %d/%d = %d\n", index, l.next, len(l.elems), exit)
+		}
+
+		return uint64(exit)
+	}
+
+	ref := l.elems[l.next]
+	l.next++
+
+	m.fielddata[index] = ref
+	m.fieldmask[index>>6] |= 1 << uint(index&63)
+
+	if debugging {
+		debugf("          LoopNext[#%d] %d/%d = 0 ", index, l.next, len(l.elems))
+	}
+
+	off, n := unpackBytesRef(ref)
+	if err := m.decodeMessage(spec.sub, int(off), m.protobuf[off:][:n]); err != nil && m.looperr == nil {
+		m.looperr = loopDecodeError(err, spec.path)
+	}
+
+	if debugging {
+		debugf("\n")
+	}
+
+	return 0
+}
+
+func (m *Machine) opLoopBack(offset uint64) uint64 {
+	m.loopback = true
+
+	if debugging {
+		debugf("          LoopBack %d\n", offset)
+	}
+
+	return offset
+}
+
 func (m *Machine) getBytes(ref uint64) []byte {
 	proto := ref&constBytesFieldFlag == 0
 	ref &^= constBytesFieldFlag
@@ -340,6 +529,122 @@ func (m *Machine) getBytes(ref uint64) []byte {
 	return m.bytecode[off:][:n]
 }
 
+// quantify comparison of packed vector elements with a scalar.  The result is
+// false if the vector is malformed, unless a matching element precedes the
+// problem when any element is sufficient.
+func quantify(b []byte, enc op.ScalarEncoding, cmp op.Code, r0 uint64, all bool) bool {
+	for len(b) > 0 {
+		var x uint64
+
+		switch enc {
+		case op.Varint, op.ZigZag:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return false
+			}
+			if enc == op.ZigZag {
+				v = uint64(protowire.DecodeZigZag(v))
+			}
+			x = v
+			b = b[n:]
+
+		case op.Fixed64:
+			if len(b) < 8 {
+				return false
+			}
+			x = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+
+		default: // Fixed32
+			if len(b) < 4 {
+				return false
+			}
+			v := binary.LittleEndian.Uint32(b)
+			switch cmp.Kind() {
+			case op.Signed:
+				x = uint64(int64(int32(v)))
+			case op.Float:
+				x = math.Float64bits(float64(math.Float32frombits(v)))
+			default:
+				x = uint64(v)
+			}
+			b = b[4:]
+		}
+
+		if compareScalar(cmp, x, r0) != all {
+			return !all
+		}
+	}
+
+	return all
+}
+
+// compareScalar according to an unsigned, signed or floating-point comparison
+// opcode.
+func compareScalar(cmp op.Code, x, y uint64) bool {
+	var diff int
+
+	switch cmp.Kind() {
+	case op.Signed:
+		switch a, b := int64(x), int64(y); {
+		case a < b:
+			diff = -1
+		case a > b:
+			diff = 1
+		}
+
+	case op.Float:
+		a, b := math.Float64frombits(x), math.Float64frombits(y)
+		if a != a || b != b {
+			// Only inequality holds for NaN.
+			return cmp.Cmp() == op.CmpNE
+		}
+		switch {
+		case a < b:
+			diff = -1
+		case a > b:
+			diff = 1
+		}
+
+	default:
+		switch {
+		case x < y:
+			diff = -1
+		case x > y:
+			diff = 1
+		}
+	}
+
+	switch cmp.Cmp() {
+	case op.CmpLT:
+		return diff < 0
+	case op.CmpGE:
+		return diff >= 0
+	case op.CmpEQ:
+		return diff == 0
+	case op.CmpNE:
+		return diff != 0
+	case op.CmpLE:
+		return diff <= 0
+	default: // GT
+		return diff > 0
+	}
+}
+
+// countVarint elements, up to the first malformed one.
+func countVarint(b []byte) int {
+	n := 0
+	for len(b) > 0 {
+		_, size := protowire.ConsumeVarint(b)
+		if size < 0 {
+			break
+		}
+		b = b[size:]
+		n++
+	}
+	return n
+}
+
 func containsFixed32(b []byte, needle uint32) bool {
 	for len(b) >= 4 {
 		if binary.LittleEndian.Uint32(b) == needle {
@@ -0,0 +1,170 @@
+package pbf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ninchat/pbf/op"
+)
+
+// Explanation of a filtering decision: the executed instructions in order.
+type Explanation struct {
+	Result bool
+	Steps  []Step
+}
+
+// Step of program execution.
+type Step struct {
+	Offset int     // Instruction's bytecode offset.
+	Code   op.Code // Opcode.
+	Arg    uint64  // Field index, skip offset, comparison opcode or constant.
+	Field  int     // Field index, or -1 if the instruction doesn't access a field.
+	Found  bool    // Field was found in the message, or LoopNext visited an element.
+	R0, R1 Value   // Register contents after the instruction.
+	Status bool    // Status flag after the instruction.
+}
+
+// Explain is like Filter, but also records the instruction path.  A tracer set
+// for the machine also receives the events.
+func (m *Machine) Explain(message []byte) (*Explanation, error) {
+	e := new(Explanation)
+
+	prev := m.trace
+	x := explainer{Explanation: e}
+	if prev != nil {
+		x.next = prev.tracer
+	}
+
+	m.trace = &traceState{tracer: x}
+	ok, err := m.Filter(message)
+	m.trace = prev
+
+	e.Result = ok
+	return e, err
+}
+
+type explainer struct {
+	*Explanation
+	next Tracer
+}
+
+func (x explainer) TraceFieldSpec(index int, spec string) {
+	if x.next != nil {
+		x.next.TraceFieldSpec(index, spec)
+	}
+}
+
+func (x explainer) TraceVerifyBlock(offsets []int) {
+	if x.next != nil {
+		x.next.TraceVerifyBlock(offsets)
+	}
+}
+
+func (x explainer) TraceField(index int, value Value) {
+	if x.next != nil {
+		x.next.TraceField(index, value)
+	}
+}
+
+func (x explainer) TraceStep(step *Step) {
+	x.Steps = append(x.Steps, *step)
+	if x.next != nil {
+		x.next.TraceStep(step)
+	}
+}
+
+// Cause returns the last step before the return which set the status flag, or
+// nil.
+func (e *Explanation) Cause() *Step {
+	for i := len(e.Steps) - 1; i >= 0; i-- {
+		if e.Steps[i].Code.SetsStatus() {
+			return &e.Steps[i]
+		}
+	}
+	return nil
+}
+
+func (e *Explanation) String() string {
+	return e.Listing(nil)
+}
+
+// Listing of the steps, one per line.  Notes are appended to the lines of the
+// instructions at their offsets (see build.Builder.Notes).
+func (e *Explanation) Listing(notes map[int]string) string {
+	var b strings.Builder
+	cause := e.Cause()
+
+	for i := range e.Steps {
+		s := &e.Steps[i]
+
+		var line strings.Builder
+
+		marker := " "
+		if s == cause {
+			marker = "*"
+		}
+
+		fmt.Fprintf(&line, "%s%5d  %-30s  %s", marker, s.Offset, s.instruction(), s.result())
+
+		if note := notes[s.Offset]; note != "" {
+			fmt.Fprintf(&line, "  ; %s", note)
+		}
+
+		b.WriteString(strings.TrimRight(line.String(), " "))
+		b.WriteString("\n")
+	}
+
+	fmt.Fprintf(&b, "Result = %t\n", e.Result)
+	return b.String()
+}
+
+func (s *Step) String() string {
+	return strings.TrimRight(s.instruction()+"  "+s.result(), " ")
+}
+
+func (s *Step) instruction() string {
+	switch code := s.Code; {
+	case code < 64:
+		return code.String()
+	case code.IsQuantifier():
+		return fmt.Sprintf("%s %s", code, op.Code(s.Arg))
+	case code.HasFieldIndex():
+		if s.Found {
+			return fmt.Sprintf("%s #%d", code, s.Arg)
+		}
+		return fmt.Sprintf("%s #%d (absent)", code, s.Arg)
+	case code.IsSkip():
+		return fmt.Sprintf("%s -> %d", code, s.Offset+code.Size()+int(s.Arg))
+	case code == op.LoopNext:
+		if s.Found {
+			return fmt.Sprintf("%s #%d", code, s.Field)
+		}
+		_, exit := op.SplitLoopNextArg(s.Arg)
+		return fmt.Sprintf("%s #%d (done) -> %d", code, s.Field, s.Offset+code.Size()+int(exit))
+	case code == op.LoopBack:
+		return fmt.Sprintf("%s -> %d", code, s.Offset+code.Size()-int(s.Arg))
+	case code == op.LoadConstBytes:
+		return code.String()
+	default:
+		return fmt.Sprintf("%s %#x", code, s.Arg)
+	}
+}
+
+// result of the instruction: the status flag or the loaded register.
+func (s *Step) result() string {
+	switch code := s.Code; {
+	case code.SetsStatus():
+		return fmt.Sprintf("Status = %t", s.Status)
+	case code == op.ReturnFalse || code == op.ReturnTrue:
+		return ""
+	case code == op.LoadConstScalar || code == op.LoadConstScalar0 || code == op.LoadConstScalar1 || code == op.LoadConstBytes:
+		return fmt.Sprintf("R0 = %s", s.R0)
+	case code.HasFieldIndex() || code.IsCount():
+		if code.Reg() == op.R0 {
+			return fmt.Sprintf("R0 = %s", s.R0)
+		}
+		return fmt.Sprintf("R1 = %s", s.R1)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,79 @@
+package pbf_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/expr"
+	"github.com/ninchat/pbf/internal/test"
+	"github.com/ninchat/pbf/op"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestExplain(t *testing.T) {
+	x, err := expr.Parse(`a == 1 && (l == "Hello, world!" || b == 2) && !has(s) && n.x < 1000`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytecode, notes, err := expr.CompileNotes(x, (&test.Test{}).ProtoReflect().Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := pbf.NewMachine(prog).Explain(test.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Result {
+		t.Error("result")
+	}
+
+	if last := e.Steps[len(e.Steps)-1]; last.Code != op.ReturnFalse {
+		t.Error(last.Code)
+	}
+
+	cause := e.Cause()
+	if cause == nil || cause.Code != op.CompareSignedLT || cause.Status {
+		t.Fatal(cause)
+	}
+	if cause.R1.Int64() != 1234 || cause.R0.Int64() != 1000 {
+		t.Error(cause.R1, cause.R0)
+	}
+
+	for _, s := range e.Steps {
+		if s.Code == op.LoadR1FieldBytes && s.R1.String() != `"Hello, world!"` {
+			t.Error(s.R1)
+		}
+		if s.Code == op.LoadConstBytes && s.R0.String() != `"Hello, world!"` {
+			t.Error(s.R0)
+		}
+		if s.Code == op.CheckField && (s.Found || s.Status) {
+			t.Error(s)
+		}
+	}
+
+	listing := e.Listing(notes)
+	if !strings.Contains(listing, "R1 = 1234  ; 1:62: n.x < 1000\n") {
+		t.Error(listing)
+	}
+	if !strings.Contains(listing, "SkipFalse -> 93\n") || !strings.HasSuffix(listing, "ReturnFalse\nResult = false\n") {
+		t.Error(listing)
+	}
+
+	msg, err := proto.Marshal(&test.Test{A: 1, L: "Hello, world!", N: &test.Sub{X: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = pbf.NewMachine(prog).Explain(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Result || e.Steps[len(e.Steps)-1].Code != op.ReturnTrue {
+		t.Error(e)
+	}
+}
@@ -0,0 +1,184 @@
+// Package expr implements a boolean expression language for filters, compiled
+// into PBF bytecode against a protobuf message type:
+//
+//	a == 1 && b != 1 && n.x > 1000 && "PBF" == k && 3.14 in u
+//
+// The syntax tree can also be constructed by other front-ends.
+package expr
+
+import (
+	"fmt"
+	"go/constant"
+	"strconv"
+	"strings"
+
+	"github.com/ninchat/pbf/op"
+)
+
+// Pos is a position in source code.
+type Pos struct {
+	Offset int // Byte offset, starting at 0.
+	Line   int // Starting at 1.
+	Column int // Byte offset within line, starting at 1.
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Error with source code position.
+type Error struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+func errorf(pos Pos, format string, args ...interface{}) *Error {
+	return &Error{pos, fmt.Sprintf(format, args...)}
+}
+
+// Expr is a node of a boolean expression's syntax tree.
+type Expr interface {
+	Pos() Pos
+}
+
+// And is a logical conjunction.
+type And struct {
+	OpPos Pos
+	X, Y  Expr
+}
+
+// Or is a logical disjunction.
+type Or struct {
+	OpPos Pos
+	X, Y  Expr
+}
+
+// Not is a logical negation.
+type Not struct {
+	OpPos Pos
+	X     Expr
+}
+
+// Compare two operands.  An operand is a Path or a Literal.
+type Compare struct {
+	OpPos Pos
+	Op    op.Cmp
+	X, Y  Expr
+}
+
+// In tests whether the X operand is an element of a packed repeated field.
+type In struct {
+	OpPos Pos
+	X     Expr
+	Y     *Path
+}
+
+// Has tests field presence.
+type Has struct {
+	FunPos Pos
+	Path   *Path
+}
+
+// Path to a field, e.g. "q[1].x".  A path of a bool field can be used as a
+// condition.
+type Path struct {
+	NamePos Pos
+	Name    string
+}
+
+// Literal value is a bool, integer, floating-point or string constant.  A
+// boolean literal can be used as a condition.
+type Literal struct {
+	ValuePos Pos
+	Value    constant.Value
+}
+
+func (x *And) Pos() Pos     { return x.OpPos }
+func (x *Or) Pos() Pos      { return x.OpPos }
+func (x *Not) Pos() Pos     { return x.OpPos }
+func (x *Compare) Pos() Pos { return x.OpPos }
+func (x *In) Pos() Pos      { return x.OpPos }
+func (x *Has) Pos() Pos     { return x.FunPos }
+func (x *Path) Pos() Pos    { return x.NamePos }
+func (x *Literal) Pos() Pos { return x.ValuePos }
+
+// Format an expression in the syntax accepted by Parse.
+func Format(x Expr) string {
+	var b strings.Builder
+	format(&b, x, 0)
+	return b.String()
+}
+
+// format with parentheses if the expression binds less tightly than prec.
+func format(b *strings.Builder, x Expr, prec int) {
+	switch x := x.(type) {
+	case *Or:
+		if prec > 1 {
+			b.WriteString("(")
+		}
+		format(b, x.X, 1)
+		b.WriteString(" || ")
+		format(b, x.Y, 2)
+		if prec > 1 {
+			b.WriteString(")")
+		}
+
+	case *And:
+		if prec > 2 {
+			b.WriteString("(")
+		}
+		format(b, x.X, 2)
+		b.WriteString(" && ")
+		format(b, x.Y, 3)
+		if prec > 2 {
+			b.WriteString(")")
+		}
+
+	case *Not:
+		b.WriteString("!")
+		format(b, x.X, 4)
+
+	case *Compare:
+		if prec > 3 {
+			b.WriteString("(")
+		}
+		format(b, x.X, 4)
+		fmt.Fprintf(b, " %s ", x.Op)
+		format(b, x.Y, 4)
+		if prec > 3 {
+			b.WriteString(")")
+		}
+
+	case *In:
+		if prec > 3 {
+			b.WriteString("(")
+		}
+		format(b, x.X, 4)
+		b.WriteString(" in ")
+		format(b, x.Y, 4)
+		if prec > 3 {
+			b.WriteString(")")
+		}
+
+	case *Has:
+		fmt.Fprintf(b, "has(%s)", x.Path.Name)
+
+	case *Path:
+		b.WriteString(x.Name)
+
+	case *Literal:
+		switch v := x.Value; v.Kind() {
+		case constant.String:
+			b.WriteString(strconv.Quote(constant.StringVal(v)))
+		case constant.Float:
+			f, _ := constant.Float64Val(v)
+			b.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+		default:
+			b.WriteString(v.ExactString())
+		}
+	}
+}
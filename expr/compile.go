@@ -0,0 +1,429 @@
+package expr
+
+import (
+	"go/constant"
+	"go/token"
+	"math"
+
+	"github.com/ninchat/pbf/build"
+	"github.com/ninchat/pbf/op"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type compiler struct {
+	b   *build.Builder
+	md  protoreflect.MessageDescriptor
+	err *Error
+}
+
+// Compile a boolean expression into bytecode.  Field paths are resolved and
+// the expression is type-checked against the message type.
+func Compile(x Expr, md protoreflect.MessageDescriptor) ([]byte, error) {
+	bytecode, _, err := CompileNotes(x, md)
+	return bytecode, err
+}
+
+// CompileNotes is like Compile, but also returns the source positions and
+// subexpressions of the conditions by instruction offset.  They can be used
+// with pbf.Explanation.Listing.
+func CompileNotes(x Expr, md protoreflect.MessageDescriptor) (bytecode []byte, notes map[int]string, err error) {
+	c := compiler{
+		b:  build.New(),
+		md: md,
+	}
+
+	fail := c.b.NewLabel()
+	c.jump(x, fail, false)
+	c.b.Op(op.ReturnTrue)
+	c.b.Mark(fail)
+	c.b.Op(op.ReturnFalse)
+
+	if c.err != nil {
+		return nil, nil, c.err
+	}
+	bytecode, err = c.b.Bytecode()
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytecode, c.b.Notes(), nil
+}
+
+func (c *compiler) errorf(pos Pos, format string, args ...interface{}) {
+	if c.err == nil {
+		c.err = errorf(pos, format, args...)
+	}
+}
+
+// jump emits code which jumps to target if x evaluates to the when value, and
+// falls through otherwise.
+func (c *compiler) jump(x Expr, target build.Label, when bool) {
+	if c.err != nil {
+		return
+	}
+
+	switch x := x.(type) {
+	case *And:
+		if when {
+			skip := c.b.NewLabel()
+			c.jump(x.X, skip, false)
+			c.jump(x.Y, target, true)
+			c.b.Mark(skip)
+		} else {
+			c.jump(x.X, target, false)
+			c.jump(x.Y, target, false)
+		}
+
+	case *Or:
+		if when {
+			c.jump(x.X, target, true)
+			c.jump(x.Y, target, true)
+		} else {
+			skip := c.b.NewLabel()
+			c.jump(x.X, skip, true)
+			c.jump(x.Y, target, false)
+			c.b.Mark(skip)
+		}
+
+	case *Not:
+		c.jump(x.X, target, !when)
+
+	case *Literal:
+		if x.Value.Kind() != constant.Bool {
+			c.errorf(x.Pos(), "non-boolean literal %s used as condition", x.Value)
+			return
+		}
+		if constant.BoolVal(x.Value) == when {
+			c.b.OpSkip(op.Skip, target)
+		}
+
+	case *Compare:
+		if v, ok := c.fold(x); ok {
+			c.jump(&Literal{x.Pos(), constant.MakeBool(v)}, target, when)
+			return
+		}
+		c.note(x)
+		c.compare(x)
+		c.b.OpSkip(op.SkipIf(when), target)
+
+	case *In:
+		c.note(x)
+		c.in(x)
+		c.b.OpSkip(op.SkipIf(when), target)
+
+	case *Has:
+		c.note(x)
+		f := c.resolve(x.Path)
+		if f == nil {
+			return
+		}
+		c.b.OpField(op.CheckField, c.b.AddField(f.Spec))
+		c.b.OpSkip(op.SkipIf(when), target)
+
+	case *Path:
+		c.note(x)
+		f := c.resolve(x)
+		if f == nil {
+			return
+		}
+		if f.Kind != op.FieldScalar || f.Desc.Kind() != protoreflect.BoolKind {
+			c.errorf(x.Pos(), "non-boolean field %s used as condition", x.Name)
+			return
+		}
+		c.b.OpField(op.LoadR1FieldScalar, c.b.AddField(f.Spec))
+		c.b.Op(op.LoadConstScalar0)
+		c.b.Op(op.CompareUnsignedNE)
+		c.b.OpSkip(op.SkipIf(when), target)
+
+	default:
+		c.errorf(x.Pos(), "unsupported expression")
+	}
+
+	if c.err == nil {
+		if err := c.b.Err(); err != nil {
+			c.errorf(x.Pos(), "%v", err)
+		}
+	}
+}
+
+func (c *compiler) note(x Expr) {
+	c.b.Note(x.Pos().String() + ": " + Format(x))
+}
+
+// fold comparison of two literals.
+func (c *compiler) fold(x *Compare) (result, ok bool) {
+	a, ok1 := x.X.(*Literal)
+	b, ok2 := x.Y.(*Literal)
+	if !ok1 || !ok2 {
+		return
+	}
+
+	if a.Value.Kind() == constant.Bool || b.Value.Kind() == constant.Bool {
+		if a.Value.Kind() != b.Value.Kind() || (x.Op != op.CmpEQ && x.Op != op.CmpNE) {
+			c.errorf(x.Pos(), "invalid comparison: %s %s %s", a.Value, x.Op, b.Value)
+			return
+		}
+	} else if (a.Value.Kind() == constant.String) != (b.Value.Kind() == constant.String) {
+		c.errorf(x.Pos(), "invalid comparison: %s %s %s", a.Value, x.Op, b.Value)
+		return
+	}
+
+	result = constant.Compare(a.Value, cmpToken(x.Op), b.Value)
+	ok = true
+	return
+}
+
+// compare emits code which sets the status.
+func (c *compiler) compare(x *Compare) {
+	cmp := x.Op
+	left, right := x.X, x.Y
+
+	if _, ok := left.(*Literal); ok {
+		left, right = right, left
+		cmp = mirror(cmp)
+	}
+
+	path, ok := left.(*Path)
+	if !ok {
+		c.errorf(x.Pos(), "unsupported operand")
+		return
+	}
+
+	f := c.resolve(path)
+	if f == nil {
+		return
+	}
+	if f.Kind == op.FieldVector {
+		c.errorf(path.Pos(), "repeated field %s can only be used with the in operator", path.Name)
+		return
+	}
+	if f.Desc.Kind() == protoreflect.BoolKind && cmp != op.CmpEQ && cmp != op.CmpNE {
+		c.errorf(x.Pos(), "bool field %s can only be compared for equality", path.Name)
+		return
+	}
+
+	switch right := right.(type) {
+	case *Literal:
+		c.b.OpField(op.LoadField(op.R1, f.Kind), c.b.AddField(f.Spec))
+		c.loadConst(f, right)
+
+	case *Path:
+		if v := c.enumValue(f, right); v != nil {
+			c.b.OpField(op.LoadField(op.R1, f.Kind), c.b.AddField(f.Spec))
+			c.loadConst(f, v)
+			break
+		}
+
+		g := c.resolve(right)
+		if g == nil {
+			return
+		}
+		if g.Kind != f.Kind || g.Value != f.Value || (f.Desc.Kind() == protoreflect.BoolKind) != (g.Desc.Kind() == protoreflect.BoolKind) {
+			c.errorf(x.Pos(), "mismatched field types: %s %s %s", path.Name, cmp, right.Name)
+			return
+		}
+		c.b.OpField(op.LoadField(op.R1, f.Kind), c.b.AddField(f.Spec))
+		c.b.OpField(op.LoadField(op.R0, g.Kind), c.b.AddField(g.Spec))
+
+	default:
+		c.errorf(x.Pos(), "unsupported operand")
+		return
+	}
+
+	c.b.Op(op.Compare(f.Value, cmp))
+}
+
+// in emits code which sets the status.
+func (c *compiler) in(x *In) {
+	f := c.resolve(x.Y)
+	if f == nil {
+		return
+	}
+	if f.Kind != op.FieldVector {
+		c.errorf(x.Y.Pos(), "field %s is not a packed repeated field", x.Y.Name)
+		return
+	}
+
+	c.b.OpField(op.LoadR1FieldVector, c.b.AddField(f.Spec))
+
+	switch v := x.X.(type) {
+	case *Literal:
+		n, ok := c.convert(f, v)
+		if !ok {
+			return
+		}
+		switch f.Encoding {
+		case op.Fixed32:
+			if f.Value == op.Float {
+				n = uint64(math.Float32bits(float32(math.Float64frombits(n))))
+			} else {
+				n = uint64(uint32(n))
+			}
+		}
+		c.b.LoadConstScalar(n)
+
+	case *Path:
+		g := c.resolve(v)
+		if g == nil {
+			return
+		}
+		if g.Kind != op.FieldScalar || g.Value != f.Value || f.Value == op.Float {
+			c.errorf(x.Pos(), "mismatched field types: %s in %s", v.Name, x.Y.Name)
+			return
+		}
+		c.b.OpField(op.LoadR0FieldScalar, c.b.AddField(g.Spec))
+
+	default:
+		c.errorf(x.Pos(), "unsupported operand")
+		return
+	}
+
+	c.b.Op(op.Contains(f.Encoding))
+}
+
+func (c *compiler) resolve(path *Path) *build.Field {
+	f, err := build.ResolveField(c.md, path.Name)
+	if err != nil {
+		c.errorf(path.Pos(), "%v", err)
+		return nil
+	}
+	return f
+}
+
+// enumValue returns a literal if the path names a value of an enum field
+// instead of a field.
+func (c *compiler) enumValue(f *build.Field, path *Path) *Literal {
+	e := f.Desc.Enum()
+	if e == nil || c.md.Fields().ByName(protoreflect.Name(path.Name)) != nil {
+		return nil
+	}
+	v := e.Values().ByName(protoreflect.Name(path.Name))
+	if v == nil {
+		return nil
+	}
+	return &Literal{path.Pos(), constant.MakeInt64(int64(v.Number()))}
+}
+
+func (c *compiler) loadConst(f *build.Field, x *Literal) {
+	if f.Value == op.Bytes {
+		if x.Value.Kind() != constant.String {
+			c.errorf(x.Pos(), "%s field %s compared with %s", f.Desc.Kind(), f.Desc.Name(), x.Value)
+			return
+		}
+		c.b.LoadConstBytes([]byte(constant.StringVal(x.Value)))
+		return
+	}
+
+	n, ok := c.convert(f, x)
+	if !ok {
+		return
+	}
+
+	switch n {
+	case 0:
+		c.b.Op(op.LoadConstScalar0)
+	case 1:
+		c.b.Op(op.LoadConstScalar1)
+	default:
+		c.b.LoadConstScalar(n)
+	}
+}
+
+// convert a literal to the representation of a scalar field value or vector
+// element.  Floating-point values are converted to float64 bits.
+func (c *compiler) convert(f *build.Field, x *Literal) (n uint64, ok bool) {
+	v := x.Value
+	kind := f.Desc.Kind()
+
+	mismatch := func() {
+		c.errorf(x.Pos(), "%s field %s compared with %s", kind, f.Desc.Name(), v)
+	}
+
+	switch {
+	case kind == protoreflect.BoolKind:
+		if v.Kind() != constant.Bool {
+			mismatch()
+			return
+		}
+		if constant.BoolVal(v) {
+			n = 1
+		}
+		ok = true
+
+	case f.Value == op.Float:
+		if v.Kind() != constant.Int && v.Kind() != constant.Float {
+			mismatch()
+			return
+		}
+		d, _ := constant.Float64Val(v)
+		if kind == protoreflect.FloatKind {
+			d = float64(float32(d))
+		}
+		n = math.Float64bits(d)
+		ok = true
+
+	default:
+		i := constant.ToInt(v)
+		if i.Kind() != constant.Int {
+			mismatch()
+			return
+		}
+
+		var min, max constant.Value
+		switch kind {
+		case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind, protoreflect.EnumKind:
+			min, max = constant.MakeInt64(math.MinInt32), constant.MakeInt64(math.MaxInt32)
+		case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+			min, max = constant.MakeInt64(math.MinInt64), constant.MakeInt64(math.MaxInt64)
+		case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+			min, max = constant.MakeInt64(0), constant.MakeUint64(math.MaxUint32)
+		default:
+			min, max = constant.MakeInt64(0), constant.MakeUint64(math.MaxUint64)
+		}
+		if constant.Compare(i, token.LSS, min) || constant.Compare(i, token.GTR, max) {
+			c.errorf(x.Pos(), "constant %s overflows %s field %s", v, kind, f.Desc.Name())
+			return
+		}
+
+		if f.Value == op.Signed {
+			s, _ := constant.Int64Val(i)
+			n = uint64(s)
+		} else {
+			n, _ = constant.Uint64Val(i)
+		}
+		ok = true
+	}
+
+	return
+}
+
+func mirror(cmp op.Cmp) op.Cmp {
+	switch cmp {
+	case op.CmpLT:
+		return op.CmpGT
+	case op.CmpGE:
+		return op.CmpLE
+	case op.CmpLE:
+		return op.CmpGE
+	case op.CmpGT:
+		return op.CmpLT
+	default:
+		return cmp
+	}
+}
+
+func cmpToken(cmp op.Cmp) token.Token {
+	switch cmp {
+	case op.CmpLT:
+		return token.LSS
+	case op.CmpGE:
+		return token.GEQ
+	case op.CmpEQ:
+		return token.EQL
+	case op.CmpNE:
+		return token.NEQ
+	case op.CmpLE:
+		return token.LEQ
+	default:
+		return token.GTR
+	}
+}
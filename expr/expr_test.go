@@ -0,0 +1,128 @@
+package expr_test
+
+import (
+	"testing"
+
+	"github.com/ninchat/pbf/expr"
+	"github.com/ninchat/pbf/internal/test"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestExpr(t *testing.T) {
+	for src, result := range map[string]bool{
+		`a == 1 && b != 1 && n.x > 1000 && "PBF" == k && 2.2 in u`:  true,
+		`a == 1 && b != 1 && n.x > 1000 && "PBF" == k && 3.14 in u`: false,
+		`a == 1 || b == 1`:    true,
+		`a == 2 || b == 1`:    false,
+		`!(a == 2 || b == 1)`: true,
+		`c == 3 && d < 0 && d == d && e == -5 && f < -5`:   true,
+		`g >= 0x7f000007 && h <= 0x8000000000000008`:       true,
+		`i == 3.141592653589793 && j == 3.141592653589793`: true,
+		`i > 3.1416`: false,
+		`l == "Hello, world!" && l > "Hello" && l != k`:             true,
+		`m[3] == 4 && n.y == 56789 && o.z[0] == -3`:                 true,
+		`p[1] == 20 && q[2].x == 102 && q[0].y < q[1].y`:            true,
+		`4 in m && 1 in o.z && -3 in o.z && 3.141592653589793 in t`: true,
+		`-4 in o.z`: false,
+		`has(a) && has(q[2]) && !has(s) && !has(r)`: false,
+		`has(a) && has(q[2]) && !has(s)`:            true,
+		`s == ""`:                                   true,
+		`1 < 2 && !(1 > 2) && "a" < "b"`:            true,
+		`true && (false || c != 3)`:                 false,
+		`true && (false || c == 3)`:                 true,
+		`(a == 1 || b == 1) && (c == 1 || d == -4)`: true,
+		`(a == 0 || b == 0) && (c == 1 || d == -4)`: false,
+	} {
+		if ok := test.FilterSource(t, src, compile); ok != result {
+			t.Errorf("%s: %v", src, ok)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for src, msg := range map[string]string{
+		``:               "1:1: expected operand but found end of expression",
+		`a ==`:           "1:5: expected operand but found end of expression",
+		`a == 1 &&`:      "1:10: expected operand but found end of expression",
+		`(a == 1`:        "1:8: expected ) but found end of expression",
+		`a == 1 b`:       "1:8: unexpected b",
+		`has(1)`:         "1:5: expected field path but found 1",
+		`q[x].y == 1`:    "1:3: expected index but found x",
+		`a == - "x"`:     "1:8: expected number but found \"x\"",
+		"a == 1 &&\nb @": "2:3: illegal character U+0040 '@'",
+	} {
+		_, err := expr.Parse(src)
+		if err == nil {
+			t.Errorf("%q: no error", src)
+		} else if err.Error() != msg {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	md := (&test.Test{}).ProtoReflect().Descriptor()
+
+	for src, pos := range map[string]string{
+		`a == -1`:          "1:6",
+		`c == 3000000000`:  "1:6",
+		`a == "x"`:         "1:6",
+		`k == 1`:           "1:6",
+		`a == c`:           "1:3",
+		`a < d`:            "1:3",
+		`a`:                "1:1",
+		`1`:                "1:1",
+		`m == 1`:           "1:1",
+		`1 in a`:           "1:6",
+		`a in m && x == 1`: "1:11",
+		`true == 1`:        "1:6",
+		`1.5 in m`:         "1:1",
+	} {
+		x, err := expr.Parse(src)
+		if err != nil {
+			t.Errorf("%q: %v", src, err)
+			continue
+		}
+
+		_, err = expr.Compile(x, md)
+		if err == nil {
+			t.Errorf("%q: no error", src)
+			continue
+		}
+
+		e, ok := err.(*expr.Error)
+		if !ok {
+			t.Errorf("%q: %v", src, err)
+			continue
+		}
+		if e.Pos.String() != pos {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for _, src := range []string{
+		`a == 1 && b != 1 && n.x > 1000 && "PBF" == k && 2.2 in u`,
+		`(a == 1 || b == 1) && !(c == 1 || d == -4)`,
+		`a == 1 || b == 1 && c == 3`,
+		`has(q[2]) && !has(s) && -3 in o.z && i > 3.141592653589793`,
+		`true && (false || a == 1 && !r)`,
+	} {
+		x, err := expr.Parse(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := expr.Format(x); s != src {
+			t.Errorf("%s: %s", src, s)
+		}
+	}
+}
+
+func compile(src string, md protoreflect.MessageDescriptor) ([]byte, error) {
+	x, err := expr.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return expr.Compile(x, md)
+}
@@ -0,0 +1,251 @@
+package expr
+
+import (
+	"go/constant"
+	"go/scanner"
+	"go/token"
+	"strings"
+
+	"github.com/ninchat/pbf/op"
+)
+
+type parser struct {
+	file    *token.File
+	scanner scanner.Scanner
+	err     *Error
+
+	pos token.Pos
+	tok token.Token
+	lit string
+}
+
+// Parse a boolean expression.
+//
+// The syntax resembles Go: the logical operators are ||, && and !, and the
+// comparison operators are ==, !=, <, <=, > and >=.  Operands are field paths
+// (see build.ResolveField), integer, floating-point, string and boolean
+// literals.  The "x in path" operator tests whether a packed repeated field
+// contains a value, and "has(path)" tests whether a field is present.  A bool
+// field can be used as a condition by itself.
+func Parse(src string) (Expr, error) {
+	fset := token.NewFileSet()
+
+	p := parser{
+		file: fset.AddFile("", fset.Base(), len(src)),
+	}
+	p.scanner.Init(p.file, []byte(src), p.scanError, 0)
+	p.next()
+
+	x := p.parseOr()
+	if p.err == nil && p.tok != token.EOF {
+		p.errorf(p.pos, "unexpected %s", p.describe())
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return x, nil
+}
+
+func (p *parser) scanError(pos token.Position, msg string) {
+	if p.err == nil {
+		p.err = &Error{Pos{pos.Offset, pos.Line, pos.Column}, msg}
+	}
+}
+
+func (p *parser) errorf(pos token.Pos, format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = errorf(p.position(pos), format, args...)
+	}
+}
+
+func (p *parser) position(pos token.Pos) Pos {
+	x := p.file.Position(pos)
+	return Pos{x.Offset, x.Line, x.Column}
+}
+
+func (p *parser) next() {
+	for {
+		p.pos, p.tok, p.lit = p.scanner.Scan()
+		if p.tok != token.SEMICOLON || p.lit != "\n" {
+			return
+		}
+	}
+}
+
+func (p *parser) describe() string {
+	switch p.tok {
+	case token.EOF:
+		return "end of expression"
+	case token.IDENT, token.INT, token.FLOAT, token.STRING:
+		return p.lit
+	default:
+		return p.tok.String()
+	}
+}
+
+func (p *parser) expect(tok token.Token) token.Pos {
+	pos := p.pos
+	if p.tok != tok {
+		p.errorf(pos, "expected %s but found %s", tok, p.describe())
+	}
+	p.next()
+	return pos
+}
+
+func (p *parser) parseOr() Expr {
+	x := p.parseAnd()
+	for p.err == nil && p.tok == token.LOR {
+		pos := p.pos
+		p.next()
+		x = &Or{p.position(pos), x, p.parseAnd()}
+	}
+	return x
+}
+
+func (p *parser) parseAnd() Expr {
+	x := p.parseUnary()
+	for p.err == nil && p.tok == token.LAND {
+		pos := p.pos
+		p.next()
+		x = &And{p.position(pos), x, p.parseUnary()}
+	}
+	return x
+}
+
+func (p *parser) parseUnary() Expr {
+	if p.tok == token.NOT {
+		pos := p.pos
+		p.next()
+		return &Not{p.position(pos), p.parseUnary()}
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() Expr {
+	switch {
+	case p.tok == token.LPAREN:
+		p.next()
+		x := p.parseOr()
+		p.expect(token.RPAREN)
+		return x
+
+	case p.tok == token.IDENT && p.lit == "has":
+		pos := p.pos
+		p.next()
+		p.expect(token.LPAREN)
+		path := p.parsePath()
+		p.expect(token.RPAREN)
+		return &Has{p.position(pos), path}
+	}
+
+	x := p.parseOperand()
+
+	if p.tok == token.IDENT && p.lit == "in" {
+		pos := p.pos
+		p.next()
+		return &In{p.position(pos), x, p.parsePath()}
+	}
+
+	var cmp op.Cmp
+	switch p.tok {
+	case token.LSS:
+		cmp = op.CmpLT
+	case token.GEQ:
+		cmp = op.CmpGE
+	case token.EQL:
+		cmp = op.CmpEQ
+	case token.NEQ:
+		cmp = op.CmpNE
+	case token.LEQ:
+		cmp = op.CmpLE
+	case token.GTR:
+		cmp = op.CmpGT
+	default:
+		return x
+	}
+
+	pos := p.pos
+	p.next()
+	return &Compare{p.position(pos), cmp, x, p.parseOperand()}
+}
+
+func (p *parser) parseOperand() Expr {
+	pos := p.pos
+
+	switch p.tok {
+	case token.IDENT:
+		switch p.lit {
+		case "true", "false":
+			v := constant.MakeBool(p.lit == "true")
+			p.next()
+			return &Literal{p.position(pos), v}
+		}
+		return p.parsePath()
+
+	case token.SUB:
+		p.next()
+		if p.tok != token.INT && p.tok != token.FLOAT {
+			p.errorf(p.pos, "expected number but found %s", p.describe())
+			return nil
+		}
+		x := p.parseOperand().(*Literal)
+		x.ValuePos = p.position(pos)
+		x.Value = constant.UnaryOp(token.SUB, x.Value, 0)
+		return x
+
+	case token.INT, token.FLOAT, token.STRING:
+		v := constant.MakeFromLiteral(p.lit, p.tok, 0)
+		if v.Kind() == constant.Unknown {
+			p.errorf(pos, "invalid literal: %s", p.lit)
+		}
+		p.next()
+		return &Literal{p.position(pos), v}
+
+	default:
+		p.errorf(pos, "expected operand but found %s", p.describe())
+		p.next()
+		return nil
+	}
+}
+
+// parsePath consisting of identifiers, dots and bracketed indexes.
+func (p *parser) parsePath() *Path {
+	pos := p.pos
+	var b strings.Builder
+
+	if p.tok != token.IDENT {
+		p.errorf(pos, "expected field path but found %s", p.describe())
+		return nil
+	}
+	b.WriteString(p.lit)
+	p.next()
+
+	for p.err == nil {
+		switch p.tok {
+		case token.PERIOD:
+			p.next()
+			if p.tok != token.IDENT {
+				p.errorf(p.pos, "expected field name but found %s", p.describe())
+			}
+			b.WriteString(".")
+			b.WriteString(p.lit)
+			p.next()
+
+		case token.LBRACK:
+			p.next()
+			if p.tok != token.INT {
+				p.errorf(p.pos, "expected index but found %s", p.describe())
+			}
+			b.WriteString("[")
+			b.WriteString(p.lit)
+			b.WriteString("]")
+			p.next()
+			p.expect(token.RBRACK)
+
+		default:
+			return &Path{p.position(pos), b.String()}
+		}
+	}
+
+	return nil
+}
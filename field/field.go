@@ -4,6 +4,8 @@ package field
 
 import (
 	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 // Mod informs the decoding of a protobuf field.
@@ -22,6 +24,11 @@ const (
 	ModPacked
 	ModMessage
 	ModRepeated
+	ModEach // Current element of a repeated message field; see op.LoopNext.
+
+	// Leaf nodes (continued):
+
+	ModCount // Number of occurrences of the field.
 )
 
 func (m Mod) String() string {
@@ -38,6 +45,10 @@ func (m Mod) String() string {
 		return "Message"
 	case ModRepeated:
 		return "Repeated"
+	case ModEach:
+		return "Each"
+	case ModCount:
+		return "Count"
 	default:
 		return fmt.Sprintf("<invalid field.Mod value %d>", m)
 	}
@@ -45,11 +56,52 @@ func (m Mod) String() string {
 
 // IsValid value?
 func (m Mod) IsValid() bool {
-	return m <= ModRepeated
+	return m <= ModCount
 }
 
 // IsLeaf node?  A non-leaf node is used as an intermediary for reaching a leaf
 // node.
 func (m Mod) IsLeaf() bool {
-	return m <= ModFloat
+	return m <= ModFloat || m == ModCount
+}
+
+// SubtypeName of a ModPacked node's element wire type: Varint, Fixed32, Fixed64
+// or Bytes.
+func SubtypeName(t protowire.Type) string {
+	switch t {
+	case protowire.VarintType:
+		return "Varint"
+	case protowire.Fixed32Type:
+		return "Fixed32"
+	case protowire.Fixed64Type:
+		return "Fixed64"
+	case protowire.BytesType:
+		return "Bytes"
+	default:
+		return fmt.Sprintf("<invalid subtype %d>", t)
+	}
+}
+
+// ParseSubtype is the inverse of SubtypeName.
+func ParseSubtype(s string) (t protowire.Type, ok bool) {
+	for _, t := range []protowire.Type{protowire.VarintType, protowire.Fixed32Type, protowire.Fixed64Type, protowire.BytesType} {
+		if SubtypeName(t) == s {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// FormatNode of a field spec as NUM, NUM.Mod or NUM.Packed.Subtype.  A path is
+// formatted by joining the nodes with spaces, from the top-level node to the
+// leaf node.
+func FormatNode(num int32, mod Mod, subtype protowire.Type) string {
+	s := fmt.Sprint(num)
+	if mod != 0 {
+		s += "." + mod.String()
+	}
+	if mod == ModPacked {
+		s += "." + SubtypeName(subtype)
+	}
+	return s
 }
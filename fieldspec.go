@@ -2,38 +2,100 @@ package pbf
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 
 	"github.com/ninchat/pbf/field"
 	"google.golang.org/protobuf/encoding/protowire"
 )
 
+// maxFieldCount of the wide bytecode format.
+const maxFieldCount = 0xffff
+
+var errLoopField = errors.New("ModEach node is not referenced by a loop field")
+
+// fieldSpec is a node of the field spec tree.  The nodes are copied while
+// decoding, so the fields are kept narrow.
 type fieldSpec struct {
 	indexed bool
-	index   uint8
-	mod     field.Mod
-	subtype uint8 // Meaningful only if ModPacked.
+	counted bool
+	mod     field.Mod // ModCount if the node is referenced only by a count.
+	subtype uint8     // Meaningful only if ModPacked.
+	index   uint16
+	count   uint16 // Field index of the occurrence count.
+	loop    uint16 // Meaningful only if ModEach.
 	sub     map[int32]fieldSpec
 }
 
-func (f *fieldSpec) maskslot() uint8 { return f.index >> 6 }
-func (f *fieldSpec) maskbit() uint8  { return f.index & 63 }
+// loopSpec describes the iteration of a ModEach node.
+type loopSpec struct {
+	index  int                 // Field which refers to the node directly.
+	parent int                 // Enclosing loop, or -1.
+	path   []protowire.Number  // Field numbers from the top-level message to the node.
+	sub    map[int32]fieldSpec // Fields of an element.
+	fields []int               // Indexes of the fields below the node.
+	loops  []int               // Loops below the node.
+}
+
+// fieldSpecUndo is a log of field spec tree changes.
+type fieldSpecUndo []fieldSpecChange
+
+type fieldSpecChange struct {
+	dest  map[int32]fieldSpec
+	key   int32
+	spec  fieldSpec
+	found bool
+}
+
+// record the current state of a node before it's changed.  The log may be nil.
+func (u *fieldSpecUndo) record(dest map[int32]fieldSpec, key int32) {
+	if u != nil {
+		s, found := dest[key]
+		*u = append(*u, fieldSpecChange{dest, key, s, found})
+	}
+}
 
-func parseFieldSection(buf []byte) (map[int32]fieldSpec, uint8, int, error) {
-	if len(buf) == 0 {
-		return nil, 0, 0, errBytecodeInvalid
+// revert the recorded changes.
+func (u fieldSpecUndo) revert() {
+	for i := len(u) - 1; i >= 0; i-- {
+		if c := u[i]; c.found {
+			c.dest[c.key] = c.spec
+		} else {
+			delete(c.dest, c.key)
+		}
+	}
+}
+
+func (f *fieldSpec) maskslot() int { return int(f.index >> 6) }
+func (f *fieldSpec) maskbit() uint { return uint(f.index & 63) }
+
+// parseFieldSection with a 1-byte field count, or a 2-byte field count if
+// wide.
+func parseFieldSection(buf []byte, wide bool) (map[int32]fieldSpec, int, int, error) {
+	var count, size int
+
+	if wide {
+		if len(buf) < 2 {
+			return nil, 0, 0, io.ErrUnexpectedEOF
+		}
+		count = int(binary.LittleEndian.Uint16(buf))
+		size = 2
+	} else {
+		if len(buf) < 1 {
+			return nil, 0, 0, io.ErrUnexpectedEOF
+		}
+		count = int(buf[0])
+		size = 1
 	}
-	count := buf[0]
-	size := 1
 
 	dest := make(map[int32]fieldSpec, count)
 
-	for i := uint8(0); i < count; i++ {
+	for i := 0; i < count; i++ {
 		if debugging {
 			debugf("field:  Proto")
 		}
 
-		n, err := parseFieldSpec(dest, buf[size:], i, "")
+		n, err := parseFieldSpec(dest, buf[size:], i, "", nil)
 		size += n
 		if err != nil {
 			return nil, i, size, err
@@ -43,7 +105,9 @@ func parseFieldSection(buf []byte) (map[int32]fieldSpec, uint8, int, error) {
 	return dest, count, size, nil
 }
 
-func parseFieldSpec(dest map[int32]fieldSpec, buf []byte, index uint8, anno string) (int, error) {
+// parseFieldSpec into dest.  The previous states of the modified nodes are
+// recorded if undo is not nil.
+func parseFieldSpec(dest map[int32]fieldSpec, buf []byte, index int, anno string, undo *fieldSpecUndo) (int, error) {
 	if len(buf) < 5 {
 		return 0, io.ErrUnexpectedEOF
 	}
@@ -51,7 +115,7 @@ func parseFieldSpec(dest map[int32]fieldSpec, buf []byte, index uint8, anno stri
 	mod := field.Mod(buf[4])
 	size := 5
 	if !mod.IsValid() {
-		return size, errBytecodeInvalid
+		return size, ErrBytecodeInvalid
 	}
 
 	if debugging {
@@ -62,19 +126,36 @@ func parseFieldSpec(dest map[int32]fieldSpec, buf []byte, index uint8, anno stri
 		}
 	}
 
-	if mod.IsLeaf() {
+	if mod == field.ModCount {
 		s, found := dest[key]
-		if found {
+		if s.counted {
+			return size, ErrBytecodeInvalid
+		}
+		if !found {
+			s.mod = mod
+		}
+		s.count = uint16(index)
+		s.counted = true
+		undo.record(dest, key)
+		dest[key] = s
+
+		if debugging {
+			debugf(" = %s\n", dest[key])
+		}
+	} else if mod.IsLeaf() {
+		s, found := dest[key]
+		if found && s.mod != field.ModCount {
 			// The node is already used as an intermediary.  It can be
 			// referenced directly only as a vector (no mod).
 			if mod != 0 || s.indexed {
-				return size, errBytecodeInvalid
+				return size, ErrBytecodeInvalid
 			}
 		} else {
 			s.mod = mod
 		}
-		s.index = index
+		s.index = uint16(index)
 		s.indexed = true
+		undo.record(dest, key)
 		dest[key] = s
 
 		if debugging {
@@ -104,19 +185,22 @@ func parseFieldSpec(dest map[int32]fieldSpec, buf []byte, index uint8, anno stri
 			case protowire.BytesType:
 				subanno = "Bytes"
 			default:
-				return size, errBytecodeInvalid
+				return size, ErrBytecodeInvalid
 			}
 
 		case field.ModRepeated:
 			subanno = "Repeated"
+
+		case field.ModEach:
+			subanno = "Each"
 		}
 
 		s, found := dest[key]
 		if found {
 			// The node is already be used as an intermediary (same specs), or
-			// referenced directly as a vector (no mod).
-			if s.mod != 0 && (s.mod != mod || s.subtype != subtype) {
-				return size, errBytecodeInvalid
+			// referenced directly as a vector (no mod) or by a count.
+			if s.mod != 0 && s.mod != field.ModCount && (s.mod != mod || s.subtype != subtype) {
+				return size, ErrBytecodeInvalid
 			}
 		}
 		s.mod = mod
@@ -124,9 +208,10 @@ func parseFieldSpec(dest map[int32]fieldSpec, buf []byte, index uint8, anno stri
 		if s.sub == nil {
 			s.sub = make(map[int32]fieldSpec)
 		}
+		undo.record(dest, key)
 		dest[key] = s
 
-		n, err := parseFieldSpec(s.sub, buf[size:], index, subanno)
+		n, err := parseFieldSpec(s.sub, buf[size:], index, subanno, undo)
 		size += n
 		if err != nil {
 			return size, err
@@ -0,0 +1,222 @@
+//go:build go1.18
+
+package pbf_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/asm"
+	"github.com/ninchat/pbf/build"
+	"github.com/ninchat/pbf/internal/test"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const fuzzSource = `
+	.field q 17
+	.field x 17.Each 1
+	.field n 17.Count
+	.field l 12
+	.field m 13
+
+loop:	LoopNext q @fail
+	LoadR1FieldScalar x
+	LoadConstScalar 101
+	CompareSignedEQ
+	SkipTrue @found
+	LoopBack @loop
+found:	LoadR1FieldScalar n
+	LoadConstScalar 3
+	CompareUnsignedEQ
+	SkipFalse @fail
+	LoadR1FieldVector m
+	LoadConstScalar 0
+	AllVarint CompareUnsignedGT
+	SkipFalse @fail
+	LoadR1FieldBytes l
+	LoadConstBytes "world"
+	ContainsBytes
+	SkipFalse @fail
+	ReturnTrue
+fail:	ReturnFalse
+`
+
+const fuzzBytesSource = `
+	.field k 11
+	.field m 13
+	.field q 17
+	.field x 17.Each 2
+
+	LoadR1FieldBytes k
+	LoadConstBytes "x"
+	CompareBytesEQ
+	SkipTrue @pass
+	LoadR1FieldBytes k
+	LoadConstBytes "PBF"
+	HasPrefixBytes
+	SkipTrue @pass
+	LoadR1FieldVector m
+	LoadConstScalar 4
+	AnyVarint CompareUnsignedEQ
+	SkipTrue @pass
+loop:	LoopNext q @fail
+	LoadR1FieldBytes x
+	LengthR1Bytes
+	LoadConstScalar 0
+	CompareUnsignedGT
+	SkipTrue @pass
+	LoopBack @loop
+pass:	ReturnTrue
+fail:	ReturnFalse
+`
+
+// fuzzMessages returns test messages, some of which can't be decoded.
+func fuzzMessages() [][]byte {
+	data := test.Data()
+
+	return [][]byte{
+		data,
+		nil,
+		data[:len(data)-1],
+		append(data[:len(data):len(data)], 0x60, 0x01),                     // .12 = 1
+		append(data[:len(data):len(data)], 0x88, 0x01, 0x01),               // .17 = 1
+		{0x58, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}, // .11 = 1<<63
+		{0x68, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}, // .13 = 1<<63
+		{0x8a, 0x01, 0x02, 0x10, 0x01},                                     // .17[.2 = 1]
+		{0x8a, 0x01, 0x03, 0x08, 0xe5, 0x00},                               // .17[.1 = 101]
+		{0x8a, 0x01, 0x02, 0x08},                                           // .17[.1 =
+	}
+}
+
+// FuzzNewProgram makes sure that malformed bytecode is rejected with an error,
+// and that accepted programs can be executed.
+func FuzzNewProgram(f *testing.F) {
+	source, err := asm.Assemble([]byte(fuzzSource))
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(bytecode)
+	f.Add(source)
+	f.Add(bytecode[:len(bytecode)-4])
+
+	message := test.Data()
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		prog, err := pbf.NewProgram(b)
+		if err != nil {
+			return
+		}
+
+		pbf.NewMachine(prog).Filter(message)
+	})
+}
+
+// FuzzOptimize makes sure that optimized programs are accepted, and that they
+// make the same filtering decisions as the original programs.  Messages which
+// can't be decoded by the original program may be accepted by the optimized
+// one.
+func FuzzOptimize(f *testing.F) {
+	source, err := asm.Assemble([]byte(fuzzSource))
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(bytecode)
+	f.Add(source)
+
+	messages := fuzzMessages()
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		prog, err := pbf.NewProgram(b)
+		if err != nil {
+			return
+		}
+
+		optimized, err := build.Optimize(b)
+		if err != nil {
+			// Only the field specs which can't be built may be rejected.
+			var e *pbf.BytecodeError
+			if errors.As(err, &e) {
+				t.Fatal(err)
+			}
+			return
+		}
+		optprog, err := pbf.NewProgram(optimized)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, message := range messages {
+			x, xerr := pbf.NewMachine(prog).Filter(message)
+			y, yerr := pbf.NewMachine(optprog).Filter(message)
+			if xerr == nil && (x != y || yerr != nil) {
+				t.Errorf("%x: %v %v, %v %v", message, x, xerr, y, yerr)
+			}
+		}
+	})
+}
+
+// FuzzFilter makes sure that malformed messages don't crash the machine, the
+// matcher or the reader.
+func FuzzFilter(f *testing.F) {
+	var progs []*pbf.Program
+	for _, src := range []string{fuzzSource, fuzzBytesSource} {
+		b, err := asm.Assemble([]byte(src))
+		if err != nil {
+			f.Fatal(err)
+		}
+		prog, err := pbf.NewProgram(b)
+		if err != nil {
+			f.Fatal(err)
+		}
+		progs = append(progs, prog)
+	}
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		f.Fatal(err)
+	}
+	progs = append(progs, prog)
+
+	for _, message := range fuzzMessages() {
+		f.Add(message)
+	}
+
+	matcher, err := pbf.NewMatcher(progs...)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	visit := func(m *pbf.Machine) {
+		m.VisitFields(func(index int, value pbf.Value) bool {
+			_ = value.String()
+			m.GetBytes(index)
+			return true
+		})
+	}
+
+	f.Fuzz(func(t *testing.T, message []byte) {
+		var expect []int
+		for id, prog := range progs {
+			m := pbf.NewMachine(prog)
+			if ok, _ := m.Filter(message); ok {
+				expect = append(expect, id)
+			}
+			visit(m)
+		}
+
+		if ids, err := matcher.Match(message, nil); err == nil && !reflect.DeepEqual(ids, expect) {
+			t.Error(ids, expect)
+		}
+		for id := range progs {
+			visit(matcher.Machine(id))
+		}
+
+		stream := append(protowire.AppendVarint(nil, uint64(len(message))), message...)
+		r := pbf.NewReader(bytes.NewReader(stream), progs[1])
+		r.Next()
+	})
+}
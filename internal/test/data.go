@@ -0,0 +1,75 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ninchat/pbf"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Data returns the encoded Test message in internal/testdata/test.buf.  The
+// file is looked up relative to the working directory, which is the directory
+// of the package being tested (or one of its ancestors).
+func Data() []byte {
+	dir := "."
+
+	for {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, "internal", "testdata", "test.buf"))
+		if err == nil {
+			return buf
+		}
+		if !os.IsNotExist(err) {
+			panic(err)
+		}
+
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			panic(err)
+		}
+		if filepath.Dir(abs) == abs {
+			panic("internal/testdata/test.buf not found")
+		}
+		dir = filepath.Join(dir, "..")
+	}
+}
+
+// Filter the test data with a program.  Errors are fatal.
+func Filter(t testing.TB, bytecode []byte) bool {
+	t.Helper()
+
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := pbf.NewMachine(prog).Filter(Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+// FilterSource compiles source code for the Test message type, and filters the
+// test data with the program.  Errors are fatal.
+func FilterSource(t testing.TB, src string, compile func(string, protoreflect.MessageDescriptor) ([]byte, error)) bool {
+	t.Helper()
+
+	bytecode, err := compile(src, (&Test{}).ProtoReflect().Descriptor())
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+
+	ok, err := pbf.NewMachine(prog).Filter(Data())
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return ok
+}
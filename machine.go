@@ -1,15 +1,30 @@
 package pbf
 
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/ninchat/pbf/field"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
 // Machine for program evaluation.  There can be many instances per program,
 // but each instance can be used only by a single goroutine at a time.
 type Machine struct {
 	status      bool
 	reg         [2]uint64
-	protobuf    []byte    // Encoded protobuf message.
-	fielddata   []uint64  // Decoded fields.
-	fieldmask   [4]uint64 // Decoded field existence.
+	protobuf    []byte           // Encoded protobuf message.
+	fielddata   []uint64         // Decoded fields.
+	fieldmask   []uint64         // Decoded field existence.
+	fieldtype   []protowire.Type // Wire types of the decoded fields; zero (varint) for counts.
 	topfieldrep *[256]int32
+	topelemspec fieldSpec // Returned by getTopMessageFieldSpec.
 	fieldrep    repMapPool
+	loops       []loopState
+	loopback    bool  // LoopNext is reached via LoopBack.
+	looperr     error // First error from element decoding.
+	trace       *traceState
 	*program
 }
 
@@ -17,8 +32,13 @@ type Machine struct {
 func NewMachine(p *Program) *Machine {
 	m := &Machine{
 		fielddata: make([]uint64, p.fieldcount),
+		fieldmask: make([]uint64, (p.fieldcount+63)/64),
+		fieldtype: make([]protowire.Type, p.fieldcount),
 		program:   &p.program,
 	}
+	if len(p.loops) > 0 {
+		m.loops = make([]loopState, len(p.loops))
+	}
 	if p.fieldspecarr != nil {
 		m.topfieldrep = new([256]int32)
 	}
@@ -32,16 +52,25 @@ func (m *Machine) Filter(message []byte) (bool, error) {
 	m.reset(message)
 	err := m.decode()
 	ok := m.evaluate()
+	if err == nil {
+		err = m.looperr
+	}
 	return ok, err
 }
 
 // GetRawValue can be used after a Filter call to retrieve values of the
 // protobuf message's fields that are referenced by the filter program.  The
-// interpretation of a value depends on the field.
+// interpretation of a value depends on the field; see GetValue and the typed
+// accessors.  Fields beyond the first 256 can be retrieved with
+// GetRawValueWide.
 func (m *Machine) GetRawValue(index uint8) (value uint64, found bool) {
-	slot := index >> 6
-	bit := index & 63
-	if m.fieldmask[slot]&(1<<bit) == 0 {
+	return m.GetRawValueWide(int(index))
+}
+
+// GetRawValueWide is like GetRawValue, but it accepts all field indexes of the
+// wide bytecode format.
+func (m *Machine) GetRawValueWide(index int) (value uint64, found bool) {
+	if index < 0 || index >= m.fieldcount || !m.fieldFound(index) {
 		return
 	}
 
@@ -50,6 +79,142 @@ func (m *Machine) GetRawValue(index uint8) (value uint64, found bool) {
 	return
 }
 
+// GetUint64 can be used after a Filter call to retrieve the value of an
+// unsigned integer field or an occurrence count which is loaded as a scalar by
+// the program.
+func (m *Machine) GetUint64(index int) (value uint64, found bool, err error) {
+	return m.getScalar(index, "uint64", 0, field.ModCount)
+}
+
+// GetInt64 can be used after a Filter call to retrieve the value of a signed
+// integer field which is loaded as a scalar by the program.  The sign of a
+// value encoded with the fixed32 wire type is unknown, so ErrFieldMode is
+// returned for fixed32 and sfixed32 fields; use GetUint64 instead.
+func (m *Machine) GetInt64(index int) (value int64, found bool, err error) {
+	data, found, err := m.getScalar(index, "int64", 0, field.ModZigZag)
+	if found {
+		if err = m.checkWireType(index, "int64", protowire.VarintType, protowire.Fixed64Type); err != nil {
+			found = false
+			return
+		}
+	}
+	value = int64(data)
+	return
+}
+
+// GetFloat64 can be used after a Filter call to retrieve the value of a
+// floating-point field which is loaded as a scalar by the program.  A float
+// field must be declared with ModFloat; a double field may also be declared
+// without a modifier.  ErrFieldMode is returned if the value wasn't encoded
+// with a floating-point wire type.
+func (m *Machine) GetFloat64(index int) (value float64, found bool, err error) {
+	data, found, err := m.getScalar(index, "float64", 0, field.ModFloat)
+	if found {
+		types := []protowire.Type{protowire.Fixed64Type}
+		if m.fieldmod[index] == field.ModFloat {
+			types = append(types, protowire.Fixed32Type)
+		}
+		if err = m.checkWireType(index, "float64", types...); err != nil {
+			found = false
+			return
+		}
+	}
+	value = math.Float64frombits(data)
+	return
+}
+
+// GetBool can be used after a Filter call to retrieve the value of a bool
+// field which is loaded as a scalar by the program.  ErrFieldMode is returned
+// if the value wasn't encoded with the varint wire type.
+func (m *Machine) GetBool(index int) (value, found bool, err error) {
+	data, found, err := m.getScalar(index, "bool", 0)
+	if found {
+		if err = m.checkWireType(index, "bool", protowire.VarintType); err != nil {
+			found = false
+			return
+		}
+	}
+	value = data != 0
+	return
+}
+
+// GetBytes can be used after a Filter call to retrieve the value of a field
+// which is loaded as bytes or as a vector by the program.  The value refers to
+// the filtered message.  The payload of a packed repeated field is returned as
+// is.
+func (m *Machine) GetBytes(index int) (value []byte, found bool, err error) {
+	if err = m.checkFieldMode(index, "bytes", accessBytes, accessVector); err != nil {
+		return
+	}
+
+	data, found := m.GetRawValueWide(index)
+	if !found {
+		return
+	}
+
+	off, n := unpackBytesRef(data)
+	value = m.protobuf[off:][:n]
+	return
+}
+
+// GetString is like GetBytes, but the value is copied into a string.
+func (m *Machine) GetString(index int) (value string, found bool, err error) {
+	b, found, err := m.GetBytes(index)
+	value = string(b)
+	return
+}
+
+func (m *Machine) getScalar(index int, typ string, mods ...field.Mod) (value uint64, found bool, err error) {
+	if err = m.checkFieldMode(index, typ, accessScalar); err != nil {
+		return
+	}
+
+	mod := m.fieldmod[index]
+	ok := false
+	for _, x := range mods {
+		if mod == x {
+			ok = true
+		}
+	}
+	if !ok {
+		err = &FieldError{index, typ, fmt.Sprintf("field has %s mod", mod), ErrFieldMode}
+		return
+	}
+
+	value, found = m.GetRawValueWide(index)
+	return
+}
+
+func (m *Machine) checkFieldMode(index int, typ string, modes ...accessMode) error {
+	if index < 0 || index >= m.fieldcount {
+		return &FieldError{index, typ, fmt.Sprintf("program has %d fields", m.fieldcount), ErrFieldIndex}
+	}
+
+	mode := m.fieldmode[index]
+	for _, x := range modes {
+		if mode == x {
+			return nil
+		}
+	}
+	return &FieldError{index, typ, fmt.Sprintf("field is accessed as %s", mode), ErrFieldMode}
+}
+
+// checkWireType of a decoded scalar field.  Occurrence counts are varints.
+func (m *Machine) checkWireType(index int, typ string, types ...protowire.Type) error {
+	wiretype := m.fieldtype[index]
+	for _, x := range types {
+		if wiretype == x {
+			return nil
+		}
+	}
+	return &FieldError{index, typ, fmt.Sprintf("value has %s wire type", strings.ToLower(field.SubtypeName(wiretype))), ErrFieldMode}
+}
+
+// fieldFound indicates whether a field was decoded.  The index must be valid.
+func (m *Machine) fieldFound(index int) bool {
+	return m.fieldmask[index>>6]&(1<<uint(index&63)) != 0
+}
+
 // reset internal machine state for processing a new message.
 func (m *Machine) reset(protobuf []byte) {
 	m.status = false
@@ -64,10 +229,21 @@ func (m *Machine) reset(protobuf []byte) {
 		m.fieldmask[i] = 0
 	}
 	if m.topfieldrep != nil {
-		for i := uint8(0); i <= m.maxarrindex; i++ {
+		for i := 0; i <= int(m.maxarrindex); i++ {
 			m.topfieldrep[i] = 0
 		}
 	}
+	for i := range m.loops {
+		m.loops[i] = loopState{elems: m.loops[i].elems[:0]}
+	}
+	m.loopback = false
+	m.looperr = nil
+}
+
+// loopState of a ModEach node.
+type loopState struct {
+	elems []uint64 // Bytes references of the elements.
+	next  int      // Index of the element which LoopNext visits next.
 }
 
 // repMapPool is a memory pool for use during protobuf message decoding.  It
@@ -0,0 +1,274 @@
+package pbf
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ninchat/pbf/field"
+	"github.com/ninchat/pbf/op"
+)
+
+// Matcher evaluates many programs against each message, decoding the message
+// only once.  The field sections of the programs are merged; programs whose
+// field specs are incompatible with each other, or which would exceed the
+// field count limit, are placed in separate decoding groups.  Programs with
+// loops decode the message by themselves.  A matcher can be used only by a
+// single goroutine at a time.
+type Matcher struct {
+	groups     []*Machine
+	entries    []matcherEntry
+	standalone int // Programs with loops.
+}
+
+type matcherEntry struct {
+	*Machine
+	group    int   // Negative if the program has loops.
+	fieldmap []int // Group field indexes by program field index.
+}
+
+// NewMatcher for a set of programs.  Programs are identified by their
+// positions.  The field section of a verified program can always be decoded by
+// a group of its own, so an error indicates a bug.
+func NewMatcher(programs ...*Program) (*Matcher, error) {
+	var (
+		groups     []*matcherGroup
+		entries    = make([]matcherEntry, len(programs))
+		standalone int
+	)
+
+	for id, p := range programs {
+		specs := splitFieldSection(p.fieldSection(), p.wide)
+
+		e := &entries[id]
+		e.Machine = NewMachine(p)
+		e.group = -1
+
+		if len(p.loops) > 0 {
+			standalone++
+			continue
+		}
+
+		for i, g := range groups {
+			if g.add(specs, p.fieldmode) {
+				e.group = i
+				break
+			}
+		}
+		if e.group < 0 {
+			g := newMatcherGroup()
+			if !g.add(specs, p.fieldmode) {
+				return nil, fmt.Errorf("pbf: field section of program %d cannot be decoded by a matcher group", id)
+			}
+			e.group = len(groups)
+			groups = append(groups, g)
+		}
+
+		g := groups[e.group]
+		e.fieldmap = make([]int, len(specs))
+		for i, spec := range specs {
+			e.fieldmap[i] = g.index[string(spec)]
+		}
+	}
+
+	m := &Matcher{
+		groups:     make([]*Machine, len(groups)),
+		entries:    entries,
+		standalone: standalone,
+	}
+
+	for i, g := range groups {
+		p, err := NewProgram(g.bytecode())
+		if err != nil {
+			return nil, err
+		}
+		copy(p.fieldmode, g.modes) // Scalars are not decoded into bytes fields.
+		m.groups[i] = NewMachine(p)
+	}
+
+	return m, nil
+}
+
+// Match a protobuf message, appending the ids of the passing programs to dst.
+// An error is returned if message decoding fails, but filtering is still
+// performed against the partially decoded message.  (The extent of partial
+// decoding may differ from that of individual Filter calls.)
+func (m *Matcher) Match(message []byte, dst []int) ([]int, error) {
+	var err error
+
+	for _, g := range m.groups {
+		g.reset(message)
+		if e := g.decode(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	for id := range m.entries {
+		e := &m.entries[id]
+
+		if e.group < 0 {
+			ok, ferr := e.Filter(message)
+			if ferr != nil && err == nil {
+				err = ferr
+			}
+			if ok {
+				dst = append(dst, id)
+			}
+			continue
+		}
+
+		g := m.groups[e.group]
+
+		e.reset(message)
+		for i, j := range e.fieldmap {
+			if g.fieldFound(j) {
+				e.fielddata[i] = g.fielddata[j]
+				e.fieldmask[i>>6] |= 1 << uint(i&63)
+				e.fieldtype[i] = g.fieldtype[j]
+			}
+		}
+
+		if e.evaluate() {
+			dst = append(dst, id)
+		}
+	}
+
+	return dst, err
+}
+
+// Machine of a program.  It can be used to retrieve field values after a Match
+// call.
+func (m *Matcher) Machine(id int) *Machine {
+	return m.entries[id].Machine
+}
+
+// GroupCount returns the number of times each message is decoded.
+func (m *Matcher) GroupCount() int {
+	return len(m.groups) + m.standalone
+}
+
+type matcherGroup struct {
+	specs [][]byte
+	modes []accessMode
+	index map[string]int
+	tree  map[int32]fieldSpec // Parsed specs.
+}
+
+func newMatcherGroup() *matcherGroup {
+	return &matcherGroup{
+		index: make(map[string]int),
+		tree:  make(map[int32]fieldSpec),
+	}
+}
+
+// add field specs to the group if they are compatible with the existing ones.
+// A field which is loaded as a scalar by one program and as bytes or as a
+// vector by another is incompatible.
+func (g *matcherGroup) add(specs [][]byte, modes []accessMode) bool {
+	var (
+		added      [][]byte
+		addedmodes []accessMode
+	)
+	seen := make(map[string]bool)
+
+	for i, spec := range specs {
+		if j, found := g.index[string(spec)]; found {
+			if !compatibleModes(g.modes[j], modes[i]) {
+				return false
+			}
+		} else if !seen[string(spec)] {
+			seen[string(spec)] = true
+			added = append(added, spec)
+			addedmodes = append(addedmodes, modes[i])
+		}
+	}
+
+	if len(added) > 0 {
+		if len(g.specs)+len(added) > maxFieldCount {
+			return false
+		}
+
+		var undo fieldSpecUndo
+		for i, spec := range added {
+			if _, err := parseFieldSpec(g.tree, spec, len(g.specs)+i, "", &undo); err != nil {
+				undo.revert()
+				return false
+			}
+		}
+	}
+
+	for i, spec := range specs {
+		if j, found := g.index[string(spec)]; found && g.modes[j] == accessUndefined {
+			g.modes[j] = modes[i]
+		}
+	}
+
+	for i, spec := range added {
+		g.index[string(spec)] = len(g.specs)
+		g.specs = append(g.specs, spec)
+		g.modes = append(g.modes, addedmodes[i])
+	}
+	return true
+}
+
+func compatibleModes(a, b accessMode) bool {
+	if a == accessUndefined || b == accessUndefined {
+		return true
+	}
+	return (a == accessScalar) == (b == accessScalar)
+}
+
+// bytecode of a program which decodes the group's fields.
+func (g *matcherGroup) bytecode() []byte {
+	wide := len(g.specs) > 255
+
+	b := []byte{'P', 'B', 'F', 0}
+	if wide {
+		b[3] = 1
+	}
+	b = append(b, encodeFieldSection(g.specs, wide)...)
+	return append(b, byte(op.ReturnTrue))
+}
+
+func encodeFieldSection(specs [][]byte, wide bool) []byte {
+	b := []byte{byte(len(specs))}
+	if wide {
+		b = append(b, byte(len(specs)>>8))
+	}
+	for _, spec := range specs {
+		b = append(b, spec...)
+	}
+	return b
+}
+
+// splitFieldSection of a verified program into encoded field specs.
+func splitFieldSection(buf []byte, wide bool) [][]byte {
+	var count int
+	if wide {
+		count = int(binary.LittleEndian.Uint16(buf))
+		buf = buf[2:]
+	} else {
+		count = int(buf[0])
+		buf = buf[1:]
+	}
+
+	specs := make([][]byte, count)
+
+	for i := range specs {
+		n := 0
+		for {
+			mod := field.Mod(buf[n+4])
+			n += 5
+			if mod == field.ModPacked {
+				n++
+			}
+			if mod.IsLeaf() {
+				break
+			}
+		}
+
+		specs[i] = buf[:n]
+		buf = buf[n:]
+	}
+
+	return specs
+}
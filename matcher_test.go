@@ -0,0 +1,240 @@
+package pbf_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/build"
+	"github.com/ninchat/pbf/expr"
+	"github.com/ninchat/pbf/field"
+	"github.com/ninchat/pbf/internal/test"
+	"github.com/ninchat/pbf/op"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func compileExpr(t testing.TB, src string) *pbf.Program {
+	x, err := expr.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytecode, err := expr.Compile(x, (&test.Test{}).ProtoReflect().Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prog
+}
+
+func TestMatcher(t *testing.T) {
+	var progs []*pbf.Program
+
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progs = append(progs, prog)
+
+	for _, src := range []string{
+		`a == 1 && b != 1`,
+		`a == 2`,
+		`n.x > 1000 && "PBF" == k`,
+		`4 in m && -3 in o.z`,
+		`q[2].x == 102 || q[3].x == 103`,
+		`has(s)`,
+		`e == -5 && o.z[0] == -3`,
+	} {
+		progs = append(progs, compileExpr(t, src))
+	}
+
+	// Field 15 is a packed repeated field elsewhere, which conflicts with a
+	// scalar interpretation.
+	b := build.New()
+	b.OpField(op.LoadR1FieldScalar, b.AddField(build.NewFieldSpec(15, field.ModMessage).Sub(1, field.ModZigZag)))
+	b.Op(op.LoadConstScalar0)
+	b.Op(op.CompareSignedNE)
+	b.Op(op.ReturnTrue)
+	conflict, err := b.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err = pbf.NewProgram(conflict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progs = append(progs, prog)
+
+	// Any element of q has x == 101.  Programs with loops aren't grouped.
+	b = build.New()
+	q := b.AddField(build.NewFieldSpec(17, 0))
+	x := b.AddField(build.NewFieldSpec(17, field.ModEach).Sub(1, 0))
+	loop := b.NewLabel()
+	exit := b.NewLabel()
+	next := b.NewLabel()
+	b.Mark(loop)
+	b.OpLoopNext(q, exit)
+	b.OpField(op.LoadR1FieldScalar, x)
+	b.LoadConstScalar(101)
+	b.Op(op.CompareSignedEQ)
+	b.OpSkip(op.SkipFalse, next)
+	b.Op(op.ReturnTrue)
+	b.Mark(next)
+	b.OpLoopBack(loop)
+	b.Mark(exit)
+	b.Op(op.ReturnFalse)
+	loopcode, err := b.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err = pbf.NewProgram(loopcode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progs = append(progs, prog)
+
+	// More than 255 fields in the first group.
+	for i := 0; i < 300; i++ {
+		progs = append(progs, compileExpr(t, fmt.Sprintf("q[%d].x == 102", i)))
+	}
+
+	m, err := pbf.NewMatcher(progs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := m.GroupCount(); n != 3 {
+		t.Error("group count:", n)
+	}
+
+	buf := test.Data()
+
+	var expect []int
+	for id, p := range progs {
+		ok, err := pbf.NewMachine(p).Filter(buf)
+		if err != nil {
+			t.Fatal(id, err)
+		}
+		if ok {
+			expect = append(expect, id)
+		}
+	}
+	if len(expect) != 9 {
+		t.Error(expect)
+	}
+
+	for i := 0; i < 2; i++ {
+		ids, err := m.Match(buf, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(ids, expect) {
+			t.Error(ids)
+		}
+	}
+
+	if v, found := m.Machine(0).GetRawValue(7); !found || v != 0x8000000000000008 {
+		t.Error(v, found)
+	}
+	if v, found, err := m.Machine(0).GetInt64(3); err != nil || !found || v != -4 {
+		t.Error(v, found, err)
+	}
+	if _, _, err := m.Machine(0).GetInt64(6); !errors.Is(err, pbf.ErrFieldMode) {
+		t.Error(err)
+	}
+}
+
+func TestMatcherRevert(t *testing.T) {
+	var progs []*pbf.Program
+
+	for _, specs := range [][]*build.FieldSpec{
+		{build.NewFieldSpec(15, field.ModMessage).SubPacked(1, protowire.VarintType).Sub(0, field.ModZigZag)},
+		{build.NewFieldSpec(20, 0), build.NewFieldSpec(15, field.ModMessage).Sub(1, field.ModZigZag)},
+		{build.NewFieldSpec(20, field.ModZigZag)},
+	} {
+		b := build.New()
+		for _, spec := range specs {
+			b.OpField(op.CheckField, b.AddField(spec))
+		}
+		b.Op(op.ReturnTrue)
+		bytecode, err := b.Bytecode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog, err := pbf.NewProgram(bytecode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		progs = append(progs, prog)
+	}
+
+	// The second program doesn't fit in the first group, and its field 20
+	// must not be left behind.
+	m, err := pbf.NewMatcher(progs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := m.GroupCount(); n != 2 {
+		t.Error("group count:", n)
+	}
+}
+
+func BenchmarkMatcher(b *testing.B) {
+	var progs []*pbf.Program
+	for i := 0; i < 1000; i++ {
+		progs = append(progs, compileExpr(b, fmt.Sprintf("a == %d && n.x > %d || %d in m", i%3, i, i%7)))
+	}
+
+	m, err := pbf.NewMatcher(progs...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := test.Data()
+	var ids []int
+
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var err error
+		ids, err = m.Match(buf, ids[:0])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewMatcher(b *testing.B) {
+	var progs []*pbf.Program
+	for i := 0; i < 2000; i++ {
+		bb := build.New()
+		bb.OpField(op.LoadR1FieldScalar, bb.AddField(build.NewFieldSpec(int32(1000+i), 0)))
+		bb.Op(op.LoadConstScalar0)
+		bb.Op(op.CompareUnsignedNE)
+		bb.Op(op.ReturnTrue)
+		bytecode, err := bb.Bytecode()
+		if err != nil {
+			b.Fatal(err)
+		}
+		prog, err := pbf.NewProgram(bytecode)
+		if err != nil {
+			b.Fatal(err)
+		}
+		progs = append(progs, prog)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m, err := pbf.NewMatcher(progs...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n := m.GroupCount(); n != 1 {
+			b.Fatal(n)
+		}
+	}
+}
@@ -3,6 +3,7 @@
 package op
 
 import (
+	"encoding/binary"
 	"fmt"
 )
 
@@ -91,8 +92,8 @@ const (
 	CompareBytesNE                      // Binary register.     [Cmp]
 	CompareBytesLE                      // Binary register.     [Cmp]
 	CompareBytesGT                      // Binary register.     [Cmp]
-	_                                   //
-	_                                   //
+	HasPrefixBytes                      // Binary register.
+	HasSuffixBytes                      // Binary register.
 	CompareFloatLT                      // Binary register.     [Cmp]
 	CompareFloatGE                      // Binary register.     [Cmp]
 	CompareFloatEQ                      // Binary register.     [Cmp]
@@ -104,11 +105,19 @@ const (
 	CompareFloatNaN                     // Unary register (R0).
 	_                                   //
 	_                                   //
-	_                                   //
+	ContainsBytes                       // Binary register.
 	ContainsVarint                      // Binary register.
 	ContainsZigZag                      // Binary register.
 	ContainsFixed64                     // Binary register.
 	ContainsFixed32                     // Binary register.
+	LengthR0Bytes                       // Unary register.     [Reg]
+	LengthR1Bytes                       // Unary register.     [Reg]
+	CountR0Varint                       // Unary register.     [Reg]
+	CountR1Varint                       // Unary register.     [Reg]
+	CountR0Fixed64                      // Unary register.     [Reg]
+	CountR1Fixed64                      // Unary register.     [Reg]
+	CountR0Fixed32                      // Unary register.     [Reg]
+	CountR1Fixed32                      // Unary register.     [Reg]
 )
 
 // Opcodes with a 1-byte argument.
@@ -120,6 +129,15 @@ const (
 	LoadR0FieldVector                   // Unary register; field index. [Reg]
 	LoadR1FieldVector                   // Unary register; field index. [Reg]
 	CheckField                          // Nullary; field index.
+	_                                   //
+	AnyVarint                           // Binary register; comparison opcode. [Option]
+	AllVarint                           // Binary register; comparison opcode. [Option]
+	AnyZigZag                           // Binary register; comparison opcode. [Option]
+	AllZigZag                           // Binary register; comparison opcode. [Option]
+	AnyFixed64                          // Binary register; comparison opcode. [Option]
+	AllFixed64                          // Binary register; comparison opcode. [Option]
+	AnyFixed32                          // Binary register; comparison opcode. [Option]
+	AllFixed32                          // Binary register; comparison opcode. [Option]
 )
 
 // Opcodes with a 2-byte argument.
@@ -129,13 +147,258 @@ const (
 	Skip                         // Nullary; instruction offset.
 )
 
+// Opcodes with a 2-byte field index argument.  They correspond to the opcodes
+// with a 1-byte argument (see Wide).
+const (
+	LoadR0FieldScalarWide = Code(iota + 144) // Unary register; field index. [Reg]
+	LoadR1FieldScalarWide                    // Unary register; field index. [Reg]
+	LoadR0FieldBytesWide                     // Unary register; field index. [Reg]
+	LoadR1FieldBytesWide                     // Unary register; field index. [Reg]
+	LoadR0FieldVectorWide                    // Unary register; field index. [Reg]
+	LoadR1FieldVectorWide                    // Unary register; field index. [Reg]
+	CheckFieldWide                           // Nullary; field index.
+)
+
+const wideFieldOffset = LoadR0FieldScalarWide - LoadR0FieldScalar
+
 // Opcodes with 8 bytes of argument data.
 const (
 	LoadConstScalar = Code(iota + 192) // Unary register (R0); immediate value.
 	_                                  //
 	LoadConstBytes                     // Unary register (R0); bytecode address and length.
+	_                                  //
+	SkipFalseLong                      // Nullary; instruction offset. [Option]
+	SkipTrueLong                       // Nullary; instruction offset. [Option]
+	SkipLong                           // Nullary; instruction offset.
+	_                                  //
+	LoopNext                           // Nullary; loop field index and exit offset.
+	LoopBack                           // Nullary; backward instruction offset.
 )
 
+const longSkipOffset = SkipFalseLong - SkipFalse
+
+var codeNames = [256]string{
+	CompareUnsignedLT:     "CompareUnsignedLT",
+	CompareUnsignedGE:     "CompareUnsignedGE",
+	CompareUnsignedEQ:     "CompareUnsignedEQ",
+	CompareUnsignedNE:     "CompareUnsignedNE",
+	CompareUnsignedLE:     "CompareUnsignedLE",
+	CompareUnsignedGT:     "CompareUnsignedGT",
+	LoadConstScalar0:      "LoadConstScalar0",
+	LoadConstScalar1:      "LoadConstScalar1",
+	CompareSignedLT:       "CompareSignedLT",
+	CompareSignedGE:       "CompareSignedGE",
+	CompareSignedEQ:       "CompareSignedEQ",
+	CompareSignedNE:       "CompareSignedNE",
+	CompareSignedLE:       "CompareSignedLE",
+	CompareSignedGT:       "CompareSignedGT",
+	ReturnFalse:           "ReturnFalse",
+	ReturnTrue:            "ReturnTrue",
+	CompareBytesLT:        "CompareBytesLT",
+	CompareBytesGE:        "CompareBytesGE",
+	CompareBytesEQ:        "CompareBytesEQ",
+	CompareBytesNE:        "CompareBytesNE",
+	CompareBytesLE:        "CompareBytesLE",
+	CompareBytesGT:        "CompareBytesGT",
+	HasPrefixBytes:        "HasPrefixBytes",
+	HasSuffixBytes:        "HasSuffixBytes",
+	CompareFloatLT:        "CompareFloatLT",
+	CompareFloatGE:        "CompareFloatGE",
+	CompareFloatEQ:        "CompareFloatEQ",
+	CompareFloatNE:        "CompareFloatNE",
+	CompareFloatLE:        "CompareFloatLE",
+	CompareFloatGT:        "CompareFloatGT",
+	CompareFloatInfPos:    "CompareFloatInfPos",
+	CompareFloatInfNeg:    "CompareFloatInfNeg",
+	CompareFloatNaN:       "CompareFloatNaN",
+	ContainsBytes:         "ContainsBytes",
+	ContainsVarint:        "ContainsVarint",
+	ContainsZigZag:        "ContainsZigZag",
+	ContainsFixed64:       "ContainsFixed64",
+	ContainsFixed32:       "ContainsFixed32",
+	LengthR0Bytes:         "LengthR0Bytes",
+	LengthR1Bytes:         "LengthR1Bytes",
+	CountR0Varint:         "CountR0Varint",
+	CountR1Varint:         "CountR1Varint",
+	CountR0Fixed64:        "CountR0Fixed64",
+	CountR1Fixed64:        "CountR1Fixed64",
+	CountR0Fixed32:        "CountR0Fixed32",
+	CountR1Fixed32:        "CountR1Fixed32",
+	LoadR0FieldScalar:     "LoadR0FieldScalar",
+	LoadR1FieldScalar:     "LoadR1FieldScalar",
+	LoadR0FieldBytes:      "LoadR0FieldBytes",
+	LoadR1FieldBytes:      "LoadR1FieldBytes",
+	LoadR0FieldVector:     "LoadR0FieldVector",
+	LoadR1FieldVector:     "LoadR1FieldVector",
+	CheckField:            "CheckField",
+	AnyVarint:             "AnyVarint",
+	AllVarint:             "AllVarint",
+	AnyZigZag:             "AnyZigZag",
+	AllZigZag:             "AllZigZag",
+	AnyFixed64:            "AnyFixed64",
+	AllFixed64:            "AllFixed64",
+	AnyFixed32:            "AnyFixed32",
+	AllFixed32:            "AllFixed32",
+	SkipFalse:             "SkipFalse",
+	SkipTrue:              "SkipTrue",
+	Skip:                  "Skip",
+	LoadR0FieldScalarWide: "LoadR0FieldScalarWide",
+	LoadR1FieldScalarWide: "LoadR1FieldScalarWide",
+	LoadR0FieldBytesWide:  "LoadR0FieldBytesWide",
+	LoadR1FieldBytesWide:  "LoadR1FieldBytesWide",
+	LoadR0FieldVectorWide: "LoadR0FieldVectorWide",
+	LoadR1FieldVectorWide: "LoadR1FieldVectorWide",
+	CheckFieldWide:        "CheckFieldWide",
+	LoadConstScalar:       "LoadConstScalar",
+	LoadConstBytes:        "LoadConstBytes",
+	SkipFalseLong:         "SkipFalseLong",
+	SkipTrueLong:          "SkipTrueLong",
+	SkipLong:              "SkipLong",
+	LoopNext:              "LoopNext",
+	LoopBack:              "LoopBack",
+}
+
+func (op Code) String() string {
+	if s := codeNames[op]; s != "" {
+		return s
+	}
+	return fmt.Sprintf("<invalid op.Code value %d>", op)
+}
+
+// IsValid value?
+func (op Code) IsValid() bool {
+	return codeNames[op] != ""
+}
+
+// ParseCode looks up an opcode by its name.
+func ParseCode(name string) (Code, bool) {
+	for op, s := range codeNames {
+		if s == name && s != "" {
+			return Code(op), true
+		}
+	}
+	return 0, false
+}
+
+// Size of the encoded instruction.
+func (op Code) Size() int {
+	switch {
+	case op < 64:
+		return 1
+	case op < 128:
+		return 1 + 1
+	case op < 192:
+		return 1 + 2
+	default:
+		return 1 + 8
+	}
+}
+
+// Arg decodes the argument of an instruction.  The buffer starts after the
+// opcode, and it must hold at least Size()-1 bytes.  The argument of an opcode
+// without arguments is zero.
+func (op Code) Arg(b []byte) uint64 {
+	switch {
+	case op < 64:
+		return 0
+	case op < 128:
+		return uint64(b[0])
+	case op < 192:
+		return uint64(binary.LittleEndian.Uint16(b))
+	default:
+		return binary.LittleEndian.Uint64(b)
+	}
+}
+
+// Wide opcode corresponding to a field opcode with a 1-byte argument.  Other
+// opcodes are returned as is.
+func (op Code) Wide() Code {
+	if op >= LoadR0FieldScalar && op <= CheckField {
+		return op + wideFieldOffset
+	}
+	return op
+}
+
+// Narrow opcode corresponding to a field opcode with a 2-byte argument.  Other
+// opcodes are returned as is.
+func (op Code) Narrow() Code {
+	if op >= LoadR0FieldScalarWide && op <= CheckFieldWide {
+		return op - wideFieldOffset
+	}
+	return op
+}
+
+// Long opcode corresponding to a skip opcode with a 2-byte argument.  Other
+// opcodes are returned as is.
+func (op Code) Long() Code {
+	if op >= SkipFalse && op <= Skip {
+		return op + longSkipOffset
+	}
+	return op
+}
+
+// Short opcode corresponding to a skip opcode with an 8-byte argument.  Other
+// opcodes are returned as is.
+func (op Code) Short() Code {
+	if op >= SkipFalseLong && op <= SkipLong {
+		return op - longSkipOffset
+	}
+	return op
+}
+
+// IsSkip indicates whether the argument is an instruction offset.
+func (op Code) IsSkip() bool {
+	op = op.Short()
+	return op >= SkipFalse && op <= Skip
+}
+
+// Continues indicates whether execution may continue to the next instruction.
+func (op Code) Continues() bool {
+	switch op.Short() {
+	case ReturnFalse, ReturnTrue, Skip, LoopBack:
+		return false
+	default:
+		return true
+	}
+}
+
+// SetsStatus indicates whether the instruction sets the status flag which is
+// tested by SkipFalse and SkipTrue.
+func (op Code) SetsStatus() bool {
+	switch op.Narrow() {
+	case LoadConstScalar0, LoadConstScalar1, ReturnFalse, ReturnTrue:
+		return false
+	case CheckField:
+		return true
+	default:
+		return (op < 64 && !op.IsCount()) || op.IsQuantifier()
+	}
+}
+
+// IsCompare indicates whether the opcode compares R1 with R0 (CompareUnsignedLT
+// etc.).
+func (op Code) IsCompare() bool {
+	return op < CompareFloatNaN && op.Cmp().IsValid()
+}
+
+// IsCount indicates whether the opcode replaces the bytes or the vector in a
+// register with its length or element count (LengthR0Bytes etc.).
+func (op Code) IsCount() bool {
+	return op >= LengthR0Bytes && op <= CountR1Fixed32
+}
+
+// IsQuantifier indicates whether the argument is a comparison opcode which is
+// applied to the elements of a packed vector (AnyVarint etc.).
+func (op Code) IsQuantifier() bool {
+	return op >= AnyVarint && op <= AllFixed32
+}
+
+// HasFieldIndex indicates whether the argument is a field index.
+func (op Code) HasFieldIndex() bool {
+	op = op.Narrow()
+	return op >= LoadR0FieldScalar && op <= CheckField
+}
+
 // Option operand.
 func (op Code) Option() bool {
 	if op&1 == 0 {
@@ -153,3 +416,167 @@ func (op Code) Reg() Reg {
 func (op Code) Cmp() Cmp {
 	return Cmp(op & 7)
 }
+
+// Kind of comparison operation.
+func (op Code) Kind() ValueKind {
+	return ValueKind(op &^ 7)
+}
+
+// Encoding of the vector elements of a Contains or quantifier opcode.
+func (op Code) Encoding() ScalarEncoding {
+	if op.IsQuantifier() {
+		return ScalarEncoding((op - AnyVarint) >> 1)
+	}
+	return ScalarEncoding(op - ContainsVarint)
+}
+
+// ValueKind determines the comparison opcode family.
+type ValueKind byte
+
+// Value kinds.
+const (
+	Unsigned = ValueKind(CompareUnsignedLT)
+	Signed   = ValueKind(CompareSignedLT)
+	Bytes    = ValueKind(CompareBytesLT)
+	Float    = ValueKind(CompareFloatLT)
+)
+
+func (kind ValueKind) String() string {
+	switch kind {
+	case Unsigned:
+		return "Unsigned"
+	case Signed:
+		return "Signed"
+	case Bytes:
+		return "Bytes"
+	case Float:
+		return "Float"
+	default:
+		return fmt.Sprintf("<invalid op.ValueKind value %d>", kind)
+	}
+}
+
+// FieldKind determines the field loading opcode family.
+type FieldKind byte
+
+// Field kinds.
+const (
+	FieldScalar = FieldKind(LoadR0FieldScalar - LoadR0FieldScalar)
+	FieldBytes  = FieldKind(LoadR0FieldBytes - LoadR0FieldScalar)
+	FieldVector = FieldKind(LoadR0FieldVector - LoadR0FieldScalar)
+)
+
+func (kind FieldKind) String() string {
+	switch kind {
+	case FieldScalar:
+		return "Scalar"
+	case FieldBytes:
+		return "Bytes"
+	case FieldVector:
+		return "Vector"
+	default:
+		return fmt.Sprintf("<invalid op.FieldKind value %d>", kind)
+	}
+}
+
+// ScalarEncoding of packed vector elements.
+type ScalarEncoding byte
+
+// Scalar encodings.
+const (
+	Varint  = ScalarEncoding(ContainsVarint - ContainsVarint)
+	ZigZag  = ScalarEncoding(ContainsZigZag - ContainsVarint)
+	Fixed64 = ScalarEncoding(ContainsFixed64 - ContainsVarint)
+	Fixed32 = ScalarEncoding(ContainsFixed32 - ContainsVarint)
+)
+
+func (enc ScalarEncoding) String() string {
+	switch enc {
+	case Varint:
+		return "Varint"
+	case ZigZag:
+		return "ZigZag"
+	case Fixed64:
+		return "Fixed64"
+	case Fixed32:
+		return "Fixed32"
+	default:
+		return fmt.Sprintf("<invalid op.ScalarEncoding value %d>", enc)
+	}
+}
+
+// Compare opcode.
+func Compare(kind ValueKind, cmp Cmp) Code {
+	return Code(kind) + Code(cmp)
+}
+
+// LoadConstScalarBool opcode.
+func LoadConstScalarBool(bit bool) Code {
+	return LoadConstScalar0 + boolCode(bit)
+}
+
+// Return opcode.
+func Return(status bool) Code {
+	return ReturnFalse + boolCode(status)
+}
+
+// CompareFloatInf opcode.
+func CompareFloatInf(negative bool) Code {
+	return CompareFloatInfPos + boolCode(negative)
+}
+
+// Contains opcode.
+func Contains(enc ScalarEncoding) Code {
+	return ContainsVarint + Code(enc)
+}
+
+// Length opcode.
+func Length(r Reg) Code {
+	return LengthR0Bytes + Code(r)
+}
+
+// Count opcode.  Varint and zigzag elements are counted alike.
+func Count(r Reg, enc ScalarEncoding) Code {
+	switch enc {
+	case Varint, ZigZag:
+		return CountR0Varint + Code(r)
+	case Fixed64:
+		return CountR0Fixed64 + Code(r)
+	default:
+		return CountR0Fixed32 + Code(r)
+	}
+}
+
+// Quantifier opcode.  The comparison is true for any element, or for all
+// elements.
+func Quantifier(enc ScalarEncoding, all bool) Code {
+	return AnyVarint + Code(enc)<<1 + boolCode(all)
+}
+
+// LoadField opcode.
+func LoadField(r Reg, kind FieldKind) Code {
+	return LoadR0FieldScalar + Code(kind) + Code(r)
+}
+
+// LoopNextArg encodes the argument of LoopNext.  The exit offset is relative
+// to the end of the instruction, like the offsets of skip instructions.
+func LoopNextArg(index int, exit uint32) uint64 {
+	return uint64(exit) | uint64(index)<<32
+}
+
+// SplitLoopNextArg decodes the argument of LoopNext.
+func SplitLoopNextArg(arg uint64) (index int, exit uint32) {
+	return int(arg >> 32), uint32(arg)
+}
+
+// SkipIf opcode.
+func SkipIf(status bool) Code {
+	return SkipFalse + boolCode(status)
+}
+
+func boolCode(b bool) Code {
+	if b {
+		return 1
+	}
+	return 0
+}
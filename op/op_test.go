@@ -29,6 +29,12 @@ func TestOptions(t *testing.T) {
 	if !SkipTrue.Option() {
 		t.Error(1)
 	}
+	if SkipFalseLong.Option() {
+		t.Error(1)
+	}
+	if !SkipTrueLong.Option() {
+		t.Error(1)
+	}
 }
 
 func TestRegs(t *testing.T) {
@@ -126,3 +132,174 @@ func TestCmps(t *testing.T) {
 		t.Error(1)
 	}
 }
+
+func TestNames(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		op := Code(i)
+		if !op.IsValid() {
+			continue
+		}
+		if x, ok := ParseCode(op.String()); !ok || x != op {
+			t.Error(op, x, ok)
+		}
+	}
+
+	if Code(0xff).IsValid() {
+		t.Error(0xff)
+	}
+	if _, ok := ParseCode(""); ok {
+		t.Error("empty name")
+	}
+	if op, ok := ParseCode("LoadR1FieldScalar"); !ok || op != LoadR1FieldScalar {
+		t.Error(op, ok)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	if ReturnTrue.Size() != 1 {
+		t.Error(ReturnTrue.Size())
+	}
+	if CheckField.Size() != 2 {
+		t.Error(CheckField.Size())
+	}
+	if Skip.Size() != 3 {
+		t.Error(Skip.Size())
+	}
+	if LoadConstBytes.Size() != 9 {
+		t.Error(LoadConstBytes.Size())
+	}
+	if CheckFieldWide.Size() != 3 {
+		t.Error(CheckFieldWide.Size())
+	}
+	if SkipLong.Size() != 9 {
+		t.Error(SkipLong.Size())
+	}
+	if LoopNext.Size() != 9 {
+		t.Error(LoopNext.Size())
+	}
+}
+
+func TestArgs(t *testing.T) {
+	b := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	if ReturnTrue.Arg(nil) != 0 {
+		t.Error(ReturnTrue.Arg(nil))
+	}
+	if CheckField.Arg(b) != 1 {
+		t.Error(CheckField.Arg(b))
+	}
+	if CheckFieldWide.Arg(b) != 0x0201 {
+		t.Error(CheckFieldWide.Arg(b))
+	}
+	if LoopNext.Arg(b) != 0x0807060504030201 {
+		t.Error(LoopNext.Arg(b))
+	}
+}
+
+func TestControlFlow(t *testing.T) {
+	for _, code := range []Code{ReturnFalse, ReturnTrue, Skip, SkipLong, LoopBack} {
+		if code.Continues() {
+			t.Error(code)
+		}
+	}
+	for _, code := range []Code{SkipFalse, SkipTrueLong, LoopNext, CheckField} {
+		if !code.Continues() {
+			t.Error(code)
+		}
+	}
+
+	for _, code := range []Code{CompareUnsignedLT, CompareFloatNaN, HasPrefixBytes, ContainsVarint, AnyVarint, CheckField, CheckFieldWide} {
+		if !code.SetsStatus() {
+			t.Error(code)
+		}
+	}
+	for _, code := range []Code{LoadConstScalar0, LoadConstScalar1, ReturnTrue, LengthR0Bytes, LoadR0FieldScalar, LoadConstScalar, Skip, LoopNext} {
+		if code.SetsStatus() {
+			t.Error(code)
+		}
+	}
+}
+
+func TestVariants(t *testing.T) {
+	for narrow := LoadR0FieldScalar; narrow <= CheckField; narrow++ {
+		wide := narrow.Wide()
+		if wide == narrow || wide.Narrow() != narrow || !wide.HasFieldIndex() || !narrow.HasFieldIndex() {
+			t.Error(narrow, wide)
+		}
+		if narrow != CheckField && wide.Reg() != narrow.Reg() {
+			t.Error(narrow, wide)
+		}
+	}
+	for short := SkipFalse; short <= Skip; short++ {
+		long := short.Long()
+		if long == short || long.Short() != short || !long.IsSkip() || !short.IsSkip() {
+			t.Error(short, long)
+		}
+	}
+	for _, code := range []Code{ReturnTrue, LoadConstBytes, Skip, SkipLong} {
+		if code.Wide() != code || code.Narrow() != code || code.HasFieldIndex() {
+			t.Error(code)
+		}
+	}
+	for _, code := range []Code{ReturnTrue, LoadConstBytes, CheckField, CheckFieldWide} {
+		if code.Long() != code || code.Short() != code || code.IsSkip() {
+			t.Error(code)
+		}
+	}
+}
+
+func TestConstructors(t *testing.T) {
+	if code := Count(R0, ZigZag); code != CountR0Varint || !code.IsCount() || code.Reg() != R0 {
+		t.Error(code)
+	}
+	if code := Count(R1, Fixed32); code != CountR1Fixed32 || code.Reg() != R1 {
+		t.Error(code)
+	}
+	if code := Length(R1); code != LengthR1Bytes || !code.IsCount() || code.IsCompare() {
+		t.Error(code)
+	}
+	if code := Quantifier(Fixed32, true); code != AllFixed32 || code.Encoding() != Fixed32 || !code.Option() {
+		t.Error(code)
+	}
+	if code := Quantifier(ZigZag, false); code != AnyZigZag || code.Encoding() != ZigZag || code.Option() {
+		t.Error(code)
+	}
+	if ContainsFixed64.Encoding() != Fixed64 {
+		t.Error(ContainsFixed64.Encoding())
+	}
+	if !CompareFloatGT.IsCompare() || CompareFloatGT.Kind() != Float || CompareFloatNaN.IsCompare() || ReturnTrue.IsCompare() {
+		t.Error("IsCompare")
+	}
+	for _, code := range []Code{HasPrefixBytes, HasSuffixBytes, ContainsBytes} {
+		if code.IsCompare() || code.IsCount() || code.Size() != 1 {
+			t.Error(code)
+		}
+	}
+	if index, exit := SplitLoopNextArg(LoopNextArg(300, 0xfffffffe)); index != 300 || exit != 0xfffffffe {
+		t.Error(index, exit)
+	}
+	if Compare(Signed, CmpLE) != CompareSignedLE {
+		t.Error(Compare(Signed, CmpLE))
+	}
+	if Compare(Float, CmpGT) != CompareFloatGT {
+		t.Error(Compare(Float, CmpGT))
+	}
+	if LoadConstScalarBool(true) != LoadConstScalar1 {
+		t.Error(LoadConstScalarBool(true))
+	}
+	if Return(false) != ReturnFalse {
+		t.Error(Return(false))
+	}
+	if CompareFloatInf(true) != CompareFloatInfNeg {
+		t.Error(CompareFloatInf(true))
+	}
+	if Contains(Fixed32) != ContainsFixed32 {
+		t.Error(Contains(Fixed32))
+	}
+	if LoadField(R1, FieldVector) != LoadR1FieldVector {
+		t.Error(LoadField(R1, FieldVector))
+	}
+	if SkipIf(true) != SkipTrue {
+		t.Error(SkipIf(true))
+	}
+}
@@ -5,6 +5,7 @@ from struct import pack
 from typing import List, Optional, Union
 
 BYTECODE_HEADER = b"PBF\0"
+BYTECODE_HEADER_WIDE = b"PBF\1"
 
 
 class FieldMod(IntEnum):
@@ -14,10 +15,12 @@ class FieldMod(IntEnum):
     Packed = 3
     Message = 4
     Repeated = 5
+    Each = 6
+    Count = 7
 
     @property
     def leaf(self) -> bool:
-        return self <= self.Float
+        return self <= self.Float or self == self.Count
 
 
 class FieldType(IntEnum):
@@ -44,13 +47,13 @@ class FieldSpec:
             num: int,
             mod: FieldMod = FieldMod.Default,
             subtype: Optional[FieldType] = None) -> 'FieldSpec':
-        assert self.mod in (FieldMod.Packed, FieldMod.Message, FieldMod.Repeated)
+        assert self.mod in (FieldMod.Packed, FieldMod.Message, FieldMod.Repeated, FieldMod.Each)
         child = FieldSpec(num, mod, subtype)
         child.parent = self
         return child
 
     def encode(self) -> bytes:
-        assert self.mod not in (FieldMod.Packed, FieldMod.Message, FieldMod.Repeated)
+        assert self.mod not in (FieldMod.Packed, FieldMod.Message, FieldMod.Repeated, FieldMod.Each)
         b = b""
         f = self
         while f:
@@ -62,12 +65,15 @@ class FieldSpec:
         return b
 
 
-def encode_field_section_header(field_count: int) -> bytes:
+def encode_field_section_header(field_count: int, wide: bool = False) -> bytes:
+    "The wide format (BYTECODE_HEADER_WIDE) supports up to 65535 fields."
+    if wide:
+        return pack("<H", field_count)
     return pack("<B", field_count)
 
 
-def encode_field_section(fields: List[FieldSpec]) -> bytes:
-    b = encode_field_section_header(len(fields))
+def encode_field_section(fields: List[FieldSpec], wide: bool = False) -> bytes:
+    b = encode_field_section_header(len(fields), wide)
     for f in fields:
         b += f.encode()
     return b
@@ -134,6 +140,8 @@ class Op(IntEnum):
     CompareBytesNE = 19
     CompareBytesLE = 20
     CompareBytesGT = 21
+    HasPrefixBytes = 22
+    HasSuffixBytes = 23
     CompareFloatLT = 24
     CompareFloatGE = 25
     CompareFloatEQ = 26
@@ -143,10 +151,19 @@ class Op(IntEnum):
     CompareFloatInfPos = 30
     CompareFloatInfNeg = 31
     CompareFloatNaN = 32
+    ContainsBytes = 35
     ContainsVarint = 36
     ContainsZigZag = 37
     ContainsFixed64 = 38
     ContainsFixed32 = 39
+    LengthR0Bytes = 40
+    LengthR1Bytes = 41
+    CountR0Varint = 42
+    CountR1Varint = 43
+    CountR0Fixed64 = 44
+    CountR1Fixed64 = 45
+    CountR0Fixed32 = 46
+    CountR1Fixed32 = 47
     LoadR0FieldScalar = 64
     LoadR1FieldScalar = 65
     LoadR0FieldBytes = 66
@@ -154,11 +171,31 @@ class Op(IntEnum):
     LoadR0FieldVector = 68
     LoadR1FieldVector = 69
     CheckField = 70
+    AnyVarint = 72
+    AllVarint = 73
+    AnyZigZag = 74
+    AllZigZag = 75
+    AnyFixed64 = 76
+    AllFixed64 = 77
+    AnyFixed32 = 78
+    AllFixed32 = 79
     SkipFalse = 128
     SkipTrue = 129
     Skip = 130
+    LoadR0FieldScalarWide = 144
+    LoadR1FieldScalarWide = 145
+    LoadR0FieldBytesWide = 146
+    LoadR1FieldBytesWide = 147
+    LoadR0FieldVectorWide = 148
+    LoadR1FieldVectorWide = 149
+    CheckFieldWide = 150
     LoadConstScalar = 192
     LoadConstBytes = 194
+    SkipFalseLong = 196
+    SkipTrueLong = 197
+    SkipLong = 198
+    LoopNext = 200
+    LoopBack = 201
 
     @classmethod
     def compare_(cls, kind: ValueKind, cmp: Cmp) -> 'Op':
@@ -187,14 +224,41 @@ class Op(IntEnum):
         return cls(cls.ContainsVarint + enc)
 
     @classmethod
-    def load_field_(cls, reg: Reg, kind: FieldKind) -> 'Op':
+    def length_(cls, reg: Reg) -> 'Op':
+        assert reg in (R0, R1)
+        return cls(cls.LengthR0Bytes + reg)
+
+    @classmethod
+    def count_(cls, reg: Reg, enc: ScalarEncoding) -> 'Op':
+        "Varint and zigzag elements are counted alike."
+        assert reg in (R0, R1)
+        assert isinstance(enc, ScalarEncoding)
+        if enc in (ScalarEncoding.Varint, ScalarEncoding.ZigZag):
+            return cls(cls.CountR0Varint + reg)
+        elif enc == ScalarEncoding.Fixed64:
+            return cls(cls.CountR0Fixed64 + reg)
+        return cls(cls.CountR0Fixed32 + reg)
+
+    @classmethod
+    def quantifier_(cls, enc: ScalarEncoding, all: bool) -> 'Op':
+        "The argument is a comparison opcode."
+        assert isinstance(enc, ScalarEncoding)
+        assert all in (False, True)
+        return cls(cls.AnyVarint + (enc << 1) + all)
+
+    @classmethod
+    def load_field_(cls, reg: Reg, kind: FieldKind, wide: bool = False) -> 'Op':
         assert reg in (R0, R1)
         assert isinstance(kind, FieldKind)
+        if wide:
+            return cls(cls.LoadR0FieldScalarWide + reg + kind)
         return cls(cls.LoadR0FieldScalar + reg + kind)
 
     @classmethod
-    def skip_(cls, status: bool) -> 'Op':
+    def skip_(cls, status: bool, long: bool = False) -> 'Op':
         assert status in (False, True)
+        if long:
+            return cls(cls.SkipFalseLong + status)
         return cls(cls.SkipFalse + status)
 
     @classmethod
@@ -241,6 +305,13 @@ class Op(IntEnum):
         return pack("B", self) + arg
 
 
+def loop_next_arg(index: int, exit: int) -> int:
+    "Form an argument for the LoopNext op."
+    assert index in range(0, 1 << 16)
+    assert exit in range(0, 1 << 32)
+    return (index << 32) | exit
+
+
 def const_bytes_ref(offset: int, length: int) -> int:
     "Form an argument for the LoadConstBytes op."
     assert isinstance(offset, int)
@@ -276,3 +347,18 @@ if __name__ == "__main__":
 
     assert Op.load_field_(1, FieldKind.Bytes).size == 2
     assert Op.load_field_(1, FieldKind.Bytes).encode(42) == b"\x43\x2a"
+
+    assert Op.skip_(True, long=True).encode(0x10000) == b"\xc5\x00\x00\x01\x00\x00\x00\x00\x00"
+
+    assert encode_field_section_header(300, wide=True) == b"\x2c\x01"
+
+    assert Op.load_field_(1, FieldKind.Bytes, wide=True).size == 3
+    assert Op.load_field_(1, FieldKind.Bytes, wide=True).encode(300) == b"\x93\x2c\x01"
+
+    assert Op.LoopNext.encode(loop_next_arg(1, 34)) == b"\xc8\x22\x00\x00\x00\x01\x00\x00\x00"
+
+    assert Op.quantifier_(ScalarEncoding.Fixed32, all=True).encode(Op.CompareFloatGT) == b"\x4f\x1d"
+
+    assert FieldMod.Count.leaf
+    assert Op.count_(R1, ScalarEncoding.ZigZag) == Op.CountR1Varint
+    assert Op.HasSuffixBytes.size == 1
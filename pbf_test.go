@@ -1,11 +1,15 @@
 package pbf_test
 
 import (
-	"io/ioutil"
+	"errors"
+	"math"
+	"reflect"
 	"testing"
 
 	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/asm"
 	"github.com/ninchat/pbf/field"
+	"github.com/ninchat/pbf/internal/test"
 	"github.com/ninchat/pbf/op"
 	"google.golang.org/protobuf/encoding/protowire"
 )
@@ -126,7 +130,7 @@ var bytecode = []byte{
 	byte(op.ReturnFalse),
 
 	byte(op.LoadR1FieldBytes), 10, // Tag 11.
-	byte(op.LoadConstBytes), 0, 0, 0, 0, 3, 0, 0, 0, // "PBF"
+	byte(op.LoadConstBytes), 2, 2, 0, 0, 3, 0, 0, 0, // "PBF"
 	byte(op.CompareBytesEQ),
 	byte(op.SkipTrue), 1, 0,
 	byte(op.ReturnFalse),
@@ -217,15 +221,11 @@ var bytecode = []byte{
 
 	byte(op.ReturnTrue),
 
-	// End of instruction-and-constant section.
-}
+	// Constant data after the last instruction:
 
-func getTestData() []byte {
-	buf, err := ioutil.ReadFile("internal/testdata/test.buf")
-	if err != nil {
-		panic(err)
-	}
-	return buf
+	'P', 'B', 'F',
+
+	// End of instruction-and-constant section.
 }
 
 func TestPBF(t *testing.T) {
@@ -235,7 +235,7 @@ func TestPBF(t *testing.T) {
 	}
 
 	mach := pbf.NewMachine(prog)
-	buf := getTestData()
+	buf := test.Data()
 
 	ok, err := mach.Filter(buf)
 	if err != nil {
@@ -256,6 +256,326 @@ func TestPBF(t *testing.T) {
 	}
 }
 
+func TestMalformedProgram(t *testing.T) {
+	for name, c := range map[string]struct {
+		bytecode []byte
+		err      error
+		offset   int
+		opcode   op.Code // Zero if the error isn't about an instruction.
+	}{
+		"truncated header":     {[]byte{'P', 'B', 'F'}, pbf.ErrBytecodeInvalid, 0, 0},
+		"unknown format":       {[]byte{'P', 'B', 'F', 2, 0}, pbf.ErrBytecodeFormat, 0, 0},
+		"no instructions":      {[]byte{'P', 'B', 'F', 0, 0}, pbf.ErrBytecodeInvalid, 5, 0},
+		"no Return":            {[]byte{'P', 'B', 'F', 0, 0, byte(op.LoadConstScalar1)}, pbf.ErrBytecodeInvalid, 5, op.LoadConstScalar1},
+		"truncated argument":   {[]byte{'P', 'B', 'F', 0, 0, byte(op.LoadConstScalar), 1, 0, 0}, pbf.ErrBytecodeInvalid, 5, op.LoadConstScalar},
+		"truncated field spec": {[]byte{'P', 'B', 'F', 0, 1, 1, 0, 0}, pbf.ErrBytecodeInvalid, 5, 0},
+		"invalid field spec":   {[]byte{'P', 'B', 'F', 0, 2, 1, 0, 0, 0, 0, 2, 0, 0, 0, 0xff}, pbf.ErrBytecodeInvalid, 15, 0},
+		"skip to the end":      {[]byte{'P', 'B', 'F', 0, 0, byte(op.Skip), 1, 0, byte(op.ReturnTrue)}, pbf.ErrBytecodeInvalid, 5, op.Skip},
+		"skip past the end":    {[]byte{'P', 'B', 'F', 0, 0, byte(op.SkipTrue), 0xff, 0xff, byte(op.ReturnTrue)}, pbf.ErrBytecodeInvalid, 5, op.SkipTrue},
+		"long skip past the end": {
+			[]byte{
+				'P', 'B', 'F', 0, 0,
+				byte(op.SkipLong), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				byte(op.ReturnTrue),
+			},
+			pbf.ErrBytecodeInvalid, 5, op.SkipLong,
+		},
+		"constant in header": {
+			[]byte{
+				'P', 'B', 'F', 0, 0,
+				byte(op.LoadConstBytes), 0, 0, 0, 0, 3, 0, 0, 0,
+				byte(op.ReturnTrue),
+			},
+			pbf.ErrBytecodeInvalid, 5, op.LoadConstBytes,
+		},
+		"constant past the end": {
+			[]byte{
+				'P', 'B', 'F', 0, 0,
+				byte(op.LoadConstBytes), 14, 0, 0, 0, 2, 0, 0, 0,
+				byte(op.ReturnTrue),
+			},
+			pbf.ErrBytecodeInvalid, 5, op.LoadConstBytes,
+		},
+		"register mismatch": {
+			[]byte{
+				'P', 'B', 'F', 0, 0,
+				byte(op.LoadConstScalar1),
+				byte(op.LoadConstScalar0),
+				byte(op.CompareBytesEQ),
+				byte(op.ReturnTrue),
+			},
+			pbf.ErrBytecodeInvalid, 7, op.CompareBytesEQ,
+		},
+		"unknown opcode": {[]byte{'P', 'B', 'F', 0, 0, 0xff}, pbf.ErrBytecodeInvalid, 5, 0xff},
+	} {
+		_, err := pbf.NewProgram(c.bytecode)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		var e *pbf.BytecodeError
+		if !errors.As(err, &e) {
+			t.Errorf("%s: %T", name, err)
+			continue
+		}
+		if e.Offset != c.offset || e.Instruction != (c.opcode != 0) || e.Opcode != c.opcode {
+			t.Errorf("%s: %#v", name, e)
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loopProg, err := asm.Assemble([]byte(`
+	.field q 17
+	.field x 17.Each 1
+
+loop:	LoopNext q @done
+	LoopBack @loop
+done:	ReturnTrue
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loop, err := pbf.NewProgram(loopProg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]struct {
+		prog     *pbf.Program
+		message  []byte
+		err      error
+		offset   int
+		path     []protowire.Number
+		wiretype protowire.Type
+	}{
+		"truncated tag": {
+			prog, []byte{0x08, 0x01, 0x80},
+			pbf.ErrProtobufInvalid, 2, nil, 0,
+		},
+		"group": {
+			prog, []byte{0x08, 0x01, 0x1b},
+			pbf.ErrProtobufDeprecated, 2, []protowire.Number{3}, protowire.StartGroupType,
+		},
+		"message as varint": {
+			prog, []byte{0x70, 0x01},
+			pbf.ErrProtobufFieldType, 0, []protowire.Number{14}, protowire.VarintType,
+		},
+		"scalar in bytes field": {
+			prog, []byte{0x08, 0x01, 0x58, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01},
+			pbf.ErrProtobufFieldType, 2, []protowire.Number{11}, protowire.VarintType,
+		},
+		"truncated nested varint": {
+			prog, []byte{0x08, 0x01, 0x72, 0x02, 0x10, 0x80},
+			pbf.ErrProtobufInvalid, 4, []protowire.Number{14, 2}, protowire.VarintType,
+		},
+		"truncated nested tag": {
+			// Only the third occurrence of field 17 is specified.
+			prog, []byte{0x08, 0x01, 0x8a, 0x01, 0x00, 0x8a, 0x01, 0x00, 0x8a, 0x01, 0x01, 0x80},
+			pbf.ErrProtobufInvalid, 11, []protowire.Number{17}, protowire.BytesType,
+		},
+		"truncated loop element varint": {
+			loop, []byte{0x8a, 0x01, 0x02, 0x08, 0x80},
+			pbf.ErrProtobufInvalid, 3, []protowire.Number{17, 1}, protowire.VarintType,
+		},
+	} {
+		_, err := pbf.NewMachine(c.prog).Filter(c.message)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		var e *pbf.DecodeError
+		if !errors.As(err, &e) {
+			t.Errorf("%s: %T", name, err)
+			continue
+		}
+		if e.Offset != c.offset || !reflect.DeepEqual(e.FieldPath, c.path) || (len(c.path) > 0 && e.WireType != c.wiretype) {
+			t.Errorf("%s: %#v", name, e)
+		}
+	}
+}
+
+func TestOverlappingInstructions(t *testing.T) {
+	// SkipFalse jumps to the argument of LoadConstScalar, which is ReturnTrue.
+	prog, err := pbf.NewProgram([]byte{
+		'P', 'B', 'F', 0, 0,
+		byte(op.SkipFalse), 1, 0,
+		byte(op.LoadConstScalar), byte(op.ReturnTrue), 0, 0, 0, 0, 0, 0, 0,
+		byte(op.ReturnFalse),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := pbf.NewMachine(prog).Filter(nil); err != nil || !ok {
+		t.Error(ok, err)
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mach := pbf.NewMachine(prog)
+	if _, err := mach.Filter(test.Data()); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, found, err := mach.GetUint64(1); err != nil || !found || v != 2 {
+		t.Error(v, found, err)
+	}
+	if v, found, err := mach.GetInt64(3); err != nil || !found || v != -4 {
+		t.Error(v, found, err)
+	}
+	if v, found, err := mach.GetInt64(4); err != nil || !found || v != -5 {
+		t.Error(v, found, err)
+	}
+	if v, found, err := mach.GetFloat64(8); err != nil || !found || v != float64(float32(math.Pi)) {
+		t.Error(v, found, err)
+	}
+	if v, found, err := mach.GetFloat64(9); err != nil || !found || v != math.Pi {
+		t.Error(v, found, err)
+	}
+	if v, found, err := mach.GetBool(0); err != nil || !found || !v {
+		t.Error(v, found, err)
+	}
+	if v, found, err := mach.GetBytes(10); err != nil || !found || string(v) != "PBF" {
+		t.Error(v, found, err)
+	}
+	if v, found, err := mach.GetString(11); err != nil || !found || v != "Hello, world!" {
+		t.Error(v, found, err)
+	}
+	if v, found, err := mach.GetBytes(18); err != nil || !found || len(v) != 5 {
+		t.Error(v, found, err)
+	}
+	if v, found, err := mach.GetString(17); err != nil || found || v != "" {
+		t.Error(v, found, err)
+	}
+
+	if v, found, err := mach.GetUint64(6); err != nil || !found || v != 0x7f000007 {
+		t.Error(v, found, err)
+	}
+	if _, found, err := mach.GetUint64(7); err != nil || !found {
+		t.Error(found, err)
+	}
+
+	for i, x := range []struct {
+		f   func() error
+		err error
+	}{
+		{func() error { _, _, err := mach.GetUint64(4); return err }, pbf.ErrFieldMode},   // ZigZag.
+		{func() error { _, _, err := mach.GetInt64(8); return err }, pbf.ErrFieldMode},    // Float.
+		{func() error { _, _, err := mach.GetInt64(6); return err }, pbf.ErrFieldMode},    // Fixed32.
+		{func() error { _, _, err := mach.GetFloat64(4); return err }, pbf.ErrFieldMode},  // ZigZag.
+		{func() error { _, _, err := mach.GetUint64(8); return err }, pbf.ErrFieldMode},   // Float.
+		{func() error { _, _, err := mach.GetUint64(9); return err }, pbf.ErrFieldMode},   // Double.
+		{func() error { _, _, err := mach.GetUint64(10); return err }, pbf.ErrFieldMode},  // Bytes.
+		{func() error { _, _, err := mach.GetInt64(9); return err }, pbf.ErrFieldMode},    // Double.
+		{func() error { _, _, err := mach.GetInt64(11); return err }, pbf.ErrFieldMode},   // Bytes.
+		{func() error { _, _, err := mach.GetFloat64(1); return err }, pbf.ErrFieldMode},  // Varint.
+		{func() error { _, _, err := mach.GetFloat64(6); return err }, pbf.ErrFieldMode},  // Fixed32.
+		{func() error { _, _, err := mach.GetFloat64(10); return err }, pbf.ErrFieldMode}, // Bytes.
+		{func() error { _, _, err := mach.GetBool(4); return err }, pbf.ErrFieldMode},     // ZigZag.
+		{func() error { _, _, err := mach.GetBool(6); return err }, pbf.ErrFieldMode},     // Fixed32.
+		{func() error { _, _, err := mach.GetBool(7); return err }, pbf.ErrFieldMode},     // Fixed64.
+		{func() error { _, _, err := mach.GetBool(9); return err }, pbf.ErrFieldMode},     // Double.
+		{func() error { _, _, err := mach.GetBytes(0); return err }, pbf.ErrFieldMode},    // Scalar.
+		{func() error { _, _, err := mach.GetString(9); return err }, pbf.ErrFieldMode},   // Double.
+		{func() error { _, _, err := mach.GetUint64(22); return err }, pbf.ErrFieldIndex}, // Out of bounds.
+	} {
+		err := x.f()
+		if !errors.Is(err, x.err) {
+			t.Errorf("%d: %v", i, err)
+		}
+		var e *pbf.FieldError
+		if !errors.As(err, &e) {
+			t.Errorf("%d: %T", i, err)
+		}
+	}
+}
+
+func TestVisitFields(t *testing.T) {
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mach := pbf.NewMachine(prog)
+	buf := test.Data()
+	if _, err := mach.Filter(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var indexes []int
+	mach.VisitFields(func(index int, v pbf.Value) bool {
+		indexes = append(indexes, index)
+
+		if v.Kind() != prog.FieldKind(index) {
+			t.Error(index, v.Kind(), prog.FieldKind(index))
+		}
+
+		switch index {
+		case 3:
+			if v.Kind() != pbf.ValueScalar || v.Int64() != -4 {
+				t.Error(index, v.Kind(), v.Int64())
+			}
+		case 4:
+			if v.Kind() != pbf.ValueZigZag || v.Int64() != -5 {
+				t.Error(index, v.Kind(), v.Int64())
+			}
+		case 8:
+			if v.Kind() != pbf.ValueFloat || v.Float64() != float64(float32(math.Pi)) {
+				t.Error(index, v.Kind(), v.Float64())
+			}
+		case 11:
+			if v.Kind() != pbf.ValueBytes || string(v.Bytes()) != "Hello, world!" {
+				t.Error(index, v.Kind(), v.Bytes())
+			}
+		case 18:
+			if v.Kind() != pbf.ValueVector || len(v.Bytes()) != 5 {
+				t.Error(index, v.Kind(), v.Bytes())
+			}
+		}
+		return true
+	})
+	if len(indexes) != 21 || indexes[16] != 16 || indexes[17] != 18 {
+		t.Error(indexes)
+	}
+
+	if k := prog.FieldKind(17); k != pbf.ValueBytes {
+		t.Error(k)
+	}
+
+	n := 0
+	mach.VisitFields(func(int, pbf.Value) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Error(n)
+	}
+
+	var sum int64
+	allocs := testing.AllocsPerRun(10, func() {
+		mach.Filter(buf)
+		mach.VisitFields(func(index int, v pbf.Value) bool {
+			sum += int64(len(v.Bytes()))
+			return true
+		})
+	})
+	if allocs != 0 {
+		t.Error(allocs)
+	}
+}
+
 func BenchmarkPrepare(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		if _, err := pbf.NewProgram(bytecode); err != nil {
@@ -271,7 +591,7 @@ func BenchmarkFilter(b *testing.B) {
 	}
 
 	mach := pbf.NewMachine(prog)
-	buf := getTestData()
+	buf := test.Data()
 
 	b.SetBytes(int64(len(buf)))
 	b.ResetTimer()
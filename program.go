@@ -2,17 +2,17 @@ package pbf
 
 import (
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"io"
 	"math"
-)
 
-const bytecodeHeader = uint32(0x00464250) // "PBF\0"
+	"github.com/ninchat/pbf/field"
+	"google.golang.org/protobuf/encoding/protowire"
+)
 
-var (
-	errBytecodeFormat  = errors.New("pbf: unknown bytecode format")
-	errBytecodeInvalid = errors.New("pbf: bytecode is invalid")
-	errBytecodeTooLong = errors.New("pbf: bytecode is too long")
+const (
+	bytecodeHeader     = uint32(0x00464250) // "PBF\0"
+	bytecodeHeaderWide = uint32(0x01464250) // "PBF\1"
 )
 
 // Program for filtering protobuf messages.
@@ -20,71 +20,120 @@ type Program struct {
 	program
 }
 
-// NewProgram decodes and verifies a PBF bytecode program.
+// NewProgram decodes and verifies a PBF bytecode program.  The "PBF\0" header
+// denotes a 1-byte field count, and the "PBF\1" header a 2-byte field count.
+// The error is a *BytecodeError.
 func NewProgram(bytecode []byte) (*Program, error) {
+	return newProgram(bytecode, nil)
+}
+
+func newProgram(bytecode []byte, t Tracer) (*Program, error) {
 	if len(bytecode) < 4 {
-		return nil, io.ErrUnexpectedEOF
+		return nil, &BytecodeError{Reason: "truncated header", Err: ErrBytecodeInvalid}
 	}
 	header := binary.LittleEndian.Uint32(bytecode)
 	off := 4
 
-	if header != bytecodeHeader {
-		return nil, errBytecodeFormat
+	var wide bool
+	switch header {
+	case bytecodeHeader:
+	case bytecodeHeaderWide:
+		wide = true
+	default:
+		return nil, &BytecodeError{Reason: fmt.Sprintf("header %q", bytecode[:4]), Err: ErrBytecodeFormat}
 	}
 
 	if len(bytecode) > math.MaxInt32 {
 		// Const offsets and lengths could overflow the field data encoding.
-		return nil, errBytecodeTooLong
+		return nil, &BytecodeError{Reason: "size exceeds 2 GiB", Err: ErrBytecodeTooLong}
 	}
 
-	fieldspec, fieldcount, n, err := parseFieldSection(bytecode[off:])
+	fieldspec, fieldcount, n, err := parseFieldSection(bytecode[off:], wide)
 	if err != nil {
-		return nil, err
+		return nil, fieldSectionError(err, off+n, fieldcount)
 	}
-	off += n
-
 	p := program{
 		bytecode:   bytecode,
 		fieldcount: fieldcount,
-		insnoffset: off,
+		wide:       wide,
+		insnoffset: off + n,
+	}
+	if err := p.initFieldSpec(fieldspec); err != nil {
+		return nil, fieldSectionError(err, off+n, fieldcount)
+	}
+	if t != nil {
+		for i, spec := range splitFieldSection(bytecode[off:off+n], wide) {
+			t.TraceFieldSpec(i, formatFieldSpec(spec))
+		}
 	}
-	p.initFieldSpec(fieldspec)
 
 	if debugging {
 		debugf("prog:   Instruction offset: %d\n", p.insnoffset)
 	}
 
-	if err := verify(p); err != nil {
+	fieldmode, err := verify(p, t)
+	if err != nil {
 		return nil, err
 	}
+	p.fieldmode = fieldmode
 
 	return &Program{p}, nil
 }
 
+// fieldSectionError describes a parseFieldSection or initFieldSpec error which
+// occurred at the given bytecode offset while processing the field spec with
+// the given index.
+func fieldSectionError(err error, off, index int) *BytecodeError {
+	e := &BytecodeError{
+		Offset: off,
+		Reason: fmt.Sprintf("invalid field spec #%d", index),
+		Err:    ErrBytecodeInvalid,
+	}
+	switch err {
+	case io.ErrUnexpectedEOF:
+		e.Reason = fmt.Sprintf("truncated field spec #%d", index)
+	case errLoopField:
+		e.Reason = err.Error()
+	}
+	return e
+}
+
 type program struct {
 	bytecode   []byte
-	fieldcount uint8
+	fieldcount int
+	wide       bool // 2-byte field count.
 	insnoffset int
 
-	fieldspecarr *[256]fieldSpec
+	fieldspecarr []fieldSpec // Indexed by tag numbers up to maxarrindex.
 	maxarrindex  uint8
 
 	fieldspecmap map[int32]fieldSpec
+
+	fieldmode []accessMode // Determined by verifier.
+	fieldmod  []field.Mod  // Mod of the field spec's last node.
+
+	loops     []loopSpec
+	fieldloop []int // Loop referenced by each field, or -1; nil if there are no loops.
 }
 
-func (p *program) initFieldSpec(spec map[int32]fieldSpec) {
+func (p *program) initFieldSpec(spec map[int32]fieldSpec) error {
+	p.fieldmod = make([]field.Mod, p.fieldcount)
+	if err := p.initLoops(spec); err != nil {
+		return err
+	}
+
 	var maxtag uint8
 	for tag := range spec {
 		if tag < 0 || tag >= 256 {
 			p.fieldspecmap = spec
-			return
+			return nil
 		}
 		if uint8(tag) > maxtag {
 			maxtag = uint8(tag)
 		}
 	}
 
-	var arr [256]fieldSpec
+	arr := make([]fieldSpec, int(maxtag)+1)
 	for i := range arr {
 		arr[i].mod = 0xff // Invalid mod value.
 	}
@@ -92,8 +141,107 @@ func (p *program) initFieldSpec(spec map[int32]fieldSpec) {
 		arr[uint8(tag)] = s
 	}
 
-	p.fieldspecarr = &arr
+	p.fieldspecarr = arr
 	p.maxarrindex = maxtag
+	return nil
+}
+
+// fieldSection of the bytecode.
+func (p *program) fieldSection() []byte {
+	return p.bytecode[4:p.insnoffset]
+}
+
+// initLoops numbers the ModEach nodes and describes their iteration.  The
+// field mods are recorded on the way.  All ModEach nodes must be referenced
+// directly.
+func (p *program) initLoops(spec map[int32]fieldSpec) error {
+	var path [8]protowire.Number // Typical nesting depth.
+	if !p.numberLoops(spec, -1, path[:0], false) {
+		return errLoopField
+	}
+
+	if len(p.loops) == 0 {
+		return nil
+	}
+
+	p.fieldloop = make([]int, p.fieldcount)
+	for i := range p.fieldloop {
+		p.fieldloop[i] = -1
+	}
+
+	for i := range p.loops {
+		l := &p.loops[i]
+		l.fields, l.loops = collectLoopBody(l.sub, nil, nil)
+		p.fieldloop[l.index] = i
+	}
+	return nil
+}
+
+// numberLoops below the given path.  The keys of the spec are field numbers
+// unless they are indexes of repeated elements.  The path's backing array is
+// reused by the siblings, so it's copied only for the loops.  False is returned
+// if a ModEach node is not referenced directly.
+func (p *program) numberLoops(spec map[int32]fieldSpec, parent int, path []protowire.Number, indexes bool) bool {
+	for key, s := range spec {
+		if s.indexed {
+			p.fieldmod[s.index] = s.mod
+		}
+		if s.counted {
+			p.fieldmod[s.count] = field.ModCount
+		}
+
+		subparent := parent
+		subpath := path
+		if !indexes {
+			subpath = append(path, protowire.Number(key))
+		}
+
+		if s.mod == field.ModEach {
+			if !s.indexed {
+				return false
+			}
+			s.loop = uint16(len(p.loops))
+			spec[key] = s
+
+			p.loops = append(p.loops, loopSpec{
+				index:  int(s.index),
+				parent: parent,
+				path:   append([]protowire.Number(nil), subpath...),
+				sub:    s.sub,
+			})
+			subparent = int(s.loop)
+		}
+		if s.sub != nil && !p.numberLoops(s.sub, subparent, subpath, s.mod == field.ModRepeated || s.mod == field.ModPacked) {
+			return false
+		}
+	}
+	return true
+}
+
+func collectLoopBody(spec map[int32]fieldSpec, fields, loops []int) ([]int, []int) {
+	for _, s := range spec {
+		if s.indexed {
+			fields = append(fields, int(s.index))
+		}
+		if s.counted {
+			fields = append(fields, int(s.count))
+		}
+		if s.mod == field.ModEach {
+			loops = append(loops, int(s.loop))
+		}
+		if s.sub != nil {
+			fields, loops = collectLoopBody(s.sub, fields, loops)
+		}
+	}
+	return fields, loops
+}
+
+// loopOf returns the loop which is referenced by a field, or -1.
+func (p *program) loopOf(index int) int {
+	if p.fieldloop == nil {
+		return -1
+	}
+	return p.fieldloop[index]
 }
 
 func (p *program) insn() []byte {
@@ -11,7 +11,7 @@ import (
 
 func BenchmarkProtocGo(b *testing.B) {
 	state := test.ProtocTester{}
-	buf := getTestData()
+	buf := test.Data()
 
 	b.SetBytes(int64(len(buf)))
 	b.ResetTimer()
@@ -83,7 +83,7 @@ func BenchmarkProtocCXX(b *testing.B) {
 		}
 	}()
 
-	buf := getTestData()
+	buf := test.Data()
 	size := make([]byte, 4)
 	binary.LittleEndian.PutUint32(size, uint32(len(buf)))
 
@@ -0,0 +1,136 @@
+package pbf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DefaultMaxSize is the default message size limit of Reader.
+const DefaultMaxSize = 4 << 20
+
+var errStreamFraming = errors.New("pbf: invalid message length prefix")
+
+// Reader filters a stream of varint length-delimited protobuf messages (as
+// written by protodelim.MarshalTo).  It reuses a single machine and buffer.
+type Reader struct {
+	// MaxSize limits the size of a message.  Longer messages cause an error.
+	// DefaultMaxSize is used if MaxSize is zero or negative.
+	MaxSize int
+
+	machine *Machine
+	r       *bufio.Reader
+	buf     []byte
+	passed  bool
+	err     error
+}
+
+// NewReader of messages passing a program.
+func NewReader(r io.Reader, p *Program) *Reader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	return &Reader{
+		MaxSize: DefaultMaxSize,
+		machine: NewMachine(p),
+		r:       br,
+	}
+}
+
+// Next message which passes the filter.  The message is valid until the next
+// call, and it is not nil (even if empty) when err is nil.  At the end of the
+// stream, io.EOF is returned.  Stream read and framing errors are permanent,
+// but Next can be called again after a message decoding error (*DecodeError);
+// the message which failed to decode is returned with the error, and whether
+// it passed the filter can be checked with Passed.
+func (r *Reader) Next() (message []byte, err error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	for {
+		message, err = r.read()
+		if err != nil {
+			r.err = err
+			return nil, err
+		}
+
+		ok, err := r.machine.Filter(message)
+		r.passed = ok
+		if err != nil || ok {
+			return message, err
+		}
+	}
+}
+
+// Passed indicates whether the message returned by the last Next call passed
+// the filter.  It is relevant only if Next returned a decoding error.
+func (r *Reader) Passed() bool {
+	return r.passed
+}
+
+// Machine which evaluated the last message.  It can be used to retrieve field
+// values after a Next call.
+func (r *Reader) Machine() *Machine {
+	return r.machine
+}
+
+func (r *Reader) read() ([]byte, error) {
+	size, err := r.readSize()
+	if err != nil {
+		return nil, err
+	}
+
+	maxsize := r.MaxSize
+	if maxsize <= 0 {
+		maxsize = DefaultMaxSize
+	}
+	if size > uint64(maxsize) {
+		return nil, fmt.Errorf("pbf: message size %d exceeds limit %d", size, maxsize)
+	}
+
+	if r.buf == nil || uint64(cap(r.buf)) < size {
+		r.buf = make([]byte, size)
+	}
+	r.buf = r.buf[:size]
+
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return r.buf, nil
+}
+
+func (r *Reader) readSize() (uint64, error) {
+	var prefix [binary.MaxVarintLen64]byte
+
+	for i := range prefix {
+		c, err := r.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		prefix[i] = c
+
+		if c < 0x80 {
+			size, n := protowire.ConsumeVarint(prefix[:i+1])
+			if n < 0 {
+				return 0, errStreamFraming
+			}
+			return size, nil
+		}
+	}
+
+	return 0, errStreamFraming
+}
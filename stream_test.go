@@ -0,0 +1,105 @@
+package pbf_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/internal/test"
+	"github.com/ninchat/pbf/op"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestReader(t *testing.T) {
+	prog, err := pbf.NewProgram(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pass := test.Data()
+
+	fail, err := proto.Marshal(&test.Test{A: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream []byte
+	for _, msg := range [][]byte{fail, pass, fail, fail, {0xff}, nil, pass} {
+		stream = protowire.AppendVarint(stream, uint64(len(msg)))
+		stream = append(stream, msg...)
+	}
+	stream = append(stream, 0x80) // Truncated length prefix.
+
+	r := pbf.NewReader(bytes.NewReader(stream), prog)
+
+	if msg, err := r.Next(); err != nil || !bytes.Equal(msg, pass) {
+		t.Fatal(msg, err)
+	}
+	if v, found := r.Machine().GetRawValue(7); !found || v != 0x8000000000000008 {
+		t.Error(v, found)
+	}
+
+	if msg, err := r.Next(); err == nil || !bytes.Equal(msg, []byte{0xff}) || r.Passed() {
+		t.Fatal(msg, err)
+	}
+
+	if msg, err := r.Next(); err != nil || !bytes.Equal(msg, pass) || !r.Passed() {
+		t.Fatal(msg, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if msg, err := r.Next(); err != io.ErrUnexpectedEOF {
+			t.Fatal(msg, err)
+		}
+	}
+
+	r = pbf.NewReader(bytes.NewReader(stream[:len(stream)-1]), prog)
+	n := 0
+	for {
+		_, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		n++
+	}
+	if n != 3 {
+		t.Error(n)
+	}
+
+	r = pbf.NewReader(bytes.NewReader(stream), prog)
+	r.MaxSize = len(pass) - 1
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Error(err)
+	}
+
+	// A non-positive limit means the default.
+	for _, maxsize := range []int{0, -1} {
+		r = pbf.NewReader(bytes.NewReader(stream), prog)
+		r.MaxSize = maxsize
+		if msg, err := r.Next(); err != nil || !bytes.Equal(msg, pass) {
+			t.Error(maxsize, msg, err)
+		}
+
+		huge := protowire.AppendVarint(nil, 1<<62)
+		r = pbf.NewReader(bytes.NewReader(huge), prog)
+		r.MaxSize = maxsize
+		if _, err := r.Next(); err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+			t.Error(maxsize, err)
+		}
+	}
+
+	// An empty message passes a program which doesn't check any fields.
+	prog, err = pbf.NewProgram([]byte{'P', 'B', 'F', 0, 0, byte(op.ReturnTrue)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = pbf.NewReader(bytes.NewReader([]byte{0}), prog)
+	if msg, err := r.Next(); err != nil || msg == nil || len(msg) != 0 {
+		t.Error(msg, err)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,178 @@
+package pbf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ninchat/pbf/field"
+	"github.com/ninchat/pbf/op"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Tracer receives events during program verification and message filtering.
+// Tracing can be enabled for a program with NewTracedProgram, and for a machine
+// with Machine.SetTracer.
+type Tracer interface {
+	// TraceFieldSpec is called for each field spec of a program, in index
+	// order.  The spec is formatted like "15.Message 1.Packed.Varint 0.ZigZag".
+	TraceFieldSpec(index int, spec string)
+
+	// TraceVerifyBlock is called for each basic block of a program, in
+	// offset order.  A block ends at a Return, skip or loop instruction, or
+	// before a jump target.  The offsets of the instructions are valid only
+	// during the call.
+	TraceVerifyBlock(offsets []int)
+
+	// TraceField is called for each decoded occurrence of a field.
+	TraceField(index int, value Value)
+
+	// TraceStep is called after each executed instruction.  The step is valid
+	// only during the call.
+	TraceStep(step *Step)
+}
+
+// NewTracedProgram is like NewProgram, but the field section and the
+// verification are traced.
+func NewTracedProgram(bytecode []byte, t Tracer) (*Program, error) {
+	return newProgram(bytecode, t)
+}
+
+// SetTracer for decoding and evaluation.  Nil disables tracing.
+func (m *Machine) SetTracer(t Tracer) {
+	if t == nil {
+		m.trace = nil
+	} else {
+		m.trace = &traceState{tracer: t}
+	}
+}
+
+type traceState struct {
+	tracer  Tracer
+	regkind [2]ValueKind
+	step    Step
+	pending bool
+}
+
+func (m *Machine) traceField(s *fieldSpec, data uint64) {
+	m.trace.tracer.TraceField(int(s.index), Value{m.fieldKind(int(s.index)), data, m.protobuf})
+}
+
+// traceStep completes the previous step, and begins a new one unless offset is
+// negative.
+func (m *Machine) traceStep(offset int) {
+	t := m.trace
+
+	if t.pending {
+		s := &t.step
+
+		switch code := s.Code.Narrow(); {
+		case code == op.LoadConstScalar || code == op.LoadConstScalar0 || code == op.LoadConstScalar1:
+			t.regkind[0] = ValueScalar
+		case code == op.LoadConstBytes:
+			t.regkind[0] = ValueBytes
+		case code == op.LoadR0FieldScalar || code == op.LoadR1FieldScalar:
+			t.regkind[code.Reg()] = m.fieldKind(s.Field)
+		case code == op.LoadR0FieldBytes || code == op.LoadR1FieldBytes:
+			t.regkind[code.Reg()] = ValueBytes
+		case code == op.LoadR0FieldVector || code == op.LoadR1FieldVector:
+			t.regkind[code.Reg()] = ValueVector
+		case code.IsCount():
+			t.regkind[code.Reg()] = ValueScalar
+		}
+
+		s.R0 = m.regValue(0)
+		s.R1 = m.regValue(1)
+		s.Status = m.status
+		if s.Code == op.LoopNext {
+			s.Found = m.fieldFound(s.Field)
+		}
+
+		t.pending = false
+		t.tracer.TraceStep(s)
+	}
+
+	if offset < 0 {
+		t.regkind = [2]ValueKind{}
+		return
+	}
+
+	code := op.Code(m.bytecode[offset])
+	s := Step{
+		Offset: offset,
+		Code:   code,
+		Arg:    code.Arg(m.bytecode[offset+1:]),
+		Field:  -1,
+	}
+
+	if code.HasFieldIndex() {
+		s.Field = int(s.Arg)
+		s.Found = m.fieldFound(s.Field)
+	}
+	if code == op.LoopNext {
+		s.Field, _ = op.SplitLoopNextArg(s.Arg)
+	}
+
+	t.step = s
+	t.pending = true
+}
+
+func (m *Machine) regValue(r op.Reg) Value {
+	kind := m.trace.regkind[r]
+	data := m.reg[r]
+
+	if kind == ValueBytes && data&constBytesFieldFlag != 0 {
+		return Value{kind, data &^ constBytesFieldFlag, m.bytecode}
+	}
+	return Value{kind, data, m.protobuf}
+}
+
+// NewTextTracer writes events to w, one per line.
+func NewTextTracer(w io.Writer) Tracer {
+	return textTracer{w}
+}
+
+type textTracer struct {
+	w io.Writer
+}
+
+func (t textTracer) TraceFieldSpec(index int, spec string) {
+	fmt.Fprintf(t.w, "field:  #%d = %s\n", index, spec)
+}
+
+func (t textTracer) TraceVerifyBlock(offsets []int) {
+	fmt.Fprintf(t.w, "verify: Block %v\n", offsets)
+}
+
+func (t textTracer) TraceField(index int, value Value) {
+	fmt.Fprintf(t.w, "decode: #%d = %s %s\n", index, value.Kind(), value)
+}
+
+func (t textTracer) TraceStep(step *Step) {
+	fmt.Fprintf(t.w, "eval:   %5d  %s\n", step.Offset, step)
+}
+
+// formatFieldSpec of an encoded field spec, like build.FieldSpec.String.
+func formatFieldSpec(enc []byte) string {
+	var s string
+
+	for len(enc) > 0 {
+		if s != "" {
+			s += " "
+		}
+
+		num := int32(binary.LittleEndian.Uint32(enc))
+		mod := field.Mod(enc[4])
+		enc = enc[5:]
+
+		var subtype protowire.Type
+		if mod == field.ModPacked {
+			subtype = protowire.Type(enc[0])
+			enc = enc[1:]
+		}
+
+		s += field.FormatNode(num, mod, subtype)
+	}
+
+	return s
+}
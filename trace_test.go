@@ -0,0 +1,159 @@
+package pbf_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ninchat/pbf"
+	"github.com/ninchat/pbf/internal/test"
+	"github.com/ninchat/pbf/op"
+)
+
+type recorder struct {
+	specs  []string
+	blocks [][]int
+	fields []string
+	steps  []pbf.Step
+}
+
+func (r *recorder) TraceFieldSpec(index int, spec string) {
+	r.specs = append(r.specs, fmt.Sprintf("#%d = %s", index, spec))
+}
+
+func (r *recorder) TraceVerifyBlock(offsets []int) {
+	r.blocks = append(r.blocks, append([]int(nil), offsets...))
+}
+
+func (r *recorder) TraceField(index int, value pbf.Value) {
+	r.fields = append(r.fields, fmt.Sprintf("#%d = %s", index, value))
+}
+
+func (r *recorder) TraceStep(step *pbf.Step) {
+	r.steps = append(r.steps, *step)
+}
+
+func TestTracer(t *testing.T) {
+	r := new(recorder)
+
+	prog, err := pbf.NewTracedProgram(bytecode, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.specs) != prog.FieldCount() {
+		t.Fatal(r.specs)
+	}
+	for i, s := range map[int]string{
+		0:  "#0 = 1",
+		4:  "#4 = 5.ZigZag",
+		8:  "#8 = 9.Float",
+		12: "#12 = 13.Packed.Varint 3",
+		13: "#13 = 14.Message 2",
+	} {
+		if r.specs[i] != s {
+			t.Errorf("spec %d: %s", i, r.specs[i])
+		}
+	}
+
+	if len(r.blocks) == 0 {
+		t.Fatal("no blocks")
+	}
+	prev := 0
+	for _, block := range r.blocks {
+		for _, off := range block {
+			if off <= prev {
+				t.Errorf("block %v after offset %d", block, prev)
+			}
+			prev = off
+		}
+		switch last := op.Code(bytecode[block[len(block)-1]]); {
+		case last == op.ReturnFalse || last == op.ReturnTrue || last.IsSkip():
+		default:
+			t.Errorf("block %v ends with %s", block, last)
+		}
+	}
+
+	m := pbf.NewMachine(prog)
+	m.SetTracer(r)
+
+	ok, err := m.Filter(test.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("filter")
+	}
+
+	for _, s := range []string{"#4 = -5", `#11 = "Hello, world!"`} {
+		if !contains(r.fields, s) {
+			t.Errorf("field %s not traced: %q", s, r.fields)
+		}
+	}
+
+	if len(r.steps) == 0 || r.steps[len(r.steps)-1].Code != op.ReturnTrue {
+		t.Fatal(r.steps)
+	}
+	for i, s := range r.steps {
+		if i == 0 && s.Offset != r.blocks[0][0] {
+			t.Errorf("first step at %d", s.Offset)
+		}
+		if s.Code == op.LoadR0FieldScalar && s.Arg == 3 && s.R0.Int64() != -4 {
+			t.Error(s.String())
+		}
+	}
+
+	// Explain forwards to the machine's tracer.
+	n := len(r.steps)
+	e, err := m.Explain(test.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Steps) != n || len(r.steps) != 2*n {
+		t.Error(len(e.Steps), len(r.steps), n)
+	}
+
+	m.SetTracer(nil)
+	if _, err := m.Filter(test.Data()); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.steps) != 2*n {
+		t.Error("traced after SetTracer(nil)")
+	}
+}
+
+func TestTextTracer(t *testing.T) {
+	var b strings.Builder
+
+	prog, err := pbf.NewTracedProgram(bytecode, pbf.NewTextTracer(&b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := pbf.NewMachine(prog)
+	m.SetTracer(pbf.NewTextTracer(&b))
+	if _, err := m.Filter(test.Data()); err != nil {
+		t.Fatal(err)
+	}
+
+	out := b.String()
+	for _, s := range []string{
+		"field:  #0 = 1\n",
+		"verify: Block [",
+		"decode: #4 = ZigZag -5\n",
+		"eval:  ",
+		"ReturnTrue\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("%q not in output:\n%s", s, out)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package pbf
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ninchat/pbf/field"
+)
+
+// ValueKind describes how a field is loaded by the program, which determines
+// the interpretation of its value.
+type ValueKind uint8
+
+// Field value kinds.
+const (
+	ValueNone   = ValueKind(iota) // Field presence is checked, but it's not loaded.
+	ValueScalar                   // Unsigned or signed integer, or double.
+	ValueZigZag                   // Signed integer.
+	ValueFloat                    // Float converted to double.
+	ValueBytes                    // Bytes, string or message.
+	ValueVector                   // Packed repeated field payload.
+)
+
+func (k ValueKind) String() string {
+	switch k {
+	case ValueNone:
+		return "None"
+	case ValueScalar:
+		return "Scalar"
+	case ValueZigZag:
+		return "ZigZag"
+	case ValueFloat:
+		return "Float"
+	case ValueBytes:
+		return "Bytes"
+	case ValueVector:
+		return "Vector"
+	default:
+		return fmt.Sprintf("<invalid pbf.ValueKind value %d>", k)
+	}
+}
+
+// Value of a field of the filtered message.  It is valid until the next Filter
+// call.  The accessor methods don't check the kind; interpretation of a
+// ValueScalar depends on the protobuf field type.
+type Value struct {
+	kind ValueKind
+	data uint64
+	buf  []byte
+}
+
+// Kind of the value.
+func (v Value) Kind() ValueKind { return v.kind }
+
+// Raw field data, as returned by Machine.GetRawValueWide.
+func (v Value) Raw() uint64 { return v.data }
+
+// Uint64 value of a scalar.
+func (v Value) Uint64() uint64 { return v.data }
+
+// Int64 value of a scalar or zigzag.  Values of sfixed32 fields are not
+// sign-extended.
+func (v Value) Int64() int64 { return int64(v.data) }
+
+// Float64 value of a double scalar or float.
+func (v Value) Float64() float64 { return math.Float64frombits(v.data) }
+
+// Bool value of a scalar.
+func (v Value) Bool() bool { return v.data != 0 }
+
+// Bytes refers to the filtered message.  It returns nil if the kind is not
+// ValueBytes or ValueVector.
+func (v Value) Bytes() []byte {
+	if v.kind != ValueBytes && v.kind != ValueVector {
+		return nil
+	}
+
+	off, n := unpackBytesRef(v.data)
+	return v.buf[off:][:n]
+}
+
+// String representation of the value.
+func (v Value) String() string {
+	switch v.kind {
+	case ValueScalar:
+		return fmt.Sprintf("%d", v.data)
+	case ValueZigZag:
+		return fmt.Sprintf("%d", v.Int64())
+	case ValueFloat:
+		return fmt.Sprintf("%g", v.Float64())
+	case ValueBytes:
+		return fmt.Sprintf("%q", v.Bytes())
+	case ValueVector:
+		return fmt.Sprintf("[% x]", v.Bytes())
+	default:
+		return "-"
+	}
+}
+
+// FieldKind returns the value kind of a field.  The index must be smaller than
+// the program's field count.
+func (p *Program) FieldKind(index int) ValueKind {
+	return p.fieldKind(index)
+}
+
+func (p *program) fieldKind(index int) ValueKind {
+	switch p.fieldmode[index] {
+	case accessScalar:
+		switch p.fieldmod[index] {
+		case field.ModZigZag:
+			return ValueZigZag
+		case field.ModFloat:
+			return ValueFloat
+		default:
+			return ValueScalar
+		}
+
+	case accessBytes:
+		return ValueBytes
+
+	case accessVector:
+		return ValueVector
+
+	default:
+		return ValueNone
+	}
+}
+
+// FieldCount returns the number of fields declared in the field section.
+func (p *Program) FieldCount() int {
+	return p.fieldcount
+}
+
+// GetValue can be used after a Filter call to retrieve the value of a field.
+func (m *Machine) GetValue(index int) (value Value, found bool) {
+	if index < 0 || index >= m.fieldcount {
+		return
+	}
+
+	data, found := m.GetRawValueWide(index)
+	if !found {
+		return
+	}
+
+	value = Value{m.fieldKind(index), data, m.protobuf}
+	return
+}
+
+// VisitFields can be used after a Filter call to iterate over the fields which
+// were found in the message, in index order.  Iteration stops if the visitor
+// returns false.
+func (m *Machine) VisitFields(visit func(index int, value Value) bool) {
+	for i := 0; i < m.fieldcount; i++ {
+		if value, found := m.GetValue(i); found {
+			if !visit(i, value) {
+				return
+			}
+		}
+	}
+}
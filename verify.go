@@ -3,9 +3,9 @@ package pbf
 import (
 	"encoding/binary"
 	"fmt"
-	"runtime"
 	"time"
 
+	"github.com/ninchat/pbf/field"
 	"github.com/ninchat/pbf/op"
 )
 
@@ -16,6 +16,7 @@ const (
 	accessScalar
 	accessBytes
 	accessVector
+	accessConflict // Different on converging paths.
 )
 
 func (m accessMode) String() string {
@@ -28,200 +29,607 @@ func (m accessMode) String() string {
 		return "bytes"
 	case accessVector:
 		return "vector"
+	case accessConflict:
+		return "conflicting"
 	default:
 		return fmt.Sprintf("<invalid accessMode value %d>", m)
 	}
 }
 
+// verifyError is a panic value which describes why the program is invalid.
+type verifyError string
+
+const errPastLastInstruction = verifyError("execution continues past the last instruction")
+
+// fail verification of the current instruction.
+func fail(format string, args ...interface{}) {
+	panic(verifyError(fmt.Sprintf(format, args...)))
+}
+
 type verifier struct {
 	program
 	fieldmode  []accessMode
-	debugPaths uintptr
+	tracer     Tracer
+	pending    stateHeap // States of jump targets.
+	block      []int     // Instruction offsets of the current basic block when tracing.
+	offset     int       // Instruction being analyzed, or -1.
+	opcode     op.Code   // Meaningful only if offset is not -1.
+	debugInsns uintptr
 }
 
-func verify(p program) (err error) {
+// verifyState before an instruction, merged from all of its predecessors.
+type verifyState struct {
+	reg    [2]accessMode
+	loops  []loopFrame
+	target bool // Reached by a jump.
+}
+
+// verify the program and return the access modes of the fields.
+//
+// The verifier is a dataflow analysis.  All jumps except LoopBack are forward,
+// so the instructions are analyzed in offset order, each one only once, after
+// the states of all of its predecessors have been merged.  Register states are
+// not propagated through LoopBack instructions: LoopNext leaves the registers
+// undefined, so the back edges can be ignored.  Verification time is therefore
+// linear in the size of the bytecode and the number of loops.
+func verify(p program, t Tracer) (fieldmode []accessMode, err error) {
+	v := verifier{
+		program:   p,
+		fieldmode: make([]accessMode, p.fieldcount),
+		tracer:    t,
+		offset:    -1,
+	}
+
 	defer func() {
 		if x := recover(); x != nil {
-			e, _ := x.(error)
-			if e == nil {
+			reason, ok := x.(verifyError)
+			if !ok {
 				panic(x)
 			}
-			if _, ok := e.(runtime.Error); ok {
-				panic(x)
-			}
-			err = e
+			err = v.error(string(reason))
 		}
 	}()
 
-	v := verifier{
-		program:   p,
-		fieldmode: make([]accessMode, p.fieldcount),
-	}
-
 	var debugTime time.Time
 	if debugging {
 		debugTime = time.Now()
 	}
 
-	v.simulate([2]accessMode{}, v.insn())
+	if v.insnoffset >= len(v.bytecode) {
+		panic(errPastLastInstruction)
+	}
+
+	var (
+		s    verifyState
+		live = true // s is the state at off.
+	)
+
+	for off := v.insnoffset; live || len(v.pending) > 0; {
+		if !live {
+			off = v.pending[0].off
+		}
+
+		for len(v.pending) > 0 && v.pending[0].off == off {
+			pending := v.pending.pop()
+			if live {
+				pending.merge(s)
+			}
+			s, live = pending, true
+		}
+
+		next, cont := v.analyze(off, &s)
+		if cont && v.overlapped(off, next) {
+			// Analyze the jump target inside the instruction first.
+			v.pend(next, s)
+			next, cont = off+1, false
+		}
+		off, live = next, cont
+	}
 
 	if debugging {
-		debugf("verify: Simulation time: %v\n", time.Now().Sub(debugTime))
-		debugf("verify: Execution paths: %d\n", v.debugPaths)
+		debugf("verify: Analysis time: %v\n", time.Now().Sub(debugTime))
+		debugf("verify: Instructions: %d\n", v.debugInsns)
 	}
 
+	fieldmode = v.fieldmode
 	return
 }
 
-func (v *verifier) simulate(reg [2]accessMode, insn []byte) {
+// error describes the failure of the current instruction, or of the
+// instruction section if there is no current instruction.
+func (v *verifier) error(reason string) *BytecodeError {
+	e := &BytecodeError{
+		Offset: v.insnoffset,
+		Reason: reason,
+		Err:    ErrBytecodeInvalid,
+	}
+	if v.offset >= 0 {
+		e.Offset = v.offset
+		e.Instruction = true
+		e.Opcode = v.opcode
+	}
+	return e
+}
+
+// loopFrame of a LoopNext instruction whose body contains the current
+// instruction.
+type loopFrame struct {
+	loop   int
+	offset int  // LoopNext instruction.
+	exit   int  // Exit target.
+	always bool // The loop has been entered on every path.
+}
+
+// analyze the instruction at the given offset, and merge the resulting states
+// into the jump targets.  The state is updated in place for the next
+// instruction.  The offset of the next instruction is returned along with
+// false if execution doesn't continue there.
+func (v *verifier) analyze(off int, s *verifyState) (int, bool) {
 	if debugging {
-		v.debugPaths++
+		v.debugInsns++
 	}
 
-	for {
-		opcode := op.Code(insn[0])
-		insn = insn[1:]
+	if v.tracer != nil {
+		if s.target {
+			v.endBlock()
+		}
+		v.block = append(v.block, off)
+	}
 
-		switch {
-		case opcode < 64: // No arguments.
-			switch opcode {
-			case op.CompareUnsignedLT, op.CompareUnsignedGE, op.CompareUnsignedEQ, op.CompareUnsignedNE, op.CompareUnsignedLE, op.CompareUnsignedGT:
-				checkRegs(reg, accessScalar)
+	reg := s.reg
+	loops := enclosingLoops(s.loops, off)
+	s.target = false
+
+	insn := v.bytecode[off:]
+	opcode := op.Code(insn[0])
+	insn = insn[1:]
+	v.offset = off
+	v.opcode = opcode
+	if !opcode.IsValid() {
+		failUnknownOpcode(opcode)
+	}
+	end := off + opcode.Size()
+	if end > len(v.bytecode) {
+		fail("truncated instruction")
+	}
 
-			case op.LoadConstScalar0, op.LoadConstScalar1:
-				reg[0] = accessScalar
+	switch {
+	case opcode < 64: // No arguments.
+		switch opcode {
+		case op.CompareUnsignedLT, op.CompareUnsignedGE, op.CompareUnsignedEQ, op.CompareUnsignedNE, op.CompareUnsignedLE, op.CompareUnsignedGT:
+			checkRegs(reg, accessScalar)
 
-			case op.CompareSignedLT, op.CompareSignedGE, op.CompareSignedEQ, op.CompareSignedNE, op.CompareSignedLE, op.CompareSignedGT:
-				checkRegs(reg, accessScalar)
+		case op.LoadConstScalar0, op.LoadConstScalar1:
+			reg[0] = accessScalar
 
-			case op.ReturnFalse, op.ReturnTrue:
-				return
+		case op.CompareSignedLT, op.CompareSignedGE, op.CompareSignedEQ, op.CompareSignedNE, op.CompareSignedLE, op.CompareSignedGT:
+			checkRegs(reg, accessScalar)
 
-			case op.CompareBytesLT, op.CompareBytesGE, op.CompareBytesEQ, op.CompareBytesNE, op.CompareBytesLE, op.CompareBytesGT:
-				checkRegs(reg, accessBytes)
+		case op.ReturnFalse, op.ReturnTrue:
+			v.endBlock()
+			return end, false
 
-			case op.CompareFloatLT, op.CompareFloatGE, op.CompareFloatEQ, op.CompareFloatNE, op.CompareFloatLE, op.CompareFloatGT:
-				checkRegs(reg, accessScalar)
+		case op.CompareBytesLT, op.CompareBytesGE, op.CompareBytesEQ, op.CompareBytesNE, op.CompareBytesLE, op.CompareBytesGT:
+			checkRegs(reg, accessBytes)
 
-			case op.CompareFloatInfPos, op.CompareFloatInfNeg, op.CompareFloatNaN:
-				checkReg(reg, op.R0, accessScalar)
+		case op.HasPrefixBytes, op.HasSuffixBytes, op.ContainsBytes:
+			checkRegs(reg, accessBytes)
 
-			case op.ContainsVarint, op.ContainsZigZag, op.ContainsFixed64, op.ContainsFixed32:
-				checkReg(reg, op.R1, accessVector)
-				checkReg(reg, op.R0, accessScalar)
+		case op.CompareFloatLT, op.CompareFloatGE, op.CompareFloatEQ, op.CompareFloatNE, op.CompareFloatLE, op.CompareFloatGT:
+			checkRegs(reg, accessScalar)
 
-			default:
-				panicUnknownOpcode(opcode)
-			}
+		case op.CompareFloatInfPos, op.CompareFloatInfNeg, op.CompareFloatNaN:
+			checkReg(reg, op.R0, accessScalar)
 
-		case opcode < 128: // 8-bit argument.
-			arg := insn[0]
-			insn = insn[1:]
+		case op.ContainsVarint, op.ContainsZigZag, op.ContainsFixed64, op.ContainsFixed32:
+			checkReg(reg, op.R1, accessVector)
+			checkReg(reg, op.R0, accessScalar)
 
-			switch opcode {
-			case op.LoadR0FieldScalar:
-				v.markField(arg, accessScalar)
-				reg[0] = accessScalar
+		case op.LengthR0Bytes, op.LengthR1Bytes:
+			checkReg(reg, opcode.Reg(), accessBytes)
+			reg[opcode.Reg()] = accessScalar
 
-			case op.LoadR1FieldScalar:
-				v.markField(arg, accessScalar)
-				reg[1] = accessScalar
+		case op.CountR0Varint, op.CountR1Varint, op.CountR0Fixed64, op.CountR1Fixed64, op.CountR0Fixed32, op.CountR1Fixed32:
+			checkReg(reg, opcode.Reg(), accessVector)
+			reg[opcode.Reg()] = accessScalar
 
-			case op.LoadR0FieldBytes:
-				v.markField(arg, accessBytes)
-				reg[0] = accessBytes
+		default:
+			failUnknownOpcode(opcode)
+		}
 
-			case op.LoadR1FieldBytes:
-				v.markField(arg, accessBytes)
-				reg[1] = accessBytes
+	case opcode < 128: // 8-bit argument.
+		arg := insn[0]
 
-			case op.LoadR0FieldVector:
-				v.markField(arg, accessVector)
-				reg[0] = accessVector
+		if opcode.IsQuantifier() {
+			checkQuantifier(opcode, op.Code(arg))
+			checkReg(reg, op.R1, accessVector)
+			checkReg(reg, op.R0, accessScalar)
+		} else {
+			reg = v.simulateField(opcode, int(arg), reg)
+		}
 
-			case op.LoadR1FieldVector:
-				v.markField(arg, accessVector)
-				reg[1] = accessVector
+	case opcode < 192: // 16-bit argument.
+		arg := binary.LittleEndian.Uint16(insn)
+		insn = insn[2:]
 
-			case op.CheckField:
-				v.checkFieldIndex(arg)
+		switch opcode {
+		case op.SkipFalse, op.SkipTrue:
+			v.checkSkip(uint64(arg), insn)
+			v.jump(end+int(arg), reg, loops)
+			v.endBlock()
 
-			default:
-				panicUnknownOpcode(opcode)
-			}
+		case op.Skip:
+			v.checkSkip(uint64(arg), insn)
+			v.jump(end+int(arg), reg, loops)
+			v.endBlock()
+			return end, false
 
-		case opcode < 192: // 16-bit argument.
-			arg := binary.LittleEndian.Uint16(insn)
-			insn = insn[2:]
+		case op.LoadR0FieldScalarWide, op.LoadR1FieldScalarWide, op.LoadR0FieldBytesWide, op.LoadR1FieldBytesWide, op.LoadR0FieldVectorWide, op.LoadR1FieldVectorWide, op.CheckFieldWide:
+			reg = v.simulateField(opcode.Narrow(), int(arg), reg)
 
-			switch opcode {
-			case op.SkipFalse, op.SkipTrue:
-				v.simulate(reg, insn[arg:])
+		default:
+			failUnknownOpcode(opcode)
+		}
 
-			case op.Skip:
-				insn = insn[arg:]
+	default: // 64-bit argument.
+		arg := binary.LittleEndian.Uint64(insn)
+		insn = insn[8:]
 
-			default:
-				panicUnknownOpcode(opcode)
-			}
+		switch opcode {
+		case op.LoadConstScalar:
+			reg[0] = accessScalar
+
+		case op.LoadConstBytes:
+			v.checkBytesRef(arg)
+			reg[0] = accessBytes
+
+		case op.SkipFalseLong, op.SkipTrueLong:
+			v.checkSkip(arg, insn)
+			v.jump(end+int(arg), reg, loops)
+			v.endBlock()
+
+		case op.SkipLong:
+			v.checkSkip(arg, insn)
+			v.jump(end+int(arg), reg, loops)
+			v.endBlock()
+			return end, false
+
+		case op.LoopNext:
+			index, exit := op.SplitLoopNextArg(arg)
+			frame := v.checkLoopNext(index, end, loops)
+			v.checkSkip(uint64(exit), insn)
+			frame.exit = end + int(exit)
+
+			reg = [2]accessMode{}
+			v.jump(frame.exit, reg, loops)
+			v.endBlock()
+
+			loops = append(loops[:len(loops):len(loops)], frame)
+
+		case op.LoopBack:
+			v.checkLoopBack(arg, end, loops)
+			v.endBlock()
+			return end, false
+
+		default:
+			failUnknownOpcode(opcode)
+		}
+	}
+
+	if end >= len(v.bytecode) {
+		panic(errPastLastInstruction)
+	}
+
+	s.reg = reg
+	s.loops = loops
+	return end, true
+}
+
+// jump merges a state into the instruction at the given offset.
+func (v *verifier) jump(off int, reg [2]accessMode, loops []loopFrame) {
+	if off >= len(v.bytecode) {
+		panic(errPastLastInstruction)
+	}
+
+	v.pend(off, verifyState{reg, loops, true})
+}
+
+// pend a state of the instruction at the given offset.  The pending states of
+// an instruction are merged when it's reached.
+func (v *verifier) pend(off int, s verifyState) {
+	v.pending.push(pendingState{off, s})
+}
+
+// overlapped indicates whether the instruction at the given offset contains a
+// pending jump target.  The pending targets are after the instruction's
+// offset.
+func (v *verifier) overlapped(off, end int) bool {
+	return len(v.pending) > 0 && v.pending[0].off < end
+}
+
+type pendingState struct {
+	off int
+	verifyState
+}
+
+// stateHeap is a binary min-heap of pending states ordered by offset.
+type stateHeap []pendingState
+
+func (h *stateHeap) push(p pendingState) {
+	a := append(*h, p)
+	for i := len(a) - 1; i > 0; {
+		parent := (i - 1) / 2
+		if a[parent].off <= a[i].off {
+			break
+		}
+		a[parent], a[i] = a[i], a[parent]
+		i = parent
+	}
+	*h = a
+}
 
-		default: // 64-bit argument.
-			arg := binary.LittleEndian.Uint64(insn)
-			insn = insn[8:]
+// pop the state with the smallest offset.
+func (h *stateHeap) pop() verifyState {
+	a := *h
+	s := a[0].verifyState
+	n := len(a) - 1
+	a[0] = a[n]
+	a = a[:n]
+	for i := 0; ; {
+		min := i
+		if l := 2*i + 1; l < n && a[l].off < a[min].off {
+			min = l
+		}
+		if r := 2*i + 2; r < n && a[r].off < a[min].off {
+			min = r
+		}
+		if min == i {
+			break
+		}
+		a[i], a[min] = a[min], a[i]
+		i = min
+	}
+	*h = a
+	return s
+}
 
-			switch opcode {
-			case op.LoadConstScalar:
-				reg[0] = accessScalar
+// merge the state of another path.
+func (s *verifyState) merge(other verifyState) {
+	for i := range s.reg {
+		if s.reg[i] != other.reg[i] {
+			s.reg[i] = accessConflict
+		}
+	}
+	s.loops = mergeLoops(s.loops, other.loops)
+	s.target = true
+}
 
-			case op.LoadConstBytes:
-				v.checkBytesRef(arg)
-				reg[0] = accessBytes
+// endBlock reports the current basic block to the tracer.
+func (v *verifier) endBlock() {
+	if v.tracer != nil && len(v.block) > 0 {
+		v.tracer.TraceVerifyBlock(v.block)
+		v.block = v.block[:0]
+	}
+}
 
-			default:
-				panicUnknownOpcode(opcode)
+// enclosingLoops excludes the frames of loops which have been exited before
+// the given offset.
+func enclosingLoops(loops []loopFrame, off int) []loopFrame {
+	for i, f := range loops {
+		if off >= f.exit {
+			var enclosing []loopFrame
+			for _, f := range loops[i+1:] {
+				if off < f.exit {
+					enclosing = append(enclosing, f)
+				}
 			}
+			return append(loops[:i:i], enclosing...)
+		}
+	}
+	return loops
+}
+
+// mergeLoops of two paths.  A loop has been entered on every path only if it
+// has been entered on every path of both.
+func mergeLoops(a, b []loopFrame) []loopFrame {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+
+	merged := make([]loopFrame, 0, len(a)+len(b))
+
+	for _, f := range a {
+		g, found := findLoopFrame(b, f.offset)
+		f.always = f.always && found && g.always
+		merged = append(merged, f)
+	}
+	for _, f := range b {
+		if _, found := findLoopFrame(a, f.offset); !found {
+			f.always = false
+			merged = append(merged, f)
 		}
 	}
+
+	return merged
 }
 
-func (v *verifier) markField(index uint8, m accessMode) {
+func findLoopFrame(loops []loopFrame, offset int) (loopFrame, bool) {
+	for _, f := range loops {
+		if f.offset == offset {
+			return f, true
+		}
+	}
+	return loopFrame{}, false
+}
+
+// simulateField instruction with a 1-byte argument, or the corresponding
+// instruction with a 2-byte argument.
+func (v *verifier) simulateField(opcode op.Code, index int, reg [2]accessMode) [2]accessMode {
+	switch opcode {
+	case op.LoadR0FieldScalar:
+		v.markField(index, accessScalar)
+		reg[0] = accessScalar
+
+	case op.LoadR1FieldScalar:
+		v.markField(index, accessScalar)
+		reg[1] = accessScalar
+
+	case op.LoadR0FieldBytes:
+		v.markField(index, accessBytes)
+		reg[0] = accessBytes
+
+	case op.LoadR1FieldBytes:
+		v.markField(index, accessBytes)
+		reg[1] = accessBytes
+
+	case op.LoadR0FieldVector:
+		v.markField(index, accessVector)
+		reg[0] = accessVector
+
+	case op.LoadR1FieldVector:
+		v.markField(index, accessVector)
+		reg[1] = accessVector
+
+	case op.CheckField:
+		v.checkFieldIndex(index)
+
+	default:
+		failUnknownOpcode(opcode)
+	}
+
+	return reg
+}
+
+func (v *verifier) markField(index int, m accessMode) {
 	v.checkFieldIndex(index)
 
+	if v.fieldmod[index] == field.ModCount && m != accessScalar {
+		fail("count field #%d accessed as %s", index, m)
+	}
+
 	switch v.fieldmode[index] {
 	case m:
 	case accessUndefined:
 		v.fieldmode[index] = m
 	default:
-		panic(fmt.Errorf("pbf: field #%d accessed as %s and %s", index, v.fieldmode[index], m))
+		fail("field #%d accessed as %s and %s", index, v.fieldmode[index], m)
 	}
 }
 
+// checkBytesRef of a constant.  A non-empty constant must reside in the
+// instruction-and-constant section.
 func (v *verifier) checkBytesRef(ref uint64) {
 	off, n := unpackBytesRef(ref)
 	end := uint64(off) + uint64(n)
-	if end > uint64(len(v.bytecode)) {
-		panic(fmt.Errorf("pbf: invalid bytes reference: %#016x", ref))
+	if (n > 0 && uint64(off) < uint64(v.insnoffset)) || end > uint64(len(v.bytecode)) {
+		fail("invalid bytes reference: %#016x", ref)
 	}
 }
 
-func (v *verifier) checkFieldIndex(index uint8) {
-	if index >= v.fieldcount {
-		panic(fmt.Errorf("pbf: field index out of bounds: %d", index))
+func (v *verifier) checkSkip(offset uint64, insn []byte) {
+	if offset >= uint64(len(insn)) {
+		fail("skip offset out of bounds: %d", offset)
+	}
+}
+
+// checkLoopNext instruction which ends at the given offset, and return its
+// loop frame without the exit target.  The enclosing loops may have been
+// entered on some paths only.
+func (v *verifier) checkLoopNext(index, end int, loops []loopFrame) loopFrame {
+	v.markField(index, accessBytes)
+
+	loop := v.loopOf(index)
+	if loop < 0 {
+		fail("field #%d is not a loop field", index)
+	}
+
+	for _, f := range loops {
+		if f.loop == loop {
+			fail("loop over field #%d inside itself", index)
+		}
+	}
+
+	// A nested loop must be inside the loop over the enclosing element.
+	if parent := v.loops[loop].parent; parent >= 0 {
+		found := false
+		for _, f := range loops {
+			if f.loop == parent && f.always && end <= f.exit {
+				found = true
+			}
+		}
+		if !found {
+			fail("loop over field #%d outside the loop over field #%d", index, v.loops[parent].index)
+		}
+	}
+
+	return loopFrame{
+		loop:   loop,
+		offset: end - op.LoopNext.Size(),
+		always: true,
+	}
+}
+
+// checkLoopBack instruction which ends at the given offset.  The target must be
+// the LoopNext instruction of a loop which has been entered and hasn't been
+// exited on every path.
+func (v *verifier) checkLoopBack(offset uint64, end int, loops []loopFrame) {
+	if offset <= uint64(end) {
+		target := end - int(offset)
+		for _, f := range loops {
+			if f.offset == target && f.always && end <= f.exit {
+				return
+			}
+		}
+	}
+	fail("invalid loop back offset: %d", offset)
+}
+
+func (v *verifier) checkFieldIndex(index int) {
+	if index < 0 || index >= v.fieldcount {
+		fail("field index out of bounds: %d", index)
+	}
+}
+
+// checkQuantifier's comparison opcode against the vector element encoding.
+// Floating-point comparisons require fixed-width elements, and zigzag elements
+// are signed.
+func checkQuantifier(opcode, cmp op.Code) {
+	ok := cmp.IsCompare()
+	if ok {
+		switch kind := cmp.Kind(); opcode.Encoding() {
+		case op.Varint:
+			ok = kind == op.Unsigned || kind == op.Signed
+		case op.ZigZag:
+			ok = kind == op.Signed
+		default:
+			ok = kind != op.Bytes
+		}
+	}
+	if !ok {
+		fail("%s instruction used with %s", opcode, cmp)
 	}
 }
 
 func checkReg(reg [2]accessMode, r op.Reg, m accessMode) {
+	if reg[r] == accessConflict {
+		fail("%s contents depend on the execution path but instruction expects %s", r, m)
+	}
 	if reg[r] != m {
-		panic(fmt.Errorf("pbf: %s contains %s but instruction expects %s", r, reg[r], m))
+		fail("%s contains %s but instruction expects %s", r, reg[r], m)
 	}
 }
 
 func checkRegs(reg [2]accessMode, m accessMode) {
+	for _, r := range []op.Reg{op.R1, op.R0} {
+		if reg[r] == accessConflict {
+			fail("binary %s instruction used with %s contents which depend on the execution path", m, r)
+		}
+	}
 	if reg[1] != m || reg[0] != m {
-		panic(fmt.Errorf("pbf: binary %s instruction used with %s in R1 and %s in R0", m, reg[1], reg[0]))
+		fail("binary %s instruction used with %s in R1 and %s in R0", m, reg[1], reg[0])
 	}
 }
 
-func panicUnknownOpcode(opcode op.Code) {
-	panic(fmt.Errorf("pbf: unknown opcode: %d", opcode))
+func failUnknownOpcode(opcode op.Code) {
+	fail("unknown opcode: %d", opcode)
 }
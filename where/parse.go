@@ -0,0 +1,532 @@
+package where
+
+import (
+	"fmt"
+	"go/constant"
+	"go/token"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ninchat/pbf/build"
+	"github.com/ninchat/pbf/expr"
+	"github.com/ninchat/pbf/op"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type tokenKind int
+
+const (
+	tokEOF = tokenKind(iota)
+	tokIdent
+	tokKeyword
+	tokNumber
+	tokString
+	tokOp
+)
+
+var keywords = map[string]bool{
+	"AND":     true,
+	"BETWEEN": true,
+	"FALSE":   true,
+	"IN":      true,
+	"IS":      true,
+	"LIKE":    true,
+	"NOT":     true,
+	"NULL":    true,
+	"OR":      true,
+	"TRUE":    true,
+}
+
+var operators = []string{
+	"<>", "!=", "<=", ">=", "=", "<", ">", "(", ")", ",", ".", "[", "]", "-",
+}
+
+type parser struct {
+	md protoreflect.MessageDescriptor
+
+	src  string
+	off  int
+	line int
+	col  int
+	err  *expr.Error
+
+	// Current token.
+	kind  tokenKind
+	text  string // Keywords in upper case, unquoted identifiers and strings.
+	value constant.Value
+	pos   expr.Pos
+}
+
+func (p *parser) errorf(pos expr.Pos, format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = &expr.Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	}
+}
+
+func (p *parser) advance(n int) {
+	for _, c := range []byte(p.src[p.off : p.off+n]) {
+		if c == '\n' {
+			p.line++
+			p.col = 1
+		} else {
+			p.col++
+		}
+	}
+	p.off += n
+}
+
+func (p *parser) describe() string {
+	switch p.kind {
+	case tokEOF:
+		return "end of clause"
+	case tokString:
+		return p.src[p.pos.Offset:p.off]
+	default:
+		return p.text
+	}
+}
+
+// next token.  Errors are sticky: the current token becomes EOF.
+func (p *parser) next() {
+	for p.off < len(p.src) {
+		switch c := p.src[p.off]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			p.advance(1)
+			continue
+		case strings.HasPrefix(p.src[p.off:], "--"):
+			n := strings.IndexByte(p.src[p.off:], '\n')
+			if n < 0 {
+				n = len(p.src) - p.off
+			}
+			p.advance(n)
+			continue
+		}
+		break
+	}
+
+	p.pos = expr.Pos{Offset: p.off, Line: p.line, Column: p.col}
+	p.kind = tokEOF
+	p.text = ""
+	p.value = nil
+
+	if p.err != nil || p.off == len(p.src) {
+		return
+	}
+
+	s := p.src[p.off:]
+	c := s[0]
+
+	switch {
+	case isDigit(c) || (c == '.' && len(s) > 1 && isDigit(s[1])):
+		p.number(s)
+		return
+
+	case c == '\'':
+		p.quoted(s, tokString)
+		return
+
+	case c == '"' || c == '`':
+		p.quoted(s, tokIdent)
+		return
+
+	case isIdentStart(c):
+		n := 1
+		for n < len(s) && (isIdentStart(s[n]) || isDigit(s[n])) {
+			n++
+		}
+		p.text = s[:n]
+		p.kind = tokIdent
+		if upper := strings.ToUpper(p.text); keywords[upper] {
+			p.kind = tokKeyword
+			p.text = upper
+		}
+		p.advance(n)
+		return
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(s, op) {
+			p.kind = tokOp
+			p.text = op
+			p.advance(len(op))
+			return
+		}
+	}
+
+	r, _ := utf8.DecodeRuneInString(s)
+	p.errorf(p.pos, "unexpected character %q", r)
+}
+
+func (p *parser) number(s string) {
+	n := 0
+	float := false
+
+	for n < len(s) && isDigit(s[n]) {
+		n++
+	}
+	if n < len(s) && s[n] == '.' {
+		float = true
+		n++
+		for n < len(s) && isDigit(s[n]) {
+			n++
+		}
+	}
+	if n < len(s) && (s[n] == 'e' || s[n] == 'E') {
+		m := n + 1
+		if m < len(s) && (s[m] == '+' || s[m] == '-') {
+			m++
+		}
+		if m < len(s) && isDigit(s[m]) {
+			float = true
+			n = m
+			for n < len(s) && isDigit(s[n]) {
+				n++
+			}
+		}
+	}
+
+	tok := token.INT
+	if float {
+		tok = token.FLOAT
+	}
+
+	p.kind = tokNumber
+	p.text = s[:n]
+	p.value = constant.MakeFromLiteral(p.text, tok, 0)
+	if p.value.Kind() == constant.Unknown {
+		p.errorf(p.pos, "invalid number: %s", p.text)
+	}
+	p.advance(n)
+}
+
+// quoted string or identifier.  The quote character is escaped by doubling it.
+func (p *parser) quoted(s string, kind tokenKind) {
+	quote := s[0]
+	what := "string"
+	if kind == tokIdent {
+		what = "identifier"
+	}
+
+	var b strings.Builder
+	n := 1
+
+	for {
+		if n >= len(s) {
+			p.errorf(p.pos, "unterminated %s", what)
+			return
+		}
+		if s[n] == quote {
+			if n+1 < len(s) && s[n+1] == quote {
+				b.WriteByte(quote)
+				n += 2
+				continue
+			}
+			n++
+			break
+		}
+		b.WriteByte(s[n])
+		n++
+	}
+
+	p.kind = kind
+	p.text = b.String()
+	if kind == tokString {
+		p.value = constant.MakeString(p.text)
+	}
+	p.advance(n)
+}
+
+func (p *parser) isKeyword(word string) bool {
+	return p.kind == tokKeyword && p.text == word
+}
+
+func (p *parser) isOp(op string) bool {
+	return p.kind == tokOp && p.text == op
+}
+
+func (p *parser) expectKeyword(word string) {
+	if !p.isKeyword(word) {
+		p.errorf(p.pos, "expected %s but found %s", word, p.describe())
+	}
+	p.next()
+}
+
+func (p *parser) expectOp(op string) {
+	if !p.isOp(op) {
+		p.errorf(p.pos, "expected %s but found %s", op, p.describe())
+	}
+	p.next()
+}
+
+func (p *parser) parseOr() expr.Expr {
+	x := p.parseAnd()
+	for p.err == nil && p.isKeyword("OR") {
+		pos := p.pos
+		p.next()
+		x = &expr.Or{OpPos: pos, X: x, Y: p.parseAnd()}
+	}
+	return x
+}
+
+func (p *parser) parseAnd() expr.Expr {
+	x := p.parseNot()
+	for p.err == nil && p.isKeyword("AND") {
+		pos := p.pos
+		p.next()
+		x = &expr.And{OpPos: pos, X: x, Y: p.parseNot()}
+	}
+	return x
+}
+
+func (p *parser) parseNot() expr.Expr {
+	if p.isKeyword("NOT") {
+		pos := p.pos
+		p.next()
+		return &expr.Not{OpPos: pos, X: p.parseNot()}
+	}
+	return p.parsePredicate()
+}
+
+func (p *parser) parsePredicate() expr.Expr {
+	if p.isOp("(") {
+		p.next()
+		x := p.parseOr()
+		p.expectOp(")")
+		return x
+	}
+
+	x := p.parseOperand()
+	if p.err != nil {
+		return nil
+	}
+
+	if p.kind == tokOp {
+		var cmp op.Cmp
+		switch p.text {
+		case "<":
+			cmp = op.CmpLT
+		case ">=":
+			cmp = op.CmpGE
+		case "=":
+			cmp = op.CmpEQ
+		case "<>", "!=":
+			cmp = op.CmpNE
+		case "<=":
+			cmp = op.CmpLE
+		case ">":
+			cmp = op.CmpGT
+		default:
+			return x
+		}
+
+		pos := p.pos
+		p.next()
+		return &expr.Compare{OpPos: pos, Op: cmp, X: x, Y: p.parseOperand()}
+	}
+
+	if p.isKeyword("IS") {
+		pos := p.pos
+		p.next()
+		not := p.isKeyword("NOT")
+		if not {
+			p.next()
+		}
+		p.expectKeyword("NULL")
+
+		path, ok := x.(*expr.Path)
+		if !ok {
+			p.errorf(x.Pos(), "IS NULL operand must be a column")
+			return nil
+		}
+
+		var y expr.Expr = &expr.Has{FunPos: pos, Path: path}
+		if !not {
+			y = &expr.Not{OpPos: pos, X: y}
+		}
+		return y
+	}
+
+	pos := p.pos
+	not := p.isKeyword("NOT")
+	if not {
+		p.next()
+	}
+
+	var y expr.Expr
+
+	switch {
+	case p.isKeyword("IN"):
+		p.next()
+		y = p.parseIn(pos, x)
+
+	case p.isKeyword("BETWEEN"):
+		p.next()
+		lo := p.parseOperand()
+		p.expectKeyword("AND")
+		hi := p.parseOperand()
+		y = &expr.And{
+			OpPos: pos,
+			X:     &expr.Compare{OpPos: pos, Op: op.CmpGE, X: x, Y: lo},
+			Y:     &expr.Compare{OpPos: pos, Op: op.CmpLE, X: x, Y: hi},
+		}
+
+	case p.isKeyword("LIKE"):
+		p.errorf(p.pos, "LIKE is not supported")
+		return nil
+
+	default:
+		if not {
+			p.errorf(p.pos, "expected IN or BETWEEN but found %s", p.describe())
+		}
+		return x
+	}
+
+	if not {
+		y = &expr.Not{OpPos: pos, X: y}
+	}
+	return y
+}
+
+// parseIn after the IN keyword.  "x IN (a, b)" is lowered to a chain of
+// equality comparisons, or if x is a packed repeated field, to a chain of
+// element tests.  "value IN column" tests whether a packed repeated field
+// contains the value.
+func (p *parser) parseIn(pos expr.Pos, x expr.Expr) expr.Expr {
+	if !p.isOp("(") {
+		y := p.parsePath()
+		if y == nil {
+			return nil
+		}
+		return &expr.In{OpPos: pos, X: x, Y: y}
+	}
+	p.next()
+
+	vector := false
+	if path, ok := x.(*expr.Path); ok {
+		if f, err := build.ResolveField(p.md, path.Name); err == nil && f.Kind == op.FieldVector {
+			vector = true
+		}
+	}
+
+	var chain expr.Expr
+
+	for p.err == nil {
+		v := p.parseOperand()
+		if v == nil {
+			return nil
+		}
+
+		var y expr.Expr
+		if vector {
+			y = &expr.In{OpPos: v.Pos(), X: v, Y: x.(*expr.Path)}
+		} else {
+			y = &expr.Compare{OpPos: v.Pos(), Op: op.CmpEQ, X: x, Y: v}
+		}
+
+		if chain == nil {
+			chain = y
+		} else {
+			chain = &expr.Or{OpPos: pos, X: chain, Y: y}
+		}
+
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+
+	p.expectOp(")")
+	return chain
+}
+
+func (p *parser) parseOperand() expr.Expr {
+	pos := p.pos
+
+	switch p.kind {
+	case tokIdent:
+		return p.parsePath()
+
+	case tokKeyword:
+		switch p.text {
+		case "TRUE", "FALSE":
+			v := constant.MakeBool(p.text == "TRUE")
+			p.next()
+			return &expr.Literal{ValuePos: pos, Value: v}
+
+		case "NULL":
+			p.errorf(pos, "NULL can only be used with IS NULL or IS NOT NULL")
+			return nil
+		}
+
+	case tokOp:
+		if p.text == "-" {
+			p.next()
+			if p.kind != tokNumber {
+				p.errorf(p.pos, "expected number but found %s", p.describe())
+				return nil
+			}
+			v := constant.UnaryOp(token.SUB, p.value, 0)
+			p.next()
+			return &expr.Literal{ValuePos: pos, Value: v}
+		}
+
+	case tokNumber, tokString:
+		v := p.value
+		p.next()
+		return &expr.Literal{ValuePos: pos, Value: v}
+	}
+
+	p.errorf(pos, "expected operand but found %s", p.describe())
+	return nil
+}
+
+// parsePath of a column: identifiers separated by dots, with optional
+// bracketed indexes.
+func (p *parser) parsePath() *expr.Path {
+	pos := p.pos
+	var b strings.Builder
+
+	if p.kind != tokIdent {
+		p.errorf(pos, "expected column but found %s", p.describe())
+		return nil
+	}
+	b.WriteString(p.text)
+	p.next()
+
+	for p.err == nil {
+		switch {
+		case p.isOp("."):
+			p.next()
+			if p.kind != tokIdent {
+				p.errorf(p.pos, "expected field name but found %s", p.describe())
+			}
+			b.WriteString(".")
+			b.WriteString(p.text)
+			p.next()
+
+		case p.isOp("["):
+			p.next()
+			if p.kind != tokNumber || p.value.Kind() != constant.Int {
+				p.errorf(p.pos, "expected index but found %s", p.describe())
+			}
+			b.WriteString("[")
+			b.WriteString(p.text)
+			b.WriteString("]")
+			p.next()
+			p.expectOp("]")
+
+		default:
+			return &expr.Path{NamePos: pos, Name: b.String()}
+		}
+	}
+
+	return nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,54 @@
+// Package where compiles SQL WHERE clauses into PBF bytecode.  Columns are
+// fields of a protobuf message:
+//
+//	a = 1 AND (d < 0 OR l = 'Hello, world!') AND t IS NOT NULL
+//
+// Keywords are case-insensitive.  The supported predicates:
+//
+//   - Comparisons with =, <> (or !=), <, <=, > and >=.
+//   - IS NULL and IS NOT NULL, testing field presence.
+//   - x [NOT] IN (v1, v2, ...), a chain of equality comparisons.  If x is a
+//     packed repeated field, it tests whether any of the values is an element.
+//   - value [NOT] IN column, testing whether a packed repeated field contains
+//     the value.
+//   - x [NOT] BETWEEN lo AND hi.
+//
+// Columns can be qualified with nested field names and list indexes (q[1].x),
+// and quoted with double quotes or backticks.  String literals use single
+// quotes.  Comments start with --.
+package where
+
+import (
+	"github.com/ninchat/pbf/expr"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Parse a WHERE clause into an expr syntax tree.  The message type determines
+// how IN lists are lowered.  Errors are *expr.Error.
+func Parse(src string, md protoreflect.MessageDescriptor) (expr.Expr, error) {
+	p := parser{
+		md:   md,
+		src:  src,
+		line: 1,
+		col:  1,
+	}
+	p.next()
+
+	x := p.parseOr()
+	if p.err == nil && p.kind != tokEOF {
+		p.errorf(p.pos, "unexpected %s", p.describe())
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return x, nil
+}
+
+// Compile a WHERE clause into bytecode.  Errors are *expr.Error.
+func Compile(src string, md protoreflect.MessageDescriptor) ([]byte, error) {
+	x, err := Parse(src, md)
+	if err != nil {
+		return nil, err
+	}
+	return expr.Compile(x, md)
+}
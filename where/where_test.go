@@ -0,0 +1,62 @@
+package where_test
+
+import (
+	"testing"
+
+	"github.com/ninchat/pbf/internal/test"
+	"github.com/ninchat/pbf/where"
+)
+
+func TestWhere(t *testing.T) {
+	for src, result := range map[string]bool{
+		`a = 1 AND (d < 0 OR l = 'Hello, world!') AND t IS NOT NULL`: true,
+		`a = 1 and (d > 0 or l = 'Hello') and t is not null`:         false,
+		`s IS NULL AND r IS NOT NULL AND NOT a IS NULL`:              true,
+		`a <> 1 OR b != 1`:                                      true,
+		`c IN (1, 2, 3) AND e NOT IN (5, -6)`:                   true,
+		`c IN (1, 2) OR e NOT IN (-5, -6)`:                      false,
+		`m IN (10, 4) AND o.z NOT IN (7, 8)`:                    true,
+		`m IN (10, 11)`:                                         false,
+		`4 IN m AND -3 IN o.z AND 8 NOT IN o.z`:                 true,
+		`2.2 IN u`:                                              true,
+		`c BETWEEN 3 AND 4 AND d NOT BETWEEN 0 AND 10`:          true,
+		`n.x > 1000 AND q[2].x = 102 AND "k" = 'PBF'`:           true,
+		`l = 'Hello, world!' AND l > 'Hello' AND ` + "`l` <> k": true,
+		"-- comment\na = 1\n-- AND a = 2":                       true,
+		`TRUE AND (FALSE OR c <> 3)`:                            false,
+	} {
+		if ok := test.FilterSource(t, src, where.Compile); ok != result {
+			t.Errorf("%s: %v", src, ok)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	md := (&test.Test{}).ProtoReflect().Descriptor()
+
+	for src, msg := range map[string]string{
+		``:                 "1:1: expected operand but found end of clause",
+		`a = 1 AND`:        "1:10: expected operand but found end of clause",
+		`(a = 1`:           "1:7: expected ) but found end of clause",
+		`a = 1 b`:          "1:7: unexpected b",
+		`a = NULL`:         "1:5: NULL can only be used with IS NULL or IS NOT NULL",
+		`1 IS NULL`:        "1:1: IS NULL operand must be a column",
+		`a IS 1`:           "1:6: expected NULL but found 1",
+		`a NOT = 1`:        "1:7: expected IN or BETWEEN but found =",
+		`l LIKE 'H%'`:      "1:3: LIKE is not supported",
+		`a IN ()`:          "1:7: expected operand but found )",
+		`a IN (1, 2`:       "1:11: expected ) but found end of clause",
+		`l = 'x`:           "1:5: unterminated string",
+		`a = - 'x'`:        "1:7: expected number but found 'x'",
+		"a = 1 AND\nb # 2": "2:3: unexpected character '#'",
+		`a = -1`:           "1:5: constant -1 overflows uint32 field a",
+		`1 IN a`:           "1:6: field a is not a packed repeated field",
+	} {
+		_, err := where.Compile(src, md)
+		if err == nil {
+			t.Errorf("%q: no error", src)
+		} else if err.Error() != msg {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+}